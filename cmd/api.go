@@ -0,0 +1,372 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	apiListen    string
+	apiKeysFile  string
+	apiMaxBatch  int
+	apiRate      float64
+	apiBurst     int
+	apiCacheSize int
+	apiCacheTTL  time.Duration
+)
+
+// apiResult is the normalized form of a URLhaus response served by the API
+type apiResult struct {
+	Type         string            `json:"type"`
+	Query        string            `json:"query"`
+	QueryStatus  string            `json:"query_status"`
+	FirstSeen    string            `json:"firstseen,omitempty"`
+	LastSeen     string            `json:"lastseen,omitempty"`
+	URLCount     int               `json:"url_count"`
+	PayloadCount int               `json:"payload_count,omitempty"`
+	Blacklists   map[string]string `json:"blacklists,omitempty"`
+	URLs         []urlEntry        `json:"urls"`
+	Payloads     []payloadEntry    `json:"payloads"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// apiEndpoints maps the API paths to the lookups they perform
+var apiEndpoints = map[string]string{
+	"/v1/url":       "url",
+	"/v1/host":      "host",
+	"/v1/payload":   "payload",
+	"/v1/tag":       "tag",
+	"/v1/signature": "signature",
+}
+
+// serveAPICmd represents the serve-api command
+var serveAPICmd = &cobra.Command{
+	Use:   "serve-api",
+	Short: "Run a local REST API in front of URLhaus",
+	Long: `This command runs a JSON API mirroring the lookup commands, so that many
+tools can share one cache and one upstream quota:
+
+  GET  /v1/url?url=...             POST /v1/url        ["...", ...]
+  GET  /v1/host?host=...           POST /v1/host       ["...", ...]
+  GET  /v1/payload?md5=...         POST /v1/payload    ["...", ...]
+  GET  /v1/payload?sha256=...
+  GET  /v1/tag?tag=...             POST /v1/tag        ["...", ...]
+  GET  /v1/signature?signature=... POST /v1/signature  ["...", ...]
+
+POST requests take a JSON array of values and return an array of results
+in the same order. Results are normalized: URLs and payloads have the same
+fields whatever the endpoint. The OpenAPI 3 document is served at
+/openapi.json.
+
+With --api-keys, requests must carry one of the keys in the X-API-Key header
+or as a bearer token. The file has one key per line, optionally preceded by
+the name of its user.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		s := &apiServer{
+			cache:   newLRUCache(apiCacheSize, apiCacheTTL),
+			limiter: newRateLimiter(apiRate, apiBurst),
+		}
+		if apiKeysFile != "" {
+			keys, err := readAPIKeys(apiKeysFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			s.keys = keys
+		} else {
+			log.Print("warning: no --api-keys, the API is open to anyone who can reach it")
+		}
+
+		mux := http.NewServeMux()
+		for path, kind := range apiEndpoints {
+			mux.Handle(path, s.authenticated(s.lookup(kind)))
+		}
+		mux.HandleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(openAPISpec))
+		})
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok\n"))
+		})
+
+		srv := &http.Server{Addr: apiListen, Handler: logRequests(mux)}
+		serveGracefully(srv, serveShutdownTimeout, nil)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serveAPICmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// serveAPICmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// serveAPICmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	serveAPICmd.Flags().StringVarP(&apiListen, "listen", "l", "127.0.0.1:8081", "The address to listen on")
+	serveAPICmd.Flags().StringVar(&apiKeysFile, "api-keys", "", "A file of accepted API keys")
+	serveAPICmd.Flags().IntVar(&apiMaxBatch, "max-batch", 100, "The most values in a POST request")
+	serveAPICmd.Flags().Float64Var(&apiRate, "rate", 0, "The requests per second allowed per user (0 for no limit)")
+	serveAPICmd.Flags().IntVar(&apiBurst, "burst", 20, "The requests a user may send at once")
+	serveAPICmd.Flags().IntVar(&apiCacheSize, "cache-size", 10000, "The number of results kept in memory")
+	serveAPICmd.Flags().DurationVar(&apiCacheTTL, "cache-ttl", 15*time.Minute, "How long results are kept in memory")
+	serveAPICmd.Flags().DurationVar(&serveShutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait for requests in flight on shutdown")
+}
+
+type apiServer struct {
+	keys    map[string]string // key to user
+	cache   *lruCache
+	limiter *rateLimiter
+
+	mu       sync.Mutex
+	inflight map[string]*apiCall
+}
+
+// apiCall is a lookup in progress that concurrent requests wait for
+type apiCall struct {
+	done chan struct{}
+	res  apiResult
+}
+
+// readAPIKeys reads a file of "[user] key" lines
+func readAPIKeys(name string) (map[string]string, error) {
+	lines, err := readLines(name)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]string{}
+	for i, l := range lines {
+		f := strings.Fields(l)
+		switch len(f) {
+		case 1:
+			keys[f[0]] = fmt.Sprintf("key%d", i+1)
+		case 2:
+			keys[f[1]] = f[0]
+		default:
+			return nil, fmt.Errorf("%s: malformed line %q", name, l)
+		}
+	}
+	return keys, nil
+}
+
+// authenticated checks the API key and rate limit of requests
+func (s *apiServer) authenticated(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the user is only ever set from a valid key
+		r.Header.Del("X-URLhaus-User")
+		if s.keys != nil {
+			key := r.Header.Get("X-API-Key")
+			if key == "" && strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+				key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			}
+			user, ok := s.keys[key]
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="urlhaus-cli"`)
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or invalid API key"})
+				return
+			}
+			r.Header.Set("X-URLhaus-User", user)
+		}
+		if rateLimited(w, r, s.limiter, "X-URLhaus-User") {
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// lookup handles the GET and POST requests of an endpoint
+func (s *apiServer) lookup(kind string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			q := r.URL.Query()
+			param := kind
+			if kind == "payload" {
+				param = "md5"
+				if q.Get("sha256") != "" {
+					param = "sha256"
+				}
+			}
+			value := q.Get(param)
+			if value == "" {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing " + param + " parameter"})
+				return
+			}
+			res := s.result(param, value)
+			writeJSON(w, apiStatus(res), res)
+
+		case http.MethodPost:
+			var values []string
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+			if err == nil {
+				err = json.Unmarshal(body, &values)
+			}
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "the body must be a JSON array of strings"})
+				return
+			}
+			if len(values) > apiMaxBatch {
+				writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": fmt.Sprintf("at most %d values per request", apiMaxBatch)})
+				return
+			}
+
+			results := make([]apiResult, len(values))
+			var wg sync.WaitGroup
+			sem := make(chan struct{}, 4)
+			for i, v := range values {
+				param := kind
+				if kind == "payload" {
+					param = "md5"
+					if len(v) == 64 {
+						param = "sha256"
+					}
+				}
+				wg.Add(1)
+				sem <- struct{}{}
+				go func(i int, param, v string) {
+					defer func() { <-sem; wg.Done() }()
+					results[i] = s.result(param, v)
+				}(i, param, v)
+			}
+			wg.Wait()
+			writeJSON(w, http.StatusOK, results)
+
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		}
+	})
+}
+
+// apiStatus is the HTTP status of a single result
+func apiStatus(res apiResult) int {
+	if res.Error != "" {
+		return http.StatusBadGateway
+	}
+	return http.StatusOK
+}
+
+// result looks a value up, sharing the cache and the lookups in progress
+// between all requests.
+func (s *apiServer) result(kind, value string) apiResult {
+	key := kind + " " + value
+	if v, ok := s.cache.get(key); ok {
+		return v.(apiResult)
+	}
+
+	s.mu.Lock()
+	if s.inflight == nil {
+		s.inflight = map[string]*apiCall{}
+	}
+	if c, ok := s.inflight[key]; ok {
+		s.mu.Unlock()
+		<-c.done
+		return c.res
+	}
+	c := &apiCall{done: make(chan struct{})}
+	s.inflight[key] = c
+	s.mu.Unlock()
+
+	r, err := lookupResult(kind, value)
+	if err != nil {
+		typ := kind
+		if typ == "md5" || typ == "sha256" {
+			typ = "payload"
+		}
+		c.res = apiResult{Type: typ, Query: value, URLs: []urlEntry{}, Payloads: []payloadEntry{}, Error: err.Error()}
+	} else {
+		c.res = normalizeResult(r)
+		s.cache.put(key, c.res)
+	}
+
+	s.mu.Lock()
+	delete(s.inflight, key)
+	s.mu.Unlock()
+	close(c.done)
+	return c.res
+}
+
+// normalizeResult turns a URLhaus response into an apiResult
+func normalizeResult(r result) apiResult {
+	res := apiResult{
+		Type:        r.kind,
+		Query:       r.query,
+		QueryStatus: str(r.data, "query_status"),
+		FirstSeen:   str(r.data, "firstseen"),
+		LastSeen:    str(r.data, "lastseen"),
+		Blacklists:  strMap(r.data, "blacklists"),
+		URLs:        r.urls(),
+		Payloads:    r.payloads(),
+	}
+	if res.URLs == nil {
+		res.URLs = []urlEntry{}
+	}
+	if res.Payloads == nil {
+		res.Payloads = []payloadEntry{}
+	}
+	fmt.Sscan(str(r.data, "url_count"), &res.URLCount)
+	fmt.Sscan(str(r.data, "payload_count"), &res.PayloadCount)
+	if r.kind == "url" && res.QueryStatus == "ok" {
+		res.URLCount = 1
+		res.FirstSeen = str(r.data, "date_added")
+	}
+	return res
+}
+
+// statusRecorder remembers the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// logRequests logs every request with its user, status and duration
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+
+		user := r.Header.Get("X-URLhaus-User")
+		if user == "" {
+			user = "-"
+		}
+		log.Printf("%s %s %s %s %d %s", clientID(r, ""), user, r.Method, r.URL.Path, rec.status, time.Since(start).Round(time.Millisecond))
+	})
+}
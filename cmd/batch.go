@@ -0,0 +1,219 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	batchInputFormat string
+	batchColumns     []string
+	batchDelimiter   string
+	batchNoHeader    bool
+	batchFormat      string
+	batchOutput      string
+	batchListedOnly  bool
+	batchWorkers     int
+	batchNotify      string
+)
+
+// batchResult is the verdict about an indicator of a feed, with the ID of
+// the feed entry it comes from
+type batchResult struct {
+	Feed   string `json:"feed"`
+	FeedID string `json:"feed_id,omitempty"`
+	verdict
+	Error string `json:"error,omitempty"`
+}
+
+// batchCmd represents the batch command
+var batchCmd = &cobra.Command{
+	Use:   "batch [file...]",
+	Short: "Check the indicators of files and feeds",
+	Long: `This command checks the indicators read from files (or the standard input),
+in the mirror first, and writes the verdict about each of them along with
+the file and the ID of the feed entry it was read from, so results
+can be joined back to the feeds.
+
+The --input-format is one of:
+  lines  one URL, host, MD5 or SHA256 per line, the ID is the line number;
+         the lines of another kind are skipped
+  stix   STIX 2.0 and 2.1 bundles: the URL, domain, IP address and file
+         hash comparisons of indicator patterns, and the observables; the
+         ID is the STIX ID
+  misp   MISP events (and restSearch results): the url, domain, hostname,
+         ip-src, ip-dst, md5 and sha256 attributes, composite ones
+         included; the ID is the attribute UUID
+  csv    the columns given by --column name=column, where the column is a
+         header name or a 1-based index, and the name is one of url, host,
+         md5, sha256, value (along with type, or guessed) and id; the ID
+         is the id column or the line number of the row
+  auto   guessed from the content and the file extension (the default)`,
+	Run: func(cmd *cobra.Command, args []string) {
+		switch batchFormat {
+		case "ndjson", "json", "csv", "text":
+		default:
+			log.Fatalf("unknown format %q", batchFormat)
+		}
+		if len(args) == 0 {
+			args = []string{"-"}
+		}
+
+		var inputs []batchIndicator
+		for _, name := range args {
+			in, err := readBatchInput(name, batchInputFormat)
+			if err != nil {
+				log.Fatal(err)
+			}
+			inputs = append(inputs, in...)
+		}
+
+		c, err := newChecker()
+		if err != nil {
+			log.Fatal(err)
+		}
+		var nt *notifier
+		if batchNotify != "" {
+			if nt, err = newNotifier(batchNotify); err != nil {
+				log.Fatal(err)
+			}
+		}
+		out, err := newNDJSONLogger(batchOutput)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var indicators []logIndicator
+		for _, in := range inputs {
+			indicators = append(indicators, in.logIndicator)
+		}
+		verdicts, failed := checkAll(c, indicators, batchWorkers)
+
+		results := []*batchResult{}
+		for _, in := range inputs {
+			r := &batchResult{Feed: in.Source, FeedID: in.ID, verdict: verdicts[in.logIndicator]}
+			if err := failed[in.logIndicator]; err != nil {
+				r.Error = err.Error()
+			}
+			if batchListedOnly && !r.Listed {
+				continue
+			}
+			results = append(results, r)
+			if nt != nil && r.Listed {
+				nt.notify(r.notification())
+			}
+		}
+		if nt != nil {
+			defer nt.flush(time.Minute)
+		}
+
+		switch batchFormat {
+		case "ndjson":
+			for _, r := range results {
+				if err = out.log(r); err != nil {
+					break
+				}
+			}
+		case "json":
+			err = out.log(results)
+		case "csv":
+			err = writeBatchCSV(out.w, results)
+		case "text":
+			w := bufio.NewWriter(out.w)
+			for _, r := range results {
+				r.writeText(w)
+			}
+			err = w.Flush()
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(batchCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// batchCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// batchCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	batchCmd.Flags().StringVar(&batchInputFormat, "input-format", "auto", "The input format: lines, stix, misp, csv or auto")
+	batchCmd.Flags().StringArrayVar(&batchColumns, "column", nil, "A CSV column mapping such as url=2, value=indicator or id=uuid")
+	batchCmd.Flags().StringVar(&batchDelimiter, "delimiter", ",", "The CSV field delimiter")
+	batchCmd.Flags().BoolVar(&batchNoHeader, "no-header", false, "The CSV input has no header line")
+	batchCmd.Flags().StringVarP(&batchFormat, "format", "f", "ndjson", "The output format: ndjson, json, csv or text")
+	batchCmd.Flags().StringVarP(&batchOutput, "output", "o", "-", "The file the results are written to")
+	batchCmd.Flags().BoolVar(&batchListedOnly, "listed-only", false, "Only write the listed indicators")
+	batchCmd.Flags().IntVar(&batchWorkers, "workers", 8, "The number of concurrent lookups")
+	batchCmd.Flags().StringVar(&batchNotify, "notify", "", "A JSON file configuring where listed indicators are notified")
+	addCheckerFlags(batchCmd)
+}
+
+func (r *batchResult) notification() notification {
+	return notification{
+		Time:      time.Now().UTC(),
+		Source:    "batch",
+		Summary:   r.summary() + " (" + r.Feed + " " + r.FeedID + ")",
+		Reference: r.Reference,
+		Event:     r,
+		Key:       "batch|" + r.Type + "|" + r.Indicator,
+	}
+}
+
+func (r *batchResult) writeText(w io.Writer) {
+	fmt.Fprintf(w, "%s %s: ", r.Feed, r.FeedID)
+	if r.Error != "" {
+		fmt.Fprintf(w, "%s %s: %s\n", r.Type, r.Indicator, r.Error)
+		return
+	}
+	fmt.Fprintln(w, r.summary())
+}
+
+func writeBatchCSV(w io.Writer, results []*batchResult) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"feed", "feed_id", "type", "indicator", "listed", "status", "threat", "signature", "tags", "url_count", "urlhaus_reference", "error"})
+	for _, r := range results {
+		cw.Write([]string{
+			r.Feed, r.FeedID, r.Type, r.Indicator, strconv.FormatBool(r.Listed),
+			r.Status, r.Threat, r.Signature, strings.Join(r.Tags, ","),
+			strconv.Itoa(r.URLCount), r.Reference, r.Error,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
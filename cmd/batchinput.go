@@ -0,0 +1,468 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// batchIndicator is an indicator read from a feed, along with the ID of
+// its entry in the feed
+type batchIndicator struct {
+	logIndicator
+	Source string
+	ID     string
+}
+
+var (
+	hexRe = regexp.MustCompile(`^[a-fA-F0-9]+$`)
+
+	// stixComparisonRe matches the comparisons of a STIX pattern, such as
+	// [file:hashes.'SHA-256' = '...']
+	stixComparisonRe = regexp.MustCompile(`([a-z0-9-]+):([A-Za-z0-9_.'-]+)\s*=\s*'((?:[^'\\]|\\.)*)'`)
+)
+
+// classifyIndicator returns the type of an indicator (url, host, md5 or
+// sha256), or "" if it is none
+func classifyIndicator(s string) string {
+	switch {
+	case strings.Contains(s, "://"):
+		return "url"
+	case len(s) == 32 && hexRe.MatchString(s):
+		return "md5"
+	case len(s) == 64 && hexRe.MatchString(s):
+		return "sha256"
+	case isIP(s):
+		return "host"
+	case domainRe.FindString(s) == s && strings.Contains(s, "."):
+		return "host"
+	}
+	return ""
+}
+
+// normalizeIndicator returns an indicator the way it is looked up
+func normalizeIndicator(typ, value string) logIndicator {
+	value = strings.TrimSpace(value)
+	switch typ {
+	case "host":
+		value = strings.ToLower(strings.Trim(value, "[]"))
+		value = strings.TrimSuffix(value, ".")
+	case "md5", "sha256":
+		value = strings.ToLower(value)
+	}
+	return logIndicator{typ, value}
+}
+
+// readBatchInput reads the indicators of a feed in the given format: lines,
+// stix, misp, csv, or auto to guess it
+func readBatchInput(name, format string) ([]batchIndicator, error) {
+	f, err := openInput(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == "auto" {
+		format = guessBatchFormat(name, b)
+	}
+	var indicators []batchIndicator
+	switch format {
+	case "lines":
+		indicators, err = readBatchLines(name, b)
+	case "stix":
+		indicators, err = readSTIX(b)
+	case "misp":
+		indicators, err = readMISP(b)
+	case "csv":
+		indicators, err = readBatchCSV(b)
+	default:
+		return nil, fmt.Errorf("unknown input format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	for i := range indicators {
+		indicators[i].Source = name
+	}
+	return indicators, nil
+}
+
+// guessBatchFormat tells the format of a feed from its name and content
+func guessBatchFormat(name string, b []byte) string {
+	trimmed := bytes.TrimSpace(b)
+	if bytes.HasPrefix(trimmed, []byte("{")) || bytes.HasPrefix(trimmed, []byte("[")) {
+		var probe struct {
+			Type    string          `json:"type"`
+			Objects json.RawMessage `json:"objects"`
+		}
+		if json.Unmarshal(trimmed, &probe) == nil && (probe.Type == "bundle" || probe.Objects != nil) {
+			return "stix"
+		}
+		return "misp"
+	}
+	if strings.EqualFold(filepath.Ext(name), ".csv") || len(batchColumns) > 0 {
+		return "csv"
+	}
+	return "lines"
+}
+
+// readBatchLines reads one indicator per line, skipping comments and
+// logging the lines that are not indicators. The line numbers are the IDs.
+func readBatchLines(name string, b []byte) ([]batchIndicator, error) {
+	var indicators []batchIndicator
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		typ := classifyIndicator(line)
+		if typ == "" {
+			log.Printf("%s: line %d: unknown indicator type of %q, skipped", name, n, line)
+			continue
+		}
+		indicators = append(indicators, batchIndicator{
+			logIndicator: normalizeIndicator(typ, line),
+			ID:           strconv.Itoa(n),
+		})
+	}
+	return indicators, sc.Err()
+}
+
+// readSTIX reads the indicators of the patterns and the observables of a
+// STIX 2.0 or 2.1 bundle. The STIX IDs are the IDs.
+func readSTIX(b []byte) ([]batchIndicator, error) {
+	var bundle struct {
+		Objects []map[string]interface{} `json:"objects"`
+	}
+	if err := json.Unmarshal(b, &bundle); err != nil {
+		return nil, err
+	}
+
+	var indicators []batchIndicator
+	add := func(id, typ, value string) {
+		if typ != "" && value != "" {
+			indicators = append(indicators, batchIndicator{logIndicator: normalizeIndicator(typ, value), ID: id})
+		}
+	}
+	var observable func(id string, o map[string]interface{})
+	observable = func(id string, o map[string]interface{}) {
+		switch str(o, "type") {
+		case "url":
+			add(id, "url", str(o, "value"))
+		case "domain-name":
+			add(id, "host", str(o, "value"))
+		case "ipv4-addr", "ipv6-addr":
+			add(id, "host", stixAddress(str(o, "value")))
+		case "file":
+			hashes, _ := o["hashes"].(map[string]interface{})
+			for algo := range hashes {
+				add(id, stixHashType(algo), str(hashes, algo))
+			}
+		}
+	}
+
+	for _, o := range bundle.Objects {
+		id := str(o, "id")
+		switch str(o, "type") {
+		case "indicator":
+			if pt := str(o, "pattern_type"); pt != "" && pt != "stix" {
+				continue
+			}
+			for _, m := range stixComparisonRe.FindAllStringSubmatch(str(o, "pattern"), -1) {
+				value := strings.NewReplacer(`\'`, `'`, `\\`, `\`).Replace(m[3])
+				switch path := m[2]; {
+				case m[1] == "url" && path == "value":
+					add(id, "url", value)
+				case m[1] == "domain-name" && path == "value":
+					add(id, "host", value)
+				case (m[1] == "ipv4-addr" || m[1] == "ipv6-addr") && path == "value":
+					add(id, "host", stixAddress(value))
+				case m[1] == "file" && strings.HasPrefix(path, "hashes."):
+					add(id, stixHashType(strings.Trim(strings.TrimPrefix(path, "hashes."), "'")), value)
+				}
+			}
+		case "observed-data":
+			// STIX 2.0 embeds the observables
+			objects, _ := o["objects"].(map[string]interface{})
+			for _, v := range objects {
+				if sub, ok := v.(map[string]interface{}); ok {
+					observable(id, sub)
+				}
+			}
+		default:
+			observable(id, o)
+		}
+	}
+	return indicators, nil
+}
+
+// stixAddress strips the prefix length of a single address
+func stixAddress(s string) string {
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		if bits := s[i+1:]; bits != "32" && bits != "128" {
+			// networks can not be looked up
+			return ""
+		}
+		s = s[:i]
+	}
+	return s
+}
+
+func stixHashType(algo string) string {
+	switch strings.ToUpper(strings.Replace(algo, "-", "", -1)) {
+	case "MD5":
+		return "md5"
+	case "SHA256":
+		return "sha256"
+	}
+	return ""
+}
+
+// mispAttribute is an attribute of a MISP event
+type mispAttribute struct {
+	ID    string `json:"id"`
+	UUID  string `json:"uuid"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// mispEvent is a MISP event, with the attributes of its objects
+type mispEvent struct {
+	Attribute []mispAttribute `json:"Attribute"`
+	Object    []struct {
+		Attribute []mispAttribute `json:"Attribute"`
+	} `json:"Object"`
+}
+
+// readMISP reads the attributes of MISP events, as exported or returned by
+// the events and attributes restSearch. The attribute UUIDs are the IDs.
+func readMISP(b []byte) ([]batchIndicator, error) {
+	var events []mispEvent
+	var doc struct {
+		Event     *mispEvent      `json:"Event"`
+		Attribute []mispAttribute `json:"Attribute"`
+		Response  json.RawMessage `json:"response"`
+	}
+
+	trimmed := bytes.TrimSpace(b)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		var list []struct {
+			Event mispEvent `json:"Event"`
+		}
+		if err := json.Unmarshal(trimmed, &list); err != nil {
+			return nil, err
+		}
+		for _, e := range list {
+			events = append(events, e.Event)
+		}
+	} else {
+		if err := json.Unmarshal(trimmed, &doc); err != nil {
+			return nil, err
+		}
+		if doc.Event != nil {
+			events = append(events, *doc.Event)
+		}
+		if doc.Attribute != nil {
+			events = append(events, mispEvent{Attribute: doc.Attribute})
+		}
+		if doc.Response != nil {
+			// restSearch: a list of events, or the attributes
+			var list []struct {
+				Event mispEvent `json:"Event"`
+			}
+			var attributes struct {
+				Attribute []mispAttribute `json:"Attribute"`
+			}
+			if json.Unmarshal(doc.Response, &list) == nil {
+				for _, e := range list {
+					events = append(events, e.Event)
+				}
+			} else if err := json.Unmarshal(doc.Response, &attributes); err == nil {
+				events = append(events, mispEvent{Attribute: attributes.Attribute})
+			} else {
+				return nil, err
+			}
+		}
+	}
+
+	var indicators []batchIndicator
+	for _, e := range events {
+		attributes := e.Attribute
+		for _, o := range e.Object {
+			attributes = append(attributes, o.Attribute...)
+		}
+		for _, a := range attributes {
+			id := a.UUID
+			if id == "" {
+				id = a.ID
+			}
+			for _, in := range mispIndicators(a.Type, a.Value) {
+				indicators = append(indicators, batchIndicator{logIndicator: in, ID: id})
+			}
+		}
+	}
+	return indicators, nil
+}
+
+// mispIndicators returns the indicators of an attribute, splitting the
+// composite ones such as filename|sha256 or domain|ip
+func mispIndicators(typ, value string) []logIndicator {
+	types, values := strings.Split(typ, "|"), strings.Split(value, "|")
+	if len(types) != len(values) {
+		types, values = types[:1], []string{value}
+	}
+	var indicators []logIndicator
+	for i, t := range types {
+		v := values[i]
+		switch t {
+		case "url", "uri", "link":
+			if strings.Contains(v, "://") {
+				indicators = append(indicators, normalizeIndicator("url", v))
+			}
+		case "domain", "hostname", "ip", "ip-dst", "ip-src":
+			indicators = append(indicators, normalizeIndicator("host", v))
+		case "md5", "sha256":
+			indicators = append(indicators, normalizeIndicator(t, v))
+		}
+	}
+	return indicators
+}
+
+// readBatchCSV reads the indicators of the CSV columns given by --column,
+// as name=column where the name is value (with type, or guessed), url,
+// host, md5, sha256 or id, and the column a header name or a 1-based index
+func readBatchCSV(b []byte) ([]batchIndicator, error) {
+	cr := csv.NewReader(bytes.NewReader(b))
+	cr.FieldsPerRecord = -1
+	cr.Comment = '#'
+	cr.LazyQuotes = true
+	if batchDelimiter != "" {
+		cr.Comma = []rune(batchDelimiter)[0]
+	}
+
+	var header []string
+	if !batchNoHeader {
+		h, err := cr.Read()
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		header = h
+	}
+
+	columns := map[string]int{}
+	mapping := batchColumns
+	if len(mapping) == 0 {
+		mapping = []string{"value=1"}
+	}
+	for _, m := range mapping {
+		i := strings.IndexByte(m, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid column mapping %q, expecting name=column", m)
+		}
+		name, column := strings.ToLower(m[:i]), m[i+1:]
+		switch name {
+		case "value", "type", "id", "url", "host", "md5", "sha256":
+		default:
+			return nil, fmt.Errorf("unknown column name %q", name)
+		}
+		idx, err := csvColumn(header, column)
+		if err != nil {
+			return nil, err
+		}
+		columns[name] = idx
+	}
+
+	var indicators []batchIndicator
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+
+		id := field("id")
+		if _, ok := columns["id"]; !ok {
+			// the line the row starts on
+			line, _ := cr.FieldPos(0)
+			id = strconv.Itoa(line)
+		}
+		add := func(typ, value string) {
+			if typ != "" && value != "" {
+				indicators = append(indicators, batchIndicator{logIndicator: normalizeIndicator(typ, value), ID: id})
+			}
+		}
+		for _, typ := range []string{"url", "host", "md5", "sha256"} {
+			add(typ, field(typ))
+		}
+		if value := field("value"); value != "" {
+			typ := strings.ToLower(field("type"))
+			switch typ {
+			case "domain", "hostname", "ip", "ip-dst", "domain-name", "ipv4-addr", "ipv6-addr":
+				typ = "host"
+			case "url", "host", "md5", "sha256":
+			default:
+				typ = classifyIndicator(value)
+			}
+			add(typ, value)
+		}
+	}
+	return indicators, nil
+}
+
+// csvColumn returns the index of a column given by header name or 1-based
+// index
+func csvColumn(header []string, column string) (int, error) {
+	for i, h := range header {
+		if strings.EqualFold(strings.TrimSpace(h), column) {
+			return i, nil
+		}
+	}
+	if i, err := strconv.Atoi(column); err == nil && i >= 1 {
+		return i - 1, nil
+	}
+	return 0, fmt.Errorf("unknown column %q", column)
+}
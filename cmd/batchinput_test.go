@@ -0,0 +1,232 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// sortBatch sorts indicators by ID and value, the order of the hashes of
+// STIX files being random
+func sortBatch(indicators []batchIndicator) []batchIndicator {
+	sort.SliceStable(indicators, func(i, j int) bool {
+		if indicators[i].ID != indicators[j].ID {
+			return indicators[i].ID < indicators[j].ID
+		}
+		return indicators[i].Value < indicators[j].Value
+	})
+	return indicators
+}
+
+func TestReadBatchLines(t *testing.T) {
+	input := "# a feed\nhttp://evil.example/x\n\nEvil.Example\nnot an indicator\n1.2.3.4\nB36E7B1B3C95C05D52FED09FAB8DDD16\n"
+	want := []batchIndicator{
+		{logIndicator: logIndicator{"url", "http://evil.example/x"}, ID: "2"},
+		{logIndicator: logIndicator{"host", "evil.example"}, ID: "4"},
+		{logIndicator: logIndicator{"host", "1.2.3.4"}, ID: "6"},
+		{logIndicator: logIndicator{"md5", "b36e7b1b3c95c05d52fed09fab8ddd16"}, ID: "7"},
+	}
+	got, err := readBatchLines("feed.txt", []byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestReadSTIX(t *testing.T) {
+	tests := []struct {
+		name   string
+		bundle string
+		want   []batchIndicator
+	}{
+		{
+			"STIX 2.1 patterns",
+			`{"type":"bundle","objects":[
+				{"type":"indicator","id":"indicator--1","pattern_type":"stix","pattern":"[url:value = 'http://evil.example/it\\'s'] OR [domain-name:value = 'Evil.Example']"},
+				{"type":"indicator","id":"indicator--2","pattern":"[file:hashes.'SHA-256' = 'AB'] AND [ipv4-addr:value = '1.2.3.4/32']"},
+				{"type":"indicator","id":"indicator--3","pattern":"[ipv4-addr:value = '10.0.0.0/8']"},
+				{"type":"indicator","id":"indicator--4","pattern_type":"yara","pattern":"rule x { condition: false }"}
+			]}`,
+			[]batchIndicator{
+				{logIndicator: logIndicator{"url", "http://evil.example/it's"}, ID: "indicator--1"},
+				{logIndicator: logIndicator{"host", "evil.example"}, ID: "indicator--1"},
+				{logIndicator: logIndicator{"host", "1.2.3.4"}, ID: "indicator--2"},
+				{logIndicator: logIndicator{"sha256", "ab"}, ID: "indicator--2"},
+			},
+		},
+		{
+			"STIX 2.1 observables",
+			`{"type":"bundle","objects":[
+				{"type":"url","id":"url--1","value":"http://evil.example/"},
+				{"type":"file","id":"file--1","hashes":{"MD5":"CD","SHA-256":"EF","SHA-1":"00"}},
+				{"type":"ipv6-addr","id":"ipv6-addr--1","value":"::1"}
+			]}`,
+			[]batchIndicator{
+				{logIndicator: logIndicator{"md5", "cd"}, ID: "file--1"},
+				{logIndicator: logIndicator{"sha256", "ef"}, ID: "file--1"},
+				{logIndicator: logIndicator{"host", "::1"}, ID: "ipv6-addr--1"},
+				{logIndicator: logIndicator{"url", "http://evil.example/"}, ID: "url--1"},
+			},
+		},
+		{
+			"STIX 2.0 observed data",
+			`{"type":"bundle","objects":[
+				{"type":"observed-data","id":"observed-data--1","objects":{"0":{"type":"domain-name","value":"evil.example"},"1":{"type":"url","value":"http://evil.example/"}}}
+			]}`,
+			[]batchIndicator{
+				{logIndicator: logIndicator{"host", "evil.example"}, ID: "observed-data--1"},
+				{logIndicator: logIndicator{"url", "http://evil.example/"}, ID: "observed-data--1"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, err := readSTIX([]byte(tt.bundle))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(sortBatch(got), sortBatch(tt.want)) {
+			t.Errorf("%s: got %v", tt.name, got)
+		}
+	}
+}
+
+func TestReadMISP(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want []batchIndicator
+	}{
+		{
+			"event",
+			`{"Event":{"Attribute":[
+				{"uuid":"a1","type":"url","value":"http://evil.example/"},
+				{"uuid":"a2","type":"filename|sha256","value":"x.exe|AB"},
+				{"uuid":"a3","type":"comment","value":"nothing"},
+				{"id":"4","type":"link","value":"not an URL"}
+			],"Object":[{"Attribute":[{"uuid":"a5","type":"domain|ip","value":"Evil.Example|1.2.3.4"}]}]}}`,
+			[]batchIndicator{
+				{logIndicator: logIndicator{"url", "http://evil.example/"}, ID: "a1"},
+				{logIndicator: logIndicator{"sha256", "ab"}, ID: "a2"},
+				{logIndicator: logIndicator{"host", "1.2.3.4"}, ID: "a5"},
+				{logIndicator: logIndicator{"host", "evil.example"}, ID: "a5"},
+			},
+		},
+		{
+			"list of events",
+			`[{"Event":{"Attribute":[{"uuid":"a1","type":"md5","value":"CD"}]}},{"Event":{"Attribute":[{"uuid":"a2","type":"hostname","value":"evil.example"}]}}]`,
+			[]batchIndicator{
+				{logIndicator: logIndicator{"md5", "cd"}, ID: "a1"},
+				{logIndicator: logIndicator{"host", "evil.example"}, ID: "a2"},
+			},
+		},
+		{
+			"events restSearch",
+			`{"response":[{"Event":{"Attribute":[{"uuid":"a1","type":"ip-dst","value":"1.2.3.4"}]}}]}`,
+			[]batchIndicator{{logIndicator: logIndicator{"host", "1.2.3.4"}, ID: "a1"}},
+		},
+		{
+			"attributes restSearch",
+			`{"response":{"Attribute":[{"uuid":"a1","type":"uri","value":"https://evil.example/x"}]}}`,
+			[]batchIndicator{{logIndicator: logIndicator{"url", "https://evil.example/x"}, ID: "a1"}},
+		},
+	}
+	for _, tt := range tests {
+		got, err := readMISP([]byte(tt.doc))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(sortBatch(got), sortBatch(tt.want)) {
+			t.Errorf("%s: got %v", tt.name, got)
+		}
+	}
+}
+
+func TestReadBatchCSV(t *testing.T) {
+	defer func(columns []string, delimiter string, noHeader bool) {
+		batchColumns, batchDelimiter, batchNoHeader = columns, delimiter, noHeader
+	}(batchColumns, batchDelimiter, batchNoHeader)
+
+	tests := []struct {
+		name      string
+		columns   []string
+		delimiter string
+		noHeader  bool
+		input     string
+		want      []batchIndicator
+	}{
+		{
+			"comments and multi-line fields",
+			[]string{"value=indicator", "type=kind"},
+			",",
+			false,
+			"indicator,kind,note\n# a comment\nhttp://evil.example/,url,\"two\nlines\"\n# another\nEvil.Example,domain,x\n1.2.3.4,,x\n",
+			[]batchIndicator{
+				{logIndicator: logIndicator{"url", "http://evil.example/"}, ID: "3"},
+				{logIndicator: logIndicator{"host", "evil.example"}, ID: "6"},
+				{logIndicator: logIndicator{"host", "1.2.3.4"}, ID: "7"},
+			},
+		},
+		{
+			"id column and typed columns",
+			[]string{"id=uuid", "url=2", "sha256=hash"},
+			";",
+			false,
+			"uuid;link;hash\nu1;http://evil.example/;AB\nu2;;\n",
+			[]batchIndicator{
+				{logIndicator: logIndicator{"url", "http://evil.example/"}, ID: "u1"},
+				{logIndicator: logIndicator{"sha256", "ab"}, ID: "u1"},
+			},
+		},
+		{
+			"no header",
+			nil,
+			",",
+			true,
+			"evil.example\n\"multi\nline\"\nhttp://evil.example/\n",
+			[]batchIndicator{
+				{logIndicator: logIndicator{"host", "evil.example"}, ID: "1"},
+				{logIndicator: logIndicator{"url", "http://evil.example/"}, ID: "4"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		batchColumns, batchDelimiter, batchNoHeader = tt.columns, tt.delimiter, tt.noHeader
+		got, err := readBatchCSV([]byte(tt.input))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v", tt.name, got)
+		}
+	}
+
+	batchColumns, batchNoHeader = []string{"value=missing"}, false
+	if _, err := readBatchCSV([]byte("a,b\n1,2\n")); err == nil {
+		t.Error("an unknown column was accepted")
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	blocklistFormat     string
+	blocklistMaxEntries int
+	blocklistVariable   string
+)
+
+// blocklistFormats maps each supported format to its writer
+var blocklistFormats = map[string]func(w io.Writer, entries []urlEntry) error{
+	"squid-dstdomain": writeSquidDstdomain,
+	"squid-url-regex": writeSquidURLRegex,
+	"nginx-map":       writeNginxMap,
+	"ublock":          writeUBlock,
+}
+
+// blocklistCmd represents the blocklist command
+var blocklistCmd = &cobra.Command{
+	Use:   "blocklist",
+	Short: "Export malware URLs as a proxy or web server deny-list",
+	Long: `This command exports malware URLs as a deny-list for web proxies, web
+servers and browser content blockers.
+
+Formats:
+  squid-dstdomain  Squid dstdomain ACL file (one host per line)
+  squid-url-regex  Squid url_regex ACL file (one anchored regex per URL)
+  nginx-map        nginx map block setting a variable for listed URLs
+  ublock           uBlock Origin / Adblock Plus filter list
+
+When --max-entries is set and the list would be longer, online URLs are
+kept first, then the most recently added ones.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		write, ok := blocklistFormats[blocklistFormat]
+		if !ok {
+			log.Fatalf("unknown blocklist format %q", blocklistFormat)
+		}
+
+		results, err := exportResults()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		entries, err := exportURLEntries(results)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rankURLs(entries)
+
+		w, done, err := exportWriter()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := write(w, entries); err != nil {
+			log.Fatal(err)
+		}
+		if err := done(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	exportCmd.AddCommand(blocklistCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// blocklistCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// blocklistCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	blocklistCmd.Flags().StringVarP(&blocklistFormat, "format", "f", "squid-dstdomain", "The format of the deny-list")
+	blocklistCmd.Flags().IntVarP(&blocklistMaxEntries, "max-entries", "n", 0, "The maximum number of entries (0 for no limit)")
+	blocklistCmd.Flags().StringVar(&blocklistVariable, "nginx-variable", "$urlhaus_blocked", "The variable set by the nginx map")
+}
+
+// rankURLs sorts online URLs first, then the most recently added ones
+func rankURLs(entries []urlEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		oi, oj := entries[i].Status == "online", entries[j].Status == "online"
+		if oi != oj {
+			return oi
+		}
+		return entries[i].DateAdded > entries[j].DateAdded
+	})
+}
+
+// limit truncates a count to --max-entries
+func limit(n int) int {
+	if blocklistMaxEntries > 0 && n > blocklistMaxEntries {
+		return blocklistMaxEntries
+	}
+	return n
+}
+
+// splitURL breaks an URL into its lowercased scheme://host[:port] prefix and
+// its path and query as sent in the request line. The fragment is dropped.
+func splitURL(rawurl string) (prefix, host, uri string, err error) {
+	u, err := url.Parse(strings.TrimSpace(rawurl))
+	if err != nil {
+		return "", "", "", err
+	}
+	if u.Host == "" {
+		return "", "", "", fmt.Errorf("%q has no host", rawurl)
+	}
+
+	host = strings.ToLower(u.Host)
+	prefix = strings.ToLower(u.Scheme) + "://" + host
+
+	uri = u.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	if u.RawQuery != "" || u.ForceQuery {
+		uri += "?" + u.RawQuery
+	}
+	return prefix, host, uri, nil
+}
+
+func blocklistHeader(w io.Writer, comment, format string, n int) {
+	fmt.Fprintf(w, "%s URLhaus %s deny-list\n", comment, format)
+	fmt.Fprintf(w, "%s Generated: %s\n", comment, time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "%s Entries:   %d\n", comment, n)
+}
+
+func writeSquidDstdomain(w io.Writer, entries []urlEntry) error {
+	hosts := []string{}
+	seen := map[string]bool{}
+	for _, e := range entries {
+		h := e.Host
+		if h == "" {
+			h = hostOf(e.URL)
+		}
+		h = strings.Trim(strings.ToLower(h), "[]")
+		if h == "" || seen[h] {
+			continue
+		}
+		seen[h] = true
+		hosts = append(hosts, h)
+	}
+	hosts = hosts[:limit(len(hosts))]
+	sort.Strings(hosts)
+
+	blocklistHeader(w, "#", "Squid dstdomain", len(hosts))
+	for _, h := range hosts {
+		fmt.Fprintln(w, h)
+	}
+	return nil
+}
+
+func writeSquidURLRegex(w io.Writer, entries []urlEntry) error {
+	var lines []string
+	for _, e := range entries {
+		prefix, _, uri, err := splitURL(e.URL)
+		if err != nil {
+			continue
+		}
+		lines = append(lines, "^"+regexp.QuoteMeta(prefix+uri)+"$")
+	}
+	lines = lines[:limit(len(lines))]
+
+	blocklistHeader(w, "#", "Squid url_regex", len(lines))
+	for _, l := range lines {
+		fmt.Fprintln(w, l)
+	}
+	return nil
+}
+
+// nginxQuote quotes a string for an nginx configuration file
+func nginxQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func writeNginxMap(w io.Writer, entries []urlEntry) error {
+	var keys []string
+	for _, e := range entries {
+		_, host, uri, err := splitURL(e.URL)
+		if err != nil {
+			continue
+		}
+		// $host never carries the port
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+			if strings.Contains(h, ":") {
+				host = "[" + h + "]"
+			}
+		}
+		keys = append(keys, "~^"+regexp.QuoteMeta(host+uri)+"$")
+	}
+	keys = keys[:limit(len(keys))]
+
+	blocklistHeader(w, "#", "nginx map", len(keys))
+	fmt.Fprintf(w, "map $host$request_uri %s {\n", blocklistVariable)
+	fmt.Fprintln(w, "    default 0;")
+	for _, k := range keys {
+		fmt.Fprintf(w, "    %s 1;\n", nginxQuote(k))
+	}
+	fmt.Fprintln(w, "}")
+	return nil
+}
+
+func writeUBlock(w io.Writer, entries []urlEntry) error {
+	var filters []string
+	for _, e := range entries {
+		prefix, _, uri, err := splitURL(e.URL)
+		if err != nil {
+			continue
+		}
+		u := prefix + uri
+		if strings.ContainsAny(u, "*^|$") {
+			// characters with a special meaning in filters need a regex
+			re := regexp.QuoteMeta(u)
+			re = strings.Replace(re, "/", `\/`, -1)
+			filters = append(filters, "/^"+re+"$/")
+		} else {
+			filters = append(filters, "|"+u+"|")
+		}
+	}
+	filters = filters[:limit(len(filters))]
+
+	fmt.Fprintln(w, "[Adblock Plus 2.0]")
+	fmt.Fprintln(w, "! Title: URLhaus malware URLs")
+	fmt.Fprintln(w, "! Homepage: https://urlhaus.abuse.ch/")
+	blocklistHeader(w, "!", "uBlock Origin", len(filters))
+	for _, f := range filters {
+		fmt.Fprintln(w, f)
+	}
+	return nil
+}
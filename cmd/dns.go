@@ -0,0 +1,435 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	dnsListen     string
+	dnsUpstream   string
+	dnsSinkholes  []string
+	dnsZone       string
+	dnsTTL        uint32
+	dnsOnlineOnly bool
+	dnsTimeout    time.Duration
+)
+
+// DNS types, classes and response codes
+const (
+	dnsTypeA    = 1
+	dnsTypeTXT  = 16
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsRcodeNoError  = 0
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+	dnsRcodeRefused  = 5
+)
+
+// dnsQuestion is the first question of a DNS query
+type dnsQuestion struct {
+	id     uint16
+	flags  uint16
+	name   string
+	qtype  uint16
+	qclass uint16
+	raw    []byte // the question section as received
+}
+
+// dnsAnswer is a resource record of a response about the question name
+type dnsAnswer struct {
+	rtype uint16
+	data  []byte
+}
+
+// dnsCmd represents the dns-serve command
+var dnsCmd = &cobra.Command{
+	Use:   "dns-serve",
+	Short: "Run a DNS server blocking the hosts listed on URLhaus",
+	Long: `This command runs a DNS server on UDP and TCP that forwards queries to
+the --upstream server, except for names listed on URLhaus. Those are
+answered with NXDOMAIN, or with the --sinkhole addresses when given. Each
+block is logged with the URLhaus reference of the host.
+
+With --dnsbl-zone, names below the zone are answered as a DNSBL, e.g. a
+query for evil.com.urlhaus.example.org or, for an IP address, for
+4.3.2.1.urlhaus.example.org gets:
+  127.0.0.2  the host serves malware URLs that are online
+  127.0.0.4  the host only served malware URLs that are offline now
+  NXDOMAIN   the host is not listed
+and TXT queries get the URLhaus reference of the host. Without --upstream,
+queries outside of the zone are refused.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if dnsUpstream == "" && dnsZone == "" {
+			log.Fatal("either --upstream or --dnsbl-zone is required")
+		}
+
+		var sinkholes []net.IP
+		for _, s := range dnsSinkholes {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				log.Fatalf("invalid sinkhole address %q", s)
+			}
+			sinkholes = append(sinkholes, ip)
+		}
+
+		c, err := newChecker()
+		if err != nil {
+			log.Fatal(err)
+		}
+		s := &dnsServer{
+			checker:   c,
+			sinkholes: sinkholes,
+			upstream:  dnsUpstream,
+			zone:      strings.ToLower(strings.Trim(dnsZone, ".")),
+			timeout:   dnsTimeout,
+		}
+
+		pc, err := net.ListenPacket("udp", dnsListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		l, err := net.Listen("tcp", dnsListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("listening on %s", dnsListen)
+
+		errc := make(chan error, 2)
+		go func() { errc <- s.serveUDP(pc) }()
+		go func() { errc <- s.serveTCP(l) }()
+		log.Fatal(<-errc)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(dnsCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// dnsCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// dnsCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	dnsCmd.Flags().StringVarP(&dnsListen, "listen", "l", "127.0.0.1:53", "The address to listen on")
+	dnsCmd.Flags().StringVarP(&dnsUpstream, "upstream", "u", "", "The DNS server normal queries are forwarded to")
+	dnsCmd.Flags().StringSliceVar(&dnsSinkholes, "sinkhole", nil, "The IPv4 and/or IPv6 addresses blocked names resolve to")
+	dnsCmd.Flags().StringVar(&dnsZone, "dnsbl-zone", "", "The zone answered as a DNSBL")
+	dnsCmd.Flags().Uint32Var(&dnsTTL, "ttl", 300, "The TTL of blocked and DNSBL answers")
+	dnsCmd.Flags().BoolVar(&dnsOnlineOnly, "online-only", false, "Only block hosts with online malware URLs")
+	dnsCmd.Flags().DurationVar(&dnsTimeout, "timeout", 5*time.Second, "The timeout of upstream queries")
+	addCheckerFlags(dnsCmd)
+}
+
+type dnsServer struct {
+	checker   *checker
+	sinkholes []net.IP
+	upstream  string
+	zone      string
+	timeout   time.Duration
+}
+
+func (s *dnsServer) serveUDP(pc net.PacketConn) error {
+	for {
+		buf := make([]byte, 65535)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if resp := s.handle(buf[:n], "udp", addr); resp != nil {
+				pc.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (s *dnsServer) serveTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			var mu sync.Mutex
+			for {
+				conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
+				msg, err := readDNSTCP(conn)
+				if err != nil {
+					return
+				}
+				go func() {
+					if resp := s.handle(msg, "tcp", conn.RemoteAddr()); resp != nil {
+						mu.Lock()
+						writeDNSTCP(conn, resp)
+						mu.Unlock()
+					}
+				}()
+			}
+		}()
+	}
+}
+
+// handle answers a query, either itself or by forwarding it upstream
+func (s *dnsServer) handle(msg []byte, network string, client net.Addr) []byte {
+	q, err := parseDNSQuestion(msg)
+	if err != nil {
+		return nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(q.name, "."))
+
+	if s.zone != "" && (name == s.zone || strings.HasSuffix(name, "."+s.zone)) {
+		return s.dnsbl(q, strings.TrimSuffix(strings.TrimSuffix(name, s.zone), "."))
+	}
+
+	if q.qclass == dnsClassIN && name != "" {
+		v, err := s.checker.check("host", name)
+		if err != nil {
+			log.Printf("%s: %v", name, err)
+		} else if v.Listed && (!dnsOnlineOnly || v.Status == "online") {
+			log.Printf("blocked %s query from %s for %s: %s", dnsTypeName(q.qtype), client, name, v.Reference)
+			return s.block(q)
+		}
+	}
+
+	if s.upstream == "" {
+		return dnsResponse(q, dnsRcodeRefused, false, nil)
+	}
+	resp, err := s.forward(msg, network)
+	if err != nil {
+		log.Printf("%s: %v", name, err)
+		return dnsResponse(q, dnsRcodeServFail, false, nil)
+	}
+	return resp
+}
+
+// block answers a query for a listed name
+func (s *dnsServer) block(q dnsQuestion) []byte {
+	if len(s.sinkholes) == 0 {
+		return dnsResponse(q, dnsRcodeNXDomain, false, nil)
+	}
+
+	var answers []dnsAnswer
+	for _, ip := range s.sinkholes {
+		if ip4 := ip.To4(); ip4 != nil && q.qtype == dnsTypeA {
+			answers = append(answers, dnsAnswer{dnsTypeA, ip4})
+		} else if ip4 == nil && q.qtype == dnsTypeAAAA {
+			answers = append(answers, dnsAnswer{dnsTypeAAAA, ip.To16()})
+		}
+	}
+	return dnsResponse(q, dnsRcodeNoError, false, answers)
+}
+
+// dnsbl answers a query about a host below the DNSBL zone
+func (s *dnsServer) dnsbl(q dnsQuestion, host string) []byte {
+	if host == "" {
+		return dnsResponse(q, dnsRcodeNoError, true, nil)
+	}
+
+	// IPv4 addresses are queried with their octets reversed
+	if labels := strings.Split(host, "."); len(labels) == 4 {
+		if ip := net.ParseIP(labels[3] + "." + labels[2] + "." + labels[1] + "." + labels[0]); ip != nil {
+			host = ip.String()
+		}
+	}
+
+	v, err := s.checker.check("host", host)
+	if err != nil {
+		log.Printf("%s: %v", host, err)
+		return dnsResponse(q, dnsRcodeServFail, true, nil)
+	}
+	if !v.Listed {
+		return dnsResponse(q, dnsRcodeNXDomain, true, nil)
+	}
+
+	var answers []dnsAnswer
+	switch q.qtype {
+	case dnsTypeA:
+		code := byte(4)
+		if v.Status == "online" {
+			code = 2
+		}
+		answers = append(answers, dnsAnswer{dnsTypeA, []byte{127, 0, 0, code}})
+	case dnsTypeTXT:
+		answers = append(answers, dnsAnswer{dnsTypeTXT, dnsTXT(v.Reference)})
+	}
+	log.Printf("listed %s: %s", host, v.Reference)
+	return dnsResponse(q, dnsRcodeNoError, true, answers)
+}
+
+// forward relays a query to the upstream server
+func (s *dnsServer) forward(msg []byte, network string) ([]byte, error) {
+	conn, err := net.DialTimeout(network, s.upstream, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	if network == "tcp" {
+		if err := writeDNSTCP(conn, msg); err != nil {
+			return nil, err
+		}
+		return readDNSTCP(conn)
+	}
+
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// readDNSTCP reads a length-prefixed DNS message
+func readDNSTCP(r io.Reader) ([]byte, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, n)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+// writeDNSTCP writes a length-prefixed DNS message
+func writeDNSTCP(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+var errDNSFormat = errors.New("malformed DNS message")
+
+// parseDNSQuestion parses the header and the first question of a query
+func parseDNSQuestion(msg []byte) (dnsQuestion, error) {
+	var q dnsQuestion
+	if len(msg) < 12 {
+		return q, errDNSFormat
+	}
+	q.id = binary.BigEndian.Uint16(msg[0:])
+	q.flags = binary.BigEndian.Uint16(msg[2:])
+	if q.flags&0x8000 != 0 || binary.BigEndian.Uint16(msg[4:]) == 0 {
+		return q, errDNSFormat
+	}
+
+	var labels []string
+	off := 12
+	for {
+		if off >= len(msg) {
+			return q, errDNSFormat
+		}
+		n := int(msg[off])
+		off++
+		if n == 0 {
+			break
+		}
+		if n&0xc0 != 0 || off+n > len(msg) {
+			// compression pointers are not used in questions
+			return q, errDNSFormat
+		}
+		labels = append(labels, string(msg[off:off+n]))
+		off += n
+	}
+	if off+4 > len(msg) {
+		return q, errDNSFormat
+	}
+	q.name = strings.Join(labels, ".") + "."
+	q.qtype = binary.BigEndian.Uint16(msg[off:])
+	q.qclass = binary.BigEndian.Uint16(msg[off+2:])
+	q.raw = msg[12 : off+4]
+	return q, nil
+}
+
+// dnsResponse builds a response to q with the given answers
+func dnsResponse(q dnsQuestion, rcode int, authoritative bool, answers []dnsAnswer) []byte {
+	flags := uint16(0x8000) | q.flags&0x7900 | 0x0080 | uint16(rcode)
+	if authoritative {
+		flags |= 0x0400
+	}
+
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], q.id)
+	binary.BigEndian.PutUint16(msg[2:], flags)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(answers)))
+	msg = append(msg, q.raw...)
+
+	for _, a := range answers {
+		rr := make([]byte, 12)
+		binary.BigEndian.PutUint16(rr[0:], 0xc00c) // pointer to the question name
+		binary.BigEndian.PutUint16(rr[2:], a.rtype)
+		binary.BigEndian.PutUint16(rr[4:], dnsClassIN)
+		binary.BigEndian.PutUint32(rr[6:], dnsTTL)
+		binary.BigEndian.PutUint16(rr[10:], uint16(len(a.data)))
+		msg = append(msg, rr...)
+		msg = append(msg, a.data...)
+	}
+	return msg
+}
+
+// dnsTXT encodes a string as TXT record data
+func dnsTXT(s string) []byte {
+	var data []byte
+	for len(s) > 255 {
+		data = append(data, 255)
+		data = append(data, s[:255]...)
+		s = s[255:]
+	}
+	data = append(data, byte(len(s)))
+	return append(data, s...)
+}
+
+func dnsTypeName(t uint16) string {
+	switch t {
+	case dnsTypeA:
+		return "A"
+	case dnsTypeAAAA:
+		return "AAAA"
+	case dnsTypeTXT:
+		return "TXT"
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
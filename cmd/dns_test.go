@@ -0,0 +1,303 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDump = `# id,dateadded,url,url_status,last_online,threat,tags,urlhaus_link,reporter
+"10","2024-01-02 10:00:00","http://1.2.3.4:8080/Mozi.m","online","","malware_download","elf,Mozi","https://urlhaus.abuse.ch/url/10/","r"
+"11","2024-01-02 10:00:00","http://1.2.3.5/Mozi.a","offline","","malware_download","elf,Mozi","https://urlhaus.abuse.ch/url/11/","r"
+"14","2024-01-03 10:00:00","http://bad.example/x.doc","online","","malware_download","doc","https://urlhaus.abuse.ch/url/14/","r"
+`
+
+// testChecker returns a checker backed by testDump only
+func testChecker(t *testing.T) *checker {
+	t.Helper()
+	m, err := parseMirror(strings.NewReader(testDump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &checker{mirror: m, cache: newLRUCache(100, time.Minute)}
+}
+
+// dnsQuery builds a query with a single question
+func dnsQuery(id uint16, name string, qtype uint16) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // RD
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, label := range strings.Split(strings.Trim(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+	return msg
+}
+
+func TestParseDNSQuestion(t *testing.T) {
+	query := dnsQuery(0x1234, "Evil.Example.com", dnsTypeAAAA)
+	response := append([]byte(nil), query...)
+	response[2] |= 0x80
+	noQuestion := append([]byte(nil), query...)
+	noQuestion[5] = 0
+	pointer := append(append([]byte(nil), query[:12]...), 0xc0, 0x0c, 0, 1, 0, 1)
+
+	tests := []struct {
+		name  string
+		msg   []byte
+		qname string
+		qtype uint16
+		err   bool
+	}{
+		{"query", query, "Evil.Example.com.", dnsTypeAAAA, false},
+		{"root", dnsQuery(1, "", dnsTypeA), ".", dnsTypeA, false},
+		{"short header", query[:11], "", 0, true},
+		{"response", response, "", 0, true},
+		{"no question", noQuestion, "", 0, true},
+		{"compression pointer", pointer, "", 0, true},
+		{"truncated label", query[:15], "", 0, true},
+		{"truncated type", query[:len(query)-3], "", 0, true},
+	}
+	for _, tt := range tests {
+		q, err := parseDNSQuestion(tt.msg)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if q.name != tt.qname || q.qtype != tt.qtype || q.qclass != dnsClassIN || q.id != binary.BigEndian.Uint16(tt.msg) {
+			t.Errorf("%s: got %+v", tt.name, q)
+		}
+	}
+}
+
+func TestDNSResponse(t *testing.T) {
+	q, err := parseDNSQuestion(dnsQuery(7, "a.example", dnsTypeTXT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("x", 300)
+	resp := dnsResponse(q, dnsRcodeNoError, true, []dnsAnswer{{dnsTypeTXT, dnsTXT(long)}})
+
+	if id := binary.BigEndian.Uint16(resp); id != 7 {
+		t.Errorf("id %d", id)
+	}
+	if flags := binary.BigEndian.Uint16(resp[2:]); flags != 0x8000|0x0400|0x0100|0x0080 {
+		t.Errorf("flags %#x", flags)
+	}
+	if n := binary.BigEndian.Uint16(resp[6:]); n != 1 {
+		t.Errorf("%d answers", n)
+	}
+	data := resp[12+len(q.raw)+12:]
+	if len(data) != 302 || data[0] != 255 || data[256] != 45 {
+		t.Errorf("TXT data of %d bytes", len(data))
+	}
+}
+
+// stubAnswer is the answer of the stub upstream to every query
+func stubAnswer(msg []byte) []byte {
+	q, err := parseDNSQuestion(msg)
+	if err != nil {
+		return nil
+	}
+	return dnsResponse(q, dnsRcodeNoError, false, []dnsAnswer{{dnsTypeA, []byte{192, 0, 2, 1}}})
+}
+
+// stubUpstream runs a DNS server on UDP and TCP answering every query
+// with 192.0.2.1
+func stubUpstream(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Skip(err)
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		l.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := stubAnswer(buf[:n]); resp != nil {
+				pc.WriteTo(resp, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				msg, err := readDNSTCP(conn)
+				if err != nil {
+					return
+				}
+				if resp := stubAnswer(msg); resp != nil {
+					writeDNSTCP(conn, resp)
+				}
+			}()
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// serveDNS runs a dnsServer on UDP and TCP on the same local port
+func serveDNS(t *testing.T, s *dnsServer) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Skip(err)
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		l.Close()
+	})
+	go s.serveUDP(pc)
+	go s.serveTCP(l)
+	return pc.LocalAddr().String()
+}
+
+func exchangeDNS(t *testing.T, network, addr string, msg []byte) []byte {
+	t.Helper()
+	conn, err := net.DialTimeout(network, addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if network == "tcp" {
+		if err := writeDNSTCP(conn, msg); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := readDNSTCP(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestDNSServe(t *testing.T) {
+	upstream := stubUpstream(t)
+	plain := serveDNS(t, &dnsServer{
+		checker:  testChecker(t),
+		upstream: upstream,
+		zone:     "bl.example.org",
+		timeout:  time.Second,
+	})
+	sinkhole := serveDNS(t, &dnsServer{
+		checker:   testChecker(t),
+		sinkholes: []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("::1")},
+		upstream:  upstream,
+		timeout:   time.Second,
+	})
+
+	tests := []struct {
+		name    string
+		server  string
+		network string
+		qname   string
+		qtype   uint16
+		rcode   int
+		answer  []byte
+	}{
+		{"forwarded", plain, "udp", "good.example", dnsTypeA, dnsRcodeNoError, []byte{192, 0, 2, 1}},
+		{"forwarded over TCP", plain, "tcp", "good.example", dnsTypeA, dnsRcodeNoError, []byte{192, 0, 2, 1}},
+		{"blocked", plain, "udp", "BAD.example.", dnsTypeA, dnsRcodeNXDomain, nil},
+		{"blocked over TCP", plain, "tcp", "bad.example", dnsTypeA, dnsRcodeNXDomain, nil},
+		{"sinkholed", sinkhole, "udp", "bad.example", dnsTypeA, dnsRcodeNoError, []byte{10, 0, 0, 1}},
+		{"sinkholed IPv6", sinkhole, "udp", "bad.example", dnsTypeAAAA, dnsRcodeNoError, net.ParseIP("::1")},
+		{"DNSBL online", plain, "udp", "4.3.2.1.bl.example.org", dnsTypeA, dnsRcodeNoError, []byte{127, 0, 0, 2}},
+		{"DNSBL offline", plain, "udp", "5.3.2.1.bl.example.org", dnsTypeA, dnsRcodeNoError, []byte{127, 0, 0, 4}},
+		{"DNSBL domain", plain, "tcp", "bad.example.bl.example.org", dnsTypeA, dnsRcodeNoError, []byte{127, 0, 0, 2}},
+		{"DNSBL not listed", plain, "udp", "good.example.bl.example.org", dnsTypeA, dnsRcodeNXDomain, nil},
+	}
+	for i, tt := range tests {
+		id := uint16(100 + i)
+		resp := exchangeDNS(t, tt.network, tt.server, dnsQuery(id, tt.qname, tt.qtype))
+		if len(resp) < 12 {
+			t.Errorf("%s: short response", tt.name)
+			continue
+		}
+		if got := binary.BigEndian.Uint16(resp); got != id {
+			t.Errorf("%s: id %d", tt.name, got)
+		}
+		if rcode := int(resp[3] & 0x0f); rcode != tt.rcode {
+			t.Errorf("%s: rcode %d", tt.name, rcode)
+		}
+		if tt.answer != nil && !bytes.HasSuffix(resp, tt.answer) {
+			t.Errorf("%s: answer % x", tt.name, resp)
+		}
+		if tt.answer == nil && binary.BigEndian.Uint16(resp[6:]) != 0 {
+			t.Errorf("%s: unexpected answers", tt.name)
+		}
+	}
+}
+
+func TestDNSRefusedWithoutUpstream(t *testing.T) {
+	s := &dnsServer{checker: testChecker(t), zone: "bl.example.org"}
+	resp := s.handle(dnsQuery(1, "good.example", dnsTypeA), "udp", nil)
+	if rcode := resp[3] & 0x0f; rcode != dnsRcodeRefused {
+		t.Errorf("rcode %d", rcode)
+	}
+	if resp := s.handle([]byte{1, 2, 3}, "udp", nil); resp != nil {
+		t.Errorf("answered a malformed query")
+	}
+}
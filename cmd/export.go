@@ -0,0 +1,182 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	exportURLs       []string
+	exportHosts      []string
+	exportMD5s       []string
+	exportSHA256s    []string
+	exportTags       []string
+	exportSignatures []string
+	exportInputs     []string
+	exportFromMirror bool
+	exportOutput     string
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export URLhaus data to other formats",
+	Long: `This command converts URLhaus data into formats consumed by other
+security tools.
+
+The data is either looked up with the --url, --host, --md5, --sha256, --tag
+and --signature flags, taken from the whole mirror with --from-mirror, or
+read from files holding raw responses, e.g.
+
+  urlhaus-cli tag Mozi -r > mozi.json
+  urlhaus-cli export blocklist -f squid-dstdomain -i mozi.json`,
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// exportCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// exportCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	exportCmd.PersistentFlags().StringArrayVar(&exportURLs, "url", nil, "Export information about an URL")
+	exportCmd.PersistentFlags().StringArrayVar(&exportHosts, "host", nil, "Export information about a host")
+	exportCmd.PersistentFlags().StringArrayVar(&exportMD5s, "md5", nil, "Export information about a payload by MD5 hash")
+	exportCmd.PersistentFlags().StringArrayVar(&exportSHA256s, "sha256", nil, "Export information about a payload by SHA256 hash")
+	exportCmd.PersistentFlags().StringArrayVar(&exportTags, "tag", nil, "Export information about a tag")
+	exportCmd.PersistentFlags().StringArrayVar(&exportSignatures, "signature", nil, "Export information about a signature")
+	exportCmd.PersistentFlags().StringArrayVarP(&exportInputs, "input", "i", nil, "Read raw responses from a file (- for stdin)")
+	exportCmd.PersistentFlags().BoolVar(&exportFromMirror, "from-mirror", false, "Export every URL of the mirror")
+	exportCmd.PersistentFlags().StringVarP(&exportOutput, "output", "o", "", "Write to a file instead of stdout")
+}
+
+// exportResults looks up everything requested on the command line and
+// reads every input file.
+func exportResults() ([]result, error) {
+	var results []result
+
+	lookups := []struct {
+		kind   string
+		values []string
+	}{
+		{"url", exportURLs},
+		{"host", exportHosts},
+		{"md5", exportMD5s},
+		{"sha256", exportSHA256s},
+		{"tag", exportTags},
+		{"signature", exportSignatures},
+	}
+	for _, l := range lookups {
+		for _, v := range l.values {
+			r, err := lookupResult(l.kind, v)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, r)
+		}
+	}
+
+	for _, name := range exportInputs {
+		in, err := openInput(name)
+		if err != nil {
+			return nil, err
+		}
+		r, err := readResults(bufio.NewReader(in))
+		in.Close()
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r...)
+	}
+
+	return results, nil
+}
+
+// exportURLEntries returns the malware URLs of all results, plus the whole
+// mirror with --from-mirror.
+func exportURLEntries(results []result) ([]urlEntry, error) {
+	entries := collectURLs(results)
+	if !exportFromMirror {
+		return entries, nil
+	}
+
+	m, err := localMirror()
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, errors.New("--from-mirror requires --mirror")
+	}
+
+	seen := map[string]bool{}
+	for _, e := range entries {
+		seen[e.URL] = true
+	}
+	for _, e := range m.urls {
+		if !seen[e.URL] {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// openInput opens a file for reading, - being stdin
+func openInput(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	return os.Open(name)
+}
+
+// exportWriter returns where the export is written to along with a function
+// that flushes and closes it.
+func exportWriter() (*bufio.Writer, func() error, error) {
+	if exportOutput == "" {
+		w := bufio.NewWriter(os.Stdout)
+		return w, w.Flush, nil
+	}
+
+	f, err := os.Create(exportOutput)
+	if err != nil {
+		return nil, nil, err
+	}
+	w := bufio.NewWriter(f)
+	return w, func() error {
+		if err := w.Flush(); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}, nil
+}
@@ -0,0 +1,315 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	exporterListen          string
+	exporterHosts           string
+	exporterInterval        time.Duration
+	exporterRate            float64
+	exporterBurst           int
+	exporterCacheTTL        time.Duration
+	exporterShutdownTimeout time.Duration
+)
+
+// hostStatus is what the last lookup of a monitored host found
+type hostStatus struct {
+	checked    time.Time
+	failed     bool
+	listed     bool
+	count      int
+	urls       map[string]int
+	blacklists map[string]string
+	firstSeen  time.Time
+}
+
+// exporterCmd represents the exporter command
+var exporterCmd = &cobra.Command{
+	Use:   "exporter [host...]",
+	Short: "Export Prometheus metrics about monitored hosts",
+	Long: `This command looks up a list of hosts every --interval and exposes on
+/metrics, in the Prometheus text format, how many malware URLs URLhaus knows
+on each of them, whether they are on the SURBL and Spamhaus DBL blacklists
+and since when URLhaus has seen them. The API lists at most 100 URLs of a
+host, so the counts by status only cover the URLs listed.
+
+The hosts are given as arguments or one per line in the --hosts file, which
+is read again before each round of lookups. Lookups are kept for
+--cache-ttl, so that each host is looked up with the API at most that
+often, whatever the --interval. The metrics of the API client
+itself (request latencies, errors, cache hits and rate limit waits) are
+exposed too.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		e := &exporter{
+			hosts:   args,
+			status:  map[string]hostStatus{},
+			cache:   newLRUCache(10000, exporterCacheTTL),
+			limiter: newRateLimiter(exporterRate, exporterBurst),
+		}
+		if len(e.monitored()) == 0 {
+			log.Fatal("no host to monitor")
+		}
+		go e.run()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", e.serveMetrics)
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			io.WriteString(w, "URLhaus exporter, see /metrics\n")
+		})
+		srv := &http.Server{Addr: exporterListen, Handler: mux}
+		serveGracefully(srv, exporterShutdownTimeout, nil)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exporterCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// exporterCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// exporterCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	exporterCmd.Flags().StringVarP(&exporterListen, "listen", "l", "127.0.0.1:9741", "The address to listen on")
+	exporterCmd.Flags().StringVar(&exporterHosts, "hosts", "", "A file of hosts to monitor, one per line")
+	exporterCmd.Flags().DurationVar(&exporterInterval, "interval", 5*time.Minute, "How often the hosts are looked up")
+	exporterCmd.Flags().Float64Var(&exporterRate, "rate", 1, "The most API requests per second")
+	exporterCmd.Flags().IntVar(&exporterBurst, "burst", 5, "The most API requests at once")
+	exporterCmd.Flags().DurationVar(&exporterCacheTTL, "cache-ttl", 15*time.Minute, "How long lookups are kept in memory")
+	exporterCmd.Flags().DurationVar(&exporterShutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait for requests in flight on shutdown")
+}
+
+type exporter struct {
+	hosts   []string
+	cache   *lruCache
+	limiter *rateLimiter
+
+	mu        sync.Mutex
+	status    map[string]hostStatus
+	waits     uint64
+	waitTotal time.Duration
+}
+
+// monitored returns the hosts given as arguments and in the --hosts file
+func (e *exporter) monitored() []string {
+	hosts := append([]string(nil), e.hosts...)
+	if exporterHosts != "" {
+		lines, err := readLines(exporterHosts)
+		if err != nil {
+			log.Print(err)
+		}
+		hosts = append(hosts, lines...)
+	}
+	for i, h := range hosts {
+		hosts[i] = strings.ToLower(h)
+	}
+	return appendUnique(nil, hosts...)
+}
+
+// run looks up the monitored hosts every --interval
+func (e *exporter) run() {
+	for {
+		hosts := e.monitored()
+		for _, host := range hosts {
+			e.check(host)
+		}
+
+		e.mu.Lock()
+		for host := range e.status {
+			if !containsString(hosts, host) {
+				delete(e.status, host)
+			}
+		}
+		e.mu.Unlock()
+
+		time.Sleep(exporterInterval)
+	}
+}
+
+func (e *exporter) check(host string) {
+	r, err := e.lookup(host)
+	st := hostStatus{checked: time.Now(), urls: map[string]int{}}
+	switch {
+	case err != nil:
+		log.Printf("%s: %v", host, err)
+		st.failed = true
+	case r.ok():
+		st.listed = true
+		// the response lists at most 100 URLs, url_count counts all of them
+		urls := r.urls()
+		for _, u := range urls {
+			status := u.Status
+			if status == "" {
+				status = "unknown"
+			}
+			st.urls[status]++
+		}
+		if _, err := fmt.Sscan(str(r.data, "url_count"), &st.count); err != nil {
+			st.count = len(urls)
+		}
+		st.blacklists = strMap(r.data, "blacklists")
+		st.firstSeen, _ = parseTime(str(r.data, "firstseen"))
+	case str(r.data, "query_status") != "no_results":
+		log.Printf("%s: %s", host, str(r.data, "query_status"))
+		st.failed = true
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if st.failed {
+		// keep the last known values, only the failure is new
+		if prev, ok := e.status[host]; ok {
+			prev.checked = st.checked
+			prev.failed = true
+			st = prev
+		}
+	}
+	e.status[host] = st
+}
+
+// lookup returns the host result from the cache or the API, waiting for
+// the rate limiter
+func (e *exporter) lookup(host string) (result, error) {
+	if v, ok := e.cache.get(host); ok {
+		return v.(result), nil
+	}
+	for {
+		ok, wait := e.limiter.allow("api")
+		if ok {
+			break
+		}
+		e.mu.Lock()
+		e.waits++
+		e.waitTotal += wait
+		e.mu.Unlock()
+		time.Sleep(wait)
+	}
+	r, err := lookupResult("host", host)
+	if err != nil {
+		return r, err
+	}
+	e.cache.put(host, r)
+	return r, nil
+}
+
+func (e *exporter) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	e.mu.Lock()
+	var hosts []string
+	for host := range e.status {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	now := time.Now()
+
+	writeMetricHeader(w, "urlhaus_host_listed", "gauge", "Whether the host is known to URLhaus.")
+	for _, host := range hosts {
+		writeMetric(w, "urlhaus_host_listed", boolMetric(e.status[host].listed), "host", host)
+	}
+	writeMetricHeader(w, "urlhaus_host_url_count", "gauge", "Number of malware URLs on the host.")
+	for _, host := range hosts {
+		writeMetric(w, "urlhaus_host_url_count", float64(e.status[host].count), "host", host)
+	}
+	writeMetricHeader(w, "urlhaus_host_urls", "gauge", "Number of malware URLs listed for the host (at most 100), by status.")
+	for _, host := range hosts {
+		st := e.status[host]
+		for _, status := range []string{"online", "offline", "unknown"} {
+			writeMetric(w, "urlhaus_host_urls", float64(st.urls[status]), "host", host, "status", status)
+		}
+	}
+	writeMetricHeader(w, "urlhaus_host_blacklisted", "gauge", "Whether the host is on a blacklist.")
+	for _, host := range hosts {
+		st := e.status[host]
+		for _, bl := range []string{"spamhaus_dbl", "surbl"} {
+			v := st.blacklists[bl]
+			writeMetric(w, "urlhaus_host_blacklisted", boolMetric(v != "" && v != "not listed"), "host", host, "blacklist", bl)
+		}
+	}
+	writeMetricHeader(w, "urlhaus_host_first_seen_timestamp_seconds", "gauge", "When URLhaus first saw the host.")
+	for _, host := range hosts {
+		if st := e.status[host]; !st.firstSeen.IsZero() {
+			writeMetric(w, "urlhaus_host_first_seen_timestamp_seconds", float64(st.firstSeen.Unix()), "host", host)
+		}
+	}
+	writeMetricHeader(w, "urlhaus_host_seconds_since_first_seen", "gauge", "Time since URLhaus first saw the host.")
+	for _, host := range hosts {
+		if st := e.status[host]; !st.firstSeen.IsZero() {
+			writeMetric(w, "urlhaus_host_seconds_since_first_seen", now.Sub(st.firstSeen).Seconds(), "host", host)
+		}
+	}
+	writeMetricHeader(w, "urlhaus_host_last_check_timestamp_seconds", "gauge", "When the host was last looked up.")
+	for _, host := range hosts {
+		writeMetric(w, "urlhaus_host_last_check_timestamp_seconds", float64(e.status[host].checked.Unix()), "host", host)
+	}
+	writeMetricHeader(w, "urlhaus_host_check_success", "gauge", "Whether the last lookup of the host succeeded.")
+	for _, host := range hosts {
+		writeMetric(w, "urlhaus_host_check_success", boolMetric(!e.status[host].failed), "host", host)
+	}
+
+	writeMetricHeader(w, "urlhaus_rate_limit_waits_total", "counter", "Number of times an API request waited for the rate limiter.")
+	writeMetric(w, "urlhaus_rate_limit_waits_total", float64(e.waits))
+	writeMetricHeader(w, "urlhaus_rate_limit_wait_seconds_total", "counter", "Time spent waiting for the rate limiter.")
+	writeMetric(w, "urlhaus_rate_limit_wait_seconds_total", e.waitTotal.Seconds())
+	e.mu.Unlock()
+
+	hits, misses := e.cache.stats()
+	writeMetricHeader(w, "urlhaus_cache_hits_total", "counter", "Number of lookups answered from the cache.")
+	writeMetric(w, "urlhaus_cache_hits_total", float64(hits))
+	writeMetricHeader(w, "urlhaus_cache_misses_total", "counter", "Number of lookups missing from the cache.")
+	writeMetric(w, "urlhaus_cache_misses_total", float64(misses))
+	writeMetricHeader(w, "urlhaus_cache_hit_ratio", "gauge", "Ratio of lookups answered from the cache.")
+	ratio := 0.0
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+	writeMetric(w, "urlhaus_cache_hit_ratio", ratio)
+
+	apiMetrics.write(w)
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
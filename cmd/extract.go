@@ -0,0 +1,514 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	extractFormat   string
+	extractOutput   string
+	extractTypes    []string
+	extractNoLookup bool
+	extractMaxDepth int
+	extractWorkers  int
+)
+
+// maxExtractSize bounds what is decompressed from a single stream or file
+const maxExtractSize = 64 << 20
+
+var (
+	refanger = strings.NewReplacer(
+		"[.]", ".", "(.)", ".", "{.}", ".", "[dot]", ".", "(dot)", ".",
+		"[:]", ":", "[://]", "://", "[/]", "/",
+	)
+	hxxpRe     = regexp.MustCompile(`(?i)\bh(?:xx|\*\*)ps?://`)
+	urlRe      = regexp.MustCompile(`(?i)\b(?:https?|ftp)://[^\s<>"'()\[\]{}\\^` + "`" + `|]+`)
+	ipRe       = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	domainRe   = regexp.MustCompile(`(?i)\b(?:[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z][a-z0-9-]{0,61}[a-z0-9]\b`)
+	md5Re      = regexp.MustCompile(`\b[a-fA-F0-9]{32}\b`)
+	sha256Re   = regexp.MustCompile(`\b[a-fA-F0-9]{64}\b`)
+	mboxFromRe = regexp.MustCompile(`(?m)^From .*\r?\n`)
+
+	// xmlNamespaceRe matches the namespace declarations of XML parts and the
+	// URIs under the well-known schema hosts, which are not indicators
+	xmlNamespaceRe = regexp.MustCompile(`(?i)\bxmlns(?::[\w.-]+)?\s*=\s*(?:"[^"]*"|'[^']*')|\b(?:https?://)?(?:schemas\.openxmlformats\.org|schemas\.microsoft\.com|www\.w3\.org|purl\.org)\b[^\s"'<>]*`)
+)
+
+// fileSuffixes are the endings of file names that look like domains
+var fileSuffixes = map[string]bool{
+	"exe": true, "dll": true, "bat": true, "ps1": true, "vbs": true, "js": true,
+	"jar": true, "doc": true, "docx": true, "docm": true, "xls": true, "xlsx": true,
+	"xlsm": true, "ppt": true, "pptx": true, "pdf": true, "rtf": true, "txt": true,
+	"htm": true, "html": true, "php": true, "asp": true, "aspx": true, "css": true,
+	"png": true, "jpg": true, "jpeg": true, "gif": true, "svg": true, "xml": true,
+	"json": true, "rels": true, "bin": true, "dat": true, "tmp": true, "log": true,
+	"gz": true, "rar": true, "7z": true, "iso": true, "img": true, "lnk": true,
+	"msi": true, "hta": true, "eml": true, "ico": true,
+}
+
+// extractedIndicator is an indicator along with where it was found and,
+// unless --no-lookup is set, its verdict
+type extractedIndicator struct {
+	logIndicator
+	Sources []string `json:"sources"`
+	Verdict *verdict `json:"verdict,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// extractReport is the consolidated outcome of an extraction
+type extractReport struct {
+	Indicators []*extractedIndicator `json:"indicators"`
+	Listed     int                   `json:"listed"`
+	Errors     int                   `json:"errors"`
+}
+
+// extractCmd represents the extract command
+var extractCmd = &cobra.Command{
+	Use:   "extract [file...]",
+	Short: "Extract and check the indicators of texts, emails and documents",
+	Long: `This command extracts the URLs, domains, IP addresses, MD5 and SHA256 hashes
+from files (or the standard input) and checks them against URLhaus: URLs
+with the url lookup, domains and IP addresses with the host lookup and
+hashes with the payload lookup, in the mirrors first.
+
+Plain text, emails (.eml) and mailboxes (mbox), PDF and Office Open XML
+documents (docx, xlsx, pptx) are read. The parts of emails are decoded,
+HTML is unescaped, and attachments are hashed and read in turn, down to
+--max-depth. Defanged indicators such as hxxp://evil[.]com are refanged.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		switch extractFormat {
+		case "text", "json", "ndjson":
+		default:
+			log.Fatalf("unknown format %q", extractFormat)
+		}
+		x := &extractor{found: map[logIndicator]*extractedIndicator{}}
+		for _, t := range extractTypes {
+			switch t {
+			case "url", "host", "md5", "sha256":
+			default:
+				log.Fatalf("unknown indicator type %q", t)
+			}
+		}
+
+		if len(args) == 0 {
+			args = []string{"-"}
+		}
+		for _, name := range args {
+			f, err := openInput(name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(io.LimitReader(f, maxExtractSize))
+			f.Close()
+			if err != nil {
+				log.Fatal(err)
+			}
+			x.data(name, b, 0)
+		}
+
+		report := &extractReport{Indicators: x.list}
+		if !extractNoLookup {
+			c, err := newChecker()
+			if err != nil {
+				log.Fatal(err)
+			}
+			var indicators []logIndicator
+			hashes := false
+			for _, in := range x.list {
+				indicators = append(indicators, in.logIndicator)
+				hashes = hashes || in.Type == "md5" || in.Type == "sha256"
+			}
+			if hashes && !c.checksPayloads() {
+				log.Print("the mirror has no payloads, the hashes are not checked: use --payload-mirror or --api")
+			}
+			verdicts, failed := checkAll(c, indicators, extractWorkers)
+			for _, e := range x.list {
+				if err, ok := failed[e.logIndicator]; ok {
+					e.Error = err.Error()
+					report.Errors++
+					continue
+				}
+				v := verdicts[e.logIndicator]
+				e.Verdict = &v
+				if v.Listed {
+					report.Listed++
+				}
+			}
+		}
+		sort.SliceStable(report.Indicators, func(i, j int) bool {
+			return report.Indicators[i].listed() && !report.Indicators[j].listed()
+		})
+
+		out, err := newNDJSONLogger(extractOutput)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writeScanReport(out, extractFormat, report); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(extractCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// extractCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// extractCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	extractCmd.Flags().StringVarP(&extractFormat, "format", "f", "text", "The output format: text, json or ndjson")
+	extractCmd.Flags().StringVarP(&extractOutput, "output", "o", "-", "The file the report is written to")
+	extractCmd.Flags().StringSliceVarP(&extractTypes, "types", "t", nil, "The types of indicators to extract among url, host, md5 and sha256 (default all)")
+	extractCmd.Flags().BoolVar(&extractNoLookup, "no-lookup", false, "Only extract the indicators")
+	extractCmd.Flags().IntVar(&extractMaxDepth, "max-depth", 5, "How deep attachments and archives are read")
+	extractCmd.Flags().IntVar(&extractWorkers, "workers", 8, "The number of concurrent lookups")
+	addCheckerFlags(extractCmd)
+}
+
+// extractor collects the indicators found in data, remembering where
+type extractor struct {
+	found map[logIndicator]*extractedIndicator
+	list  []*extractedIndicator
+}
+
+func (x *extractor) add(source, typ, value string) {
+	if len(extractTypes) > 0 && !containsString(extractTypes, typ) {
+		return
+	}
+	in := logIndicator{typ, value}
+	e, ok := x.found[in]
+	if !ok {
+		e = &extractedIndicator{logIndicator: in}
+		x.found[in] = e
+		x.list = append(x.list, e)
+	}
+	e.Sources = appendUnique(e.Sources, source)
+}
+
+// data extracts the indicators of a file, guessing its format
+func (x *extractor) data(source string, b []byte, depth int) {
+	switch {
+	case bytes.HasPrefix(b, []byte("%PDF")):
+		x.pdf(source, b)
+	case bytes.HasPrefix(b, []byte("PK\x03\x04")) && depth < extractMaxDepth:
+		x.zip(source, b, depth)
+	case looksLikeMail(b) && depth < extractMaxDepth:
+		x.mailbox(source, b, depth)
+	case isBinary(b):
+	default:
+		x.text(source, string(b))
+	}
+}
+
+// isBinary reports whether data is not text, from its first bytes
+func isBinary(b []byte) bool {
+	if len(b) > 1024 {
+		b = b[:1024]
+	}
+	return bytes.IndexByte(b, 0) >= 0
+}
+
+// looksLikeMail reports whether data is an email or a mbox
+func looksLikeMail(b []byte) bool {
+	if bytes.HasPrefix(b, []byte("From ")) {
+		return true
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		return false
+	}
+	h := msg.Header
+	return h.Get("From") != "" && (h.Get("Date") != "" || h.Get("Subject") != "" || h.Get("Mime-Version") != "" || h.Get("Received") != "")
+}
+
+// text extracts the indicators of a text, refanging it first
+func (x *extractor) text(source, s string) {
+	s = hxxpRe.ReplaceAllStringFunc(refanger.Replace(s), func(m string) string {
+		return "http" + strings.ToLower(m[4:])
+	})
+	if strings.Contains(s, "&") {
+		s = html.UnescapeString(s)
+	}
+
+	for _, u := range urlRe.FindAllString(s, -1) {
+		u = strings.TrimRight(u, ".,;:!?*'")
+		if hostOf(u) != "" {
+			x.add(source, "url", u)
+		}
+	}
+	for _, ip := range ipRe.FindAllString(s, -1) {
+		if net.ParseIP(ip) != nil {
+			x.add(source, "host", ip)
+		}
+	}
+	for _, d := range domainRe.FindAllString(s, -1) {
+		d = strings.ToLower(d)
+		tld := d[strings.LastIndex(d, ".")+1:]
+		if fileSuffixes[tld] || net.ParseIP(d) != nil || strings.Trim(tld, "0123456789") == "" {
+			continue
+		}
+		x.add(source, "host", d)
+	}
+	for _, h := range sha256Re.FindAllString(s, -1) {
+		x.add(source, "sha256", strings.ToLower(h))
+	}
+	for _, h := range md5Re.FindAllString(s, -1) {
+		x.add(source, "md5", strings.ToLower(h))
+	}
+}
+
+// hash adds the hashes of an attachment
+func (x *extractor) hash(source string, b []byte) {
+	m := md5.Sum(b)
+	s := sha256.Sum256(b)
+	x.add(source, "md5", hex.EncodeToString(m[:]))
+	x.add(source, "sha256", hex.EncodeToString(s[:]))
+}
+
+// mailbox extracts the indicators of an email or of each email of a mbox
+func (x *extractor) mailbox(source string, b []byte, depth int) {
+	if !bytes.HasPrefix(b, []byte("From ")) {
+		x.mail(source, b, depth)
+		return
+	}
+	locs := mboxFromRe.FindAllIndex(b, -1)
+	for i, loc := range locs {
+		end := len(b)
+		if i+1 < len(locs) {
+			end = locs[i+1][0]
+		}
+		x.mail(fmt.Sprintf("%s#%d", source, i+1), b[loc[1]:end], depth)
+	}
+}
+
+func (x *extractor) mail(source string, b []byte, depth int) {
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		x.text(source, string(b))
+		return
+	}
+	if subject := msg.Header.Get("Subject"); subject != "" {
+		if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+			subject = decoded
+		}
+		x.text(source, subject)
+	}
+	x.part(source, textproto.MIMEHeader(msg.Header), msg.Body, depth)
+}
+
+// part extracts the indicators of a MIME part, hashing attachments
+func (x *extractor) part(source string, h textproto.MIMEHeader, body io.Reader, depth int) {
+	ct, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		ct = "text/plain"
+	}
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	if strings.HasPrefix(ct, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for i := 1; ; i++ {
+			p, err := mr.NextPart()
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("%s: %v", source, err)
+				}
+				return
+			}
+			x.part(fmt.Sprintf("%s/%d", source, i), p.Header, p, depth)
+		}
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxExtractSize))
+	if err != nil {
+		log.Printf("%s: %v", source, err)
+	}
+
+	name := params["name"]
+	if _, dparams, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil && dparams["filename"] != "" {
+		name = dparams["filename"]
+	}
+	switch {
+	case ct == "message/rfc822" && depth < extractMaxDepth:
+		x.mail(source, b, depth+1)
+	case name != "" || !strings.HasPrefix(ct, "text/"):
+		if name == "" {
+			name = "attachment"
+		}
+		source += "/" + path.Base(name)
+		x.hash(source, b)
+		if depth < extractMaxDepth {
+			x.data(source, b, depth+1)
+		}
+	default:
+		x.text(source, string(b))
+	}
+}
+
+// zip extracts the indicators of the entries of a zip archive, such as the
+// XML parts and relationships of Office Open XML documents
+func (x *extractor) zip(source string, b []byte, depth int) {
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		log.Printf("%s: %v", source, err)
+		return
+	}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			log.Printf("%s/%s: %v", source, f.Name, err)
+			continue
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(rc, maxExtractSize))
+		rc.Close()
+		if err != nil {
+			log.Printf("%s/%s: %v", source, f.Name, err)
+			continue
+		}
+		name := source + "/" + f.Name
+		switch ext := path.Ext(f.Name); {
+		case f.Name == "[Content_Types].xml":
+			// only the content types of the parts
+		case ext == ".xml", ext == ".rels", ext == ".vml":
+			x.text(name, xmlNamespaceRe.ReplaceAllString(string(data), " "))
+		default:
+			x.data(name, data, depth+1)
+		}
+	}
+}
+
+// pdf extracts the indicators of a PDF document, in its uncompressed parts
+// such as link annotations and in its Flate compressed streams
+func (x *extractor) pdf(source string, b []byte) {
+	x.text(source, pdfUnescape(b))
+	for rest := b; ; {
+		i := bytes.Index(rest, []byte("stream"))
+		if i < 0 {
+			return
+		}
+		rest = rest[i+len("stream"):]
+		if bytes.HasPrefix(rest, []byte("\r\n")) {
+			rest = rest[2:]
+		} else if bytes.HasPrefix(rest, []byte("\n")) {
+			rest = rest[1:]
+		} else {
+			continue
+		}
+		end := bytes.Index(rest, []byte("endstream"))
+		if end < 0 {
+			return
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(rest[:end]))
+		if err == nil {
+			data, _ := ioutil.ReadAll(io.LimitReader(zr, maxExtractSize))
+			zr.Close()
+			x.text(source, pdfUnescape(data))
+		}
+		rest = rest[end:]
+	}
+}
+
+// pdfUnescape removes the backslash escapes of PDF literal strings
+func pdfUnescape(b []byte) string {
+	return strings.NewReplacer(`\(`, "(", `\)`, ")", `\\`, `\`, `\/`, "/").Replace(string(b))
+}
+
+func (e *extractedIndicator) listed() bool {
+	return e.Verdict != nil && e.Verdict.Listed
+}
+
+func (r *extractReport) records() []interface{} {
+	records := make([]interface{}, len(r.Indicators))
+	for i, v := range r.Indicators {
+		records[i] = v
+	}
+	return records
+}
+
+func (r *extractReport) writeText(w io.Writer) {
+	counts := map[string]int{}
+	for _, e := range r.Indicators {
+		counts[e.Type]++
+	}
+	fmt.Fprintf(w, "Extracted %d indicators: %d URLs, %d hosts, %d MD5 and %d SHA256 hashes",
+		len(r.Indicators), counts["url"], counts["host"], counts["md5"], counts["sha256"])
+	if extractNoLookup {
+		fmt.Fprintln(w)
+	} else {
+		fmt.Fprintf(w, ", %d listed on URLhaus", r.Listed)
+		if r.Errors > 0 {
+			fmt.Fprintf(w, ", %d lookups failed", r.Errors)
+		}
+		fmt.Fprintln(w)
+	}
+
+	for _, e := range r.Indicators {
+		switch {
+		case e.Verdict != nil:
+			fmt.Fprintf(w, "\n%s\n", e.Verdict.summary())
+		case e.Error != "":
+			fmt.Fprintf(w, "\n%s %s could not be looked up: %s\n", e.Type, e.Value, e.Error)
+		default:
+			fmt.Fprintf(w, "\n%s %s\n", e.Type, e.Value)
+		}
+		for _, s := range e.Sources {
+			fmt.Fprintf(w, "  found in %s\n", s)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testExtract returns the indicators extracted from data, as sorted "type
+// value" strings
+func testExtract(b []byte) []string {
+	x := &extractor{found: map[logIndicator]*extractedIndicator{}}
+	x.data("test", b, 0)
+	var got []string
+	for _, e := range x.list {
+		got = append(got, e.Type+" "+e.Value)
+	}
+	sort.Strings(got)
+	return got
+}
+
+func TestExtractText(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"hxxp://evil[.]example[.]com/a.exe", []string{"host evil.example.com", "url http://evil.example.com/a.exe"}},
+		{"see HXXPS://bad(.)example[dot]net[/]x, then", []string{"host bad.example.net", "url https://bad.example.net/x"}},
+		{"callback to 198.51.100[.]7 and 203.0.113.300", []string{"host 198.51.100.7"}},
+		{"drops invoice.exe and report.pdf from cdn.example.org", []string{"host cdn.example.org"}},
+		{"<a href=\"http://example.com/?a=1&amp;b=2\">", []string{"host example.com", "url http://example.com/?a=1&b=2"}},
+		{"MD5 D41D8CD98F00B204E9800998ECF8427E", []string{"md5 d41d8cd98f00b204e9800998ecf8427e"}},
+		{"sha256 e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", []string{"sha256 e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"}},
+	}
+	for _, tt := range tests {
+		if got := testExtract([]byte(tt.text)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestExtractMail(t *testing.T) {
+	attachment := []byte("fetch hxxp://payload[.]example[.]org/stage2\n")
+	b64 := base64.StdEncoding.EncodeToString(attachment)
+	mail := strings.Join([]string{
+		"From: sender@example.com",
+		"To: victim@example.com",
+		"Subject: =?utf-8?q?Invoice_from_billing=2Eexample=2Enet?=",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/mixed; boundary="b1"`,
+		"",
+		"--b1",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Transfer-Encoding: quoted-printable",
+		"",
+		"Please open http://mail.example.org/open=3Fid=3D1 today.",
+		"--b1",
+		`Content-Type: application/octet-stream; name="run.txt"`,
+		"Content-Transfer-Encoding: base64",
+		`Content-Disposition: attachment; filename="run.txt"`,
+		"",
+		b64[:20],
+		b64[20:],
+		"--b1--",
+		"",
+	}, "\r\n")
+
+	m, sum := md5.Sum(attachment), sha256.Sum256(attachment)
+	want := []string{
+		"host billing.example.net",
+		"host mail.example.org",
+		"host payload.example.org",
+		"md5 " + hex.EncodeToString(m[:]),
+		"sha256 " + hex.EncodeToString(sum[:]),
+		"url http://mail.example.org/open?id=1",
+		"url http://payload.example.org/stage2",
+	}
+	sort.Strings(want)
+	if got := testExtract([]byte(mail)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExtractPDF(t *testing.T) {
+	var stream bytes.Buffer
+	zw := zlib.NewWriter(&stream)
+	zw.Write([]byte("BT (Download from http://pdf.example.net/get\\(1\\).exe) Tj ET"))
+	zw.Close()
+
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n1 0 obj << /Type /Annot /A << /S /URI /URI (https:\\/\\/link.example.com/a) >> >> endobj\n")
+	fmt.Fprintf(&pdf, "2 0 obj << /Length %d /Filter /FlateDecode >>\nstream\n", stream.Len())
+	pdf.Write(stream.Bytes())
+	pdf.WriteString("\nendstream\nendobj\n%%EOF\n")
+
+	want := []string{
+		"host link.example.com",
+		"host pdf.example.net",
+		"url http://pdf.example.net/get",
+		"url https://link.example.com/a",
+	}
+	if got := testExtract(pdf.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExtractOOXML(t *testing.T) {
+	parts := []struct{ name, content string }{
+		{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/></Types>`},
+		{"docProps/core.xml", `<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"><dc:creator>a</dc:creator></cp:coreProperties>`},
+		{"word/document.xml", `<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main" xmlns:w14="http://schemas.microsoft.com/office/word/2010/wordml" mc:Ignorable="w14"><w:body><w:p><w:r><w:t>Visit docs.example.com</w:t></w:r></w:p></w:body></w:document>`},
+		{"word/_rels/document.xml.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/hyperlink" Target="http://evil.example.net/doc.hta" TargetMode="External"/></Relationships>`},
+	}
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, p := range parts {
+		w, err := zw.Create(p.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(p.content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"host docs.example.com",
+		"host evil.example.net",
+		"url http://evil.example.net/doc.hta",
+	}
+	if got := testExtract(b.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
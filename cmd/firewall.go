@@ -0,0 +1,411 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	firewallFormat    string
+	firewallAggregate bool
+	firewallDiff      string
+	firewallSet       string
+	firewallTable     string
+)
+
+// firewallFormats maps each supported format to its writer. A writer is
+// given the prefixes to add and, in diff mode, the prefixes to remove.
+var firewallFormats = map[string]func(w io.Writer, add, del []netip.Prefix, diff bool){
+	"nftables":  writeNftables,
+	"ipset":     writeIPSet,
+	"iptables":  writeIPTables(false),
+	"ip6tables": writeIPTables(true),
+	"cidr":      writeCIDR,
+}
+
+// firewallCmd represents the firewall command
+var firewallCmd = &cobra.Command{
+	Use:   "firewall",
+	Short: "Export malware hosts that are IP addresses as a firewall set",
+	Long: `This command exports the hosts of malware URLs that are bare IPv4 or IPv6
+addresses as firewall sets.
+
+Formats:
+  nftables   nft -f script filling an ipv4_addr and an ipv6_addr set
+  ipset      ipset restore script filling hash:net sets
+  iptables   iptables-restore script with a DROP rule per IPv4 network
+  ip6tables  ip6tables-restore script with a DROP rule per IPv6 network
+  cidr       one network per line
+
+With --aggregate, adjacent addresses are merged into the smallest list of
+CIDR networks covering exactly the same addresses.
+
+With --diff, the networks are compared to the ones in the given file, only
+the additions and removals are written, and the file is replaced with the
+full, updated list so that the next run picks up from there.
+
+The iptables and ip6tables scripts must be loaded with
+iptables-restore --noflush, as iptables-restore otherwise flushes the whole
+filter table. A full script declares (and so flushes) the chain, a diff
+script only deletes and appends rules and expects the chain left by the
+previous load. Nothing jumps to the chain until it is hooked once, e.g.:
+
+  iptables -I INPUT -j URLHAUS
+  iptables -I FORWARD -j URLHAUS`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		write, ok := firewallFormats[firewallFormat]
+		if !ok {
+			log.Fatalf("unknown firewall format %q", firewallFormat)
+		}
+
+		results, err := exportResults()
+		if err != nil {
+			log.Fatal(err)
+		}
+		entries, err := exportURLEntries(results)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var prefixes []netip.Prefix
+		for _, h := range collectHosts(entries) {
+			addr, err := netip.ParseAddr(strings.Trim(h, "[]"))
+			if err != nil {
+				continue
+			}
+			addr = addr.Unmap().WithZone("")
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+		if firewallAggregate {
+			prefixes = aggregatePrefixes(prefixes)
+		} else {
+			sortPrefixes(prefixes)
+		}
+
+		add, del := prefixes, []netip.Prefix(nil)
+		if firewallDiff != "" {
+			old, err := readPrefixes(firewallDiff)
+			if err != nil && !os.IsNotExist(err) {
+				log.Fatal(err)
+			}
+			add, del = diffPrefixes(old, prefixes)
+		}
+
+		w, done, err := exportWriter()
+		if err != nil {
+			log.Fatal(err)
+		}
+		write(w, add, del, firewallDiff != "")
+		if err := done(); err != nil {
+			log.Fatal(err)
+		}
+
+		if firewallDiff != "" {
+			f, err := os.Create(firewallDiff)
+			if err != nil {
+				log.Fatal(err)
+			}
+			bw := bufio.NewWriter(f)
+			write(bw, prefixes, nil, false)
+			if err := bw.Flush(); err != nil {
+				log.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				log.Fatal(err)
+			}
+		}
+	},
+}
+
+func init() {
+	exportCmd.AddCommand(firewallCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// firewallCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// firewallCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	firewallCmd.Flags().StringVarP(&firewallFormat, "format", "f", "cidr", "The format of the firewall set")
+	firewallCmd.Flags().BoolVarP(&firewallAggregate, "aggregate", "a", false, "Aggregate addresses into CIDR networks")
+	firewallCmd.Flags().StringVar(&firewallDiff, "diff", "", "Only write the changes since the given, previously generated file")
+	firewallCmd.Flags().StringVar(&firewallSet, "set", "urlhaus", "The name of the set or chain")
+	firewallCmd.Flags().StringVar(&firewallTable, "table", "inet filter", "The nftables family and table holding the sets")
+}
+
+func sortPrefixes(prefixes []netip.Prefix) {
+	sort.Slice(prefixes, func(i, j int) bool {
+		a, b := prefixes[i], prefixes[j]
+		if a.Addr() != b.Addr() {
+			return a.Addr().Less(b.Addr())
+		}
+		return a.Bits() < b.Bits()
+	})
+}
+
+// aggregatePrefixes returns the smallest list of prefixes covering the same
+// addresses as the given ones.
+func aggregatePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	in := make([]netip.Prefix, len(prefixes))
+	for i, p := range prefixes {
+		in[i] = p.Masked()
+	}
+	sortPrefixes(in)
+
+	var out []netip.Prefix
+	for _, p := range in {
+		if n := len(out); n > 0 && out[n-1].Bits() <= p.Bits() && out[n-1].Contains(p.Addr()) {
+			continue
+		}
+		out = append(out, p)
+
+		// merge the last two prefixes as long as they are the two halves
+		// of the same network
+		for len(out) >= 2 {
+			a, b := out[len(out)-2], out[len(out)-1]
+			if a.Bits() != b.Bits() || a.Bits() == 0 {
+				break
+			}
+			pa, _ := a.Addr().Prefix(a.Bits() - 1)
+			pb, _ := b.Addr().Prefix(b.Bits() - 1)
+			if pa != pb {
+				break
+			}
+			out = append(out[:len(out)-2], pa)
+		}
+	}
+	return out
+}
+
+// readPrefixes collects every address and network found in a file
+// generated by a previous run, whatever its format.
+func readPrefixes(name string) ([]netip.Prefix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var prefixes []netip.Prefix
+	seen := map[netip.Prefix]bool{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return strings.ContainsRune(" \t,{};+", r)
+		})
+		for _, field := range fields {
+			p, err := netip.ParsePrefix(field)
+			if err != nil {
+				a, err := netip.ParseAddr(field)
+				if err != nil {
+					continue
+				}
+				p = netip.PrefixFrom(a, a.BitLen())
+			}
+			if !seen[p] {
+				seen[p] = true
+				prefixes = append(prefixes, p)
+			}
+		}
+	}
+	return prefixes, s.Err()
+}
+
+// diffPrefixes returns the prefixes added to and removed from old
+func diffPrefixes(old, cur []netip.Prefix) (add, del []netip.Prefix) {
+	inOld := map[netip.Prefix]bool{}
+	for _, p := range old {
+		inOld[p] = true
+	}
+	inCur := map[netip.Prefix]bool{}
+	for _, p := range cur {
+		inCur[p] = true
+		if !inOld[p] {
+			add = append(add, p)
+		}
+	}
+	for _, p := range old {
+		if !inCur[p] {
+			del = append(del, p)
+		}
+	}
+	sortPrefixes(del)
+	return add, del
+}
+
+// splitFamilies separates IPv4 from IPv6 prefixes
+func splitFamilies(prefixes []netip.Prefix) (v4, v6 []netip.Prefix) {
+	for _, p := range prefixes {
+		if p.Addr().Is4() {
+			v4 = append(v4, p)
+		} else {
+			v6 = append(v6, p)
+		}
+	}
+	return v4, v6
+}
+
+func firewallHeader(w io.Writer, format string, add, del []netip.Prefix, diff bool) {
+	fmt.Fprintf(w, "# URLhaus %s set\n", format)
+	fmt.Fprintf(w, "# Generated: %s\n", time.Now().UTC().Format(time.RFC3339))
+	if diff {
+		fmt.Fprintf(w, "# Added:     %d\n", len(add))
+		fmt.Fprintf(w, "# Removed:   %d\n", len(del))
+	} else {
+		fmt.Fprintf(w, "# Entries:   %d\n", len(add))
+	}
+}
+
+func joinPrefixes(prefixes []netip.Prefix) string {
+	s := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		s[i] = p.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+func writeNftables(w io.Writer, add, del []netip.Prefix, diff bool) {
+	firewallHeader(w, "nftables", add, del, diff)
+
+	add4, add6 := splitFamilies(add)
+	del4, del6 := splitFamilies(del)
+	sets := []struct {
+		name     string
+		typ      string
+		add, del []netip.Prefix
+	}{
+		{firewallSet + "_v4", "ipv4_addr", add4, del4},
+		{firewallSet + "_v6", "ipv6_addr", add6, del6},
+	}
+
+	fmt.Fprintf(w, "table %s {\n", firewallTable)
+	for _, s := range sets {
+		fmt.Fprintf(w, "\tset %s {\n\t\ttype %s\n\t\tflags interval\n\t}\n", s.name, s.typ)
+	}
+	fmt.Fprintln(w, "}")
+
+	for _, s := range sets {
+		if !diff {
+			fmt.Fprintf(w, "flush set %s %s\n", firewallTable, s.name)
+		}
+		if len(s.del) > 0 {
+			fmt.Fprintf(w, "delete element %s %s { %s }\n", firewallTable, s.name, joinPrefixes(s.del))
+		}
+		if len(s.add) > 0 {
+			fmt.Fprintf(w, "add element %s %s { %s }\n", firewallTable, s.name, joinPrefixes(s.add))
+		}
+	}
+}
+
+func writeIPSet(w io.Writer, add, del []netip.Prefix, diff bool) {
+	firewallHeader(w, "ipset", add, del, diff)
+
+	add4, add6 := splitFamilies(add)
+	del4, del6 := splitFamilies(del)
+	sets := []struct {
+		name     string
+		family   string
+		add, del []netip.Prefix
+	}{
+		{firewallSet + "-v4", "inet", add4, del4},
+		{firewallSet + "-v6", "inet6", add6, del6},
+	}
+
+	for _, s := range sets {
+		fmt.Fprintf(w, "create %s hash:net family %s -exist\n", s.name, s.family)
+		if !diff {
+			fmt.Fprintf(w, "flush %s\n", s.name)
+		}
+		for _, p := range s.del {
+			fmt.Fprintf(w, "del %s %s -exist\n", s.name, p)
+		}
+		for _, p := range s.add {
+			fmt.Fprintf(w, "add %s %s -exist\n", s.name, p)
+		}
+	}
+}
+
+func writeIPTables(v6 bool) func(w io.Writer, add, del []netip.Prefix, diff bool) {
+	return func(w io.Writer, add, del []netip.Prefix, diff bool) {
+		add4, add6 := splitFamilies(add)
+		del4, del6 := splitFamilies(del)
+		add, del = add4, del4
+		format := "iptables"
+		if v6 {
+			add, del = add6, del6
+			format = "ip6tables"
+		}
+		chain := strings.ToUpper(firewallSet)
+
+		firewallHeader(w, format, add, del, diff)
+		fmt.Fprintf(w, "# Load with %s-restore --noflush, and hook the chain once with\n", format)
+		fmt.Fprintf(w, "# %s -I INPUT -j %s\n", format, chain)
+		fmt.Fprintln(w, "*filter")
+		if !diff {
+			// declaring the chain flushes it, so a diff relies on the
+			// chain declared by the previous full load
+			fmt.Fprintf(w, ":%s - [0:0]\n", chain)
+		}
+		for _, p := range del {
+			fmt.Fprintf(w, "-D %s -d %s -j DROP\n", chain, p)
+		}
+		for _, p := range add {
+			fmt.Fprintf(w, "-A %s -d %s -j DROP\n", chain, p)
+		}
+		fmt.Fprintln(w, "COMMIT")
+	}
+}
+
+func writeCIDR(w io.Writer, add, del []netip.Prefix, diff bool) {
+	firewallHeader(w, "CIDR", add, del, diff)
+	if !diff {
+		for _, p := range add {
+			fmt.Fprintln(w, p)
+		}
+		return
+	}
+	for _, p := range del {
+		fmt.Fprintf(w, "-%s\n", p)
+	}
+	for _, p := range add {
+		fmt.Fprintf(w, "+%s\n", p)
+	}
+}
@@ -0,0 +1,485 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// logAlert is the NDJSON record of a log line mentioning a listed indicator
+type logAlert struct {
+	Time    string `json:"time"`
+	Source  string `json:"source"`
+	Line    int    `json:"line,omitempty"`
+	Offset  *int64 `json:"offset,omitempty"`
+	LogTime string `json:"log_time,omitempty"`
+	Client  string `json:"client,omitempty"`
+	ID      string `json:"id,omitempty"`
+	verdict
+	Text string `json:"text"`
+}
+
+func newLogAlert(source string, rec logRecord, v verdict, text string) logAlert {
+	a := logAlert{
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Source:  source,
+		Client:  rec.Client,
+		ID:      rec.ID,
+		verdict: v,
+		Text:    text,
+	}
+	if !rec.Time.IsZero() {
+		a.LogTime = rec.Time.Format(time.RFC3339)
+	}
+	return a
+}
+
+// followCheckpoint is where the following of a file stopped. Head is the
+// hash of the first bytes of the file, telling whether it is still the
+// same file.
+type followCheckpoint struct {
+	Offset int64  `json:"offset"`
+	Head   string `json:"head"`
+}
+
+// headSize is how many bytes at most are hashed to recognize a file
+const headSize = 256
+
+// follower checks the lines appended to log files or received by syslog
+// as they come
+type follower struct {
+	newParser func() logParser
+	checker   *checker
+	alerts    *ndjsonLogger
+	notify    *notifier
+	noHost    sync.Once
+}
+
+// runFollow follows the log files, and listens for syslog messages, until
+// interrupted
+func runFollow(files []string, f *follower) {
+	stop := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Print("shutting down")
+		close(stop)
+	}()
+
+	if scanSyslogUDP != "" {
+		go func() { log.Fatal(f.listenSyslogUDP(scanSyslogUDP)) }()
+	}
+	if scanSyslogTCP != "" {
+		go func() { log.Fatal(f.listenSyslogTCP(scanSyslogTCP)) }()
+	}
+
+	if len(files) > 0 {
+		f.tail(files, stop)
+	} else {
+		<-stop
+	}
+	if f.notify != nil {
+		f.notify.flush(time.Minute)
+	}
+}
+
+// line checks a log line, alerting about the listed indicators. offset is
+// nil for lines received by syslog.
+func (f *follower) line(parse logParser, source string, offset *int64, text string) {
+	rec, ok := parse(text)
+	if !ok {
+		return
+	}
+	if rec.NoHost {
+		f.noHost.Do(func() { log.Print(noHostWarning) })
+	}
+	for _, in := range recordIndicators(rec) {
+		v, err := f.checker.check(in.Type, in.Value)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if !v.Listed {
+			continue
+		}
+
+		a := newLogAlert(source, rec, v, text)
+		a.Offset = offset
+		if err := f.alerts.log(a); err != nil {
+			log.Print(err)
+		}
+		if f.notify != nil {
+			f.notify.notify(notification{
+				Time:      time.Now().UTC(),
+				Source:    "scan-logs",
+				Summary:   v.Type + " " + v.Indicator + " listed on URLhaus was requested by " + rec.Client,
+				Reference: v.Reference,
+				Event:     a,
+				Key:       "scan-logs|" + v.Type + "|" + v.Indicator + "|" + rec.Client,
+			})
+		}
+	}
+}
+
+// tailer reads the lines appended to a file, reopening it when it is
+// renamed and starting over when it is truncated
+type tailer struct {
+	newParser func() logParser
+	parse     logParser
+	path      string
+	f         *os.File
+	fi        os.FileInfo
+	offset    int64
+	partial   []byte
+	headSum   string
+}
+
+// tail follows the files until stop is closed, saving the offsets reached
+// to the --checkpoint file
+func (f *follower) tail(files []string, stop chan struct{}) {
+	checkpoints := map[string]followCheckpoint{}
+	if scanCheckpoint != "" {
+		b, err := ioutil.ReadFile(scanCheckpoint)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			log.Fatal(err)
+		default:
+			if err := json.Unmarshal(b, &checkpoints); err != nil {
+				log.Fatalf("%s: %v", scanCheckpoint, err)
+			}
+		}
+	}
+
+	var tailers []*tailer
+	for _, name := range files {
+		t := &tailer{path: name, newParser: f.newParser}
+		if err := t.resume(checkpoints[name]); err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+		tailers = append(tailers, t)
+	}
+
+	saved := time.Now()
+	for {
+		for _, t := range tailers {
+			if err := t.poll(func(offset int64, text string) { f.line(t.parse, t.path, &offset, text) }); err != nil {
+				log.Printf("%s: %v", t.path, err)
+			}
+		}
+
+		select {
+		case <-stop:
+			saveCheckpoints(tailers)
+			return
+		case <-time.After(scanPoll):
+		}
+		if time.Since(saved) > 10*time.Second {
+			saveCheckpoints(tailers)
+			saved = time.Now()
+		}
+	}
+}
+
+// resume opens the file at the checkpoint if it is still the same file,
+// else at its start, or at its end without checkpoint unless --from-start
+// is set
+func (t *tailer) resume(cp followCheckpoint) error {
+	if err := t.open(); err != nil {
+		return err
+	}
+	switch {
+	case cp.Head != "":
+		if cp.Offset <= t.fi.Size() && t.head(cp.Offset) == cp.Head {
+			t.offset = cp.Offset
+		}
+	case !scanFromStart:
+		t.offset = t.fi.Size()
+	}
+	if t.offset > 0 {
+		t.skipHeader()
+	}
+	t.headSum = t.head(t.offset)
+	_, err := t.f.Seek(t.offset, io.SeekStart)
+	return err
+}
+
+// skipHeader feeds the parser with the header lines starting with # at the
+// top of the file, such as the fields of a Zeek log, which are skipped when
+// not reading from the start
+func (t *tailer) skipHeader() {
+	br := bufio.NewReader(io.NewSectionReader(t.f, 0, t.offset))
+	for {
+		l, err := br.ReadString('\n')
+		if err != nil || !strings.HasPrefix(l, "#") {
+			return
+		}
+		t.parse(strings.TrimRight(l, "\r\n"))
+	}
+}
+
+// open opens the file at its start
+func (t *tailer) open() error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	t.f, t.fi, t.offset, t.partial = f, fi, 0, nil
+	t.parse = t.newParser()
+	return nil
+}
+
+// head hashes the first bytes of the file, up to n
+func (t *tailer) head(n int64) string {
+	if n > headSize {
+		n = headSize
+	}
+	b := make([]byte, n)
+	if _, err := t.f.ReadAt(b, 0); err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// poll calls fn with the complete lines appended since the last poll, and
+// the offset of each
+func (t *tailer) poll(fn func(offset int64, text string)) error {
+	if t.f == nil {
+		if err := t.open(); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+	}
+	if t.offset > 0 && t.head(t.offset) != t.headSum {
+		// truncated, and maybe written past the offset again since, as by
+		// a copytruncate rotation
+		if err := t.rewind(); err != nil {
+			return err
+		}
+	}
+	if err := t.drain(fn); err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(t.path)
+	switch {
+	case os.IsNotExist(err):
+		// rotated, and the new file is not there yet
+		return nil
+	case err != nil:
+		return err
+	case !os.SameFile(fi, t.fi):
+		// rotated by renaming: the old file was read to the end above
+		t.f.Close()
+		t.f = nil
+		if err := t.open(); err != nil {
+			return err
+		}
+		return t.drain(fn)
+	case fi.Size() < t.offset+int64(len(t.partial)):
+		// truncated
+		if err := t.rewind(); err != nil {
+			return err
+		}
+		return t.drain(fn)
+	}
+	return nil
+}
+
+// rewind starts reading the file over from its start
+func (t *tailer) rewind() error {
+	t.offset, t.partial = 0, nil
+	t.parse = t.newParser()
+	_, err := t.f.Seek(0, io.SeekStart)
+	return err
+}
+
+// drain reads the file to its end
+func (t *tailer) drain(fn func(offset int64, text string)) error {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := t.f.Read(buf)
+		data := append(t.partial, buf[:n]...)
+		for {
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			fn(t.offset, strings.TrimRight(string(data[:i]), "\r"))
+			t.offset += int64(i + 1)
+			data = data[i+1:]
+		}
+		t.partial = append([]byte(nil), data...)
+
+		if err == io.EOF || n == 0 {
+			t.headSum = t.head(t.offset)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func saveCheckpoints(tailers []*tailer) {
+	if scanCheckpoint == "" {
+		return
+	}
+	checkpoints := map[string]followCheckpoint{}
+	for _, t := range tailers {
+		if t.f != nil {
+			checkpoints[t.path] = followCheckpoint{Offset: t.offset, Head: t.head(t.offset)}
+		}
+	}
+	b, err := json.MarshalIndent(checkpoints, "", "  ")
+	if err == nil {
+		tmp := filepath.Join(filepath.Dir(scanCheckpoint), "."+filepath.Base(scanCheckpoint)+".tmp")
+		if err = ioutil.WriteFile(tmp, b, 0644); err == nil {
+			err = os.Rename(tmp, scanCheckpoint)
+		}
+	}
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+var (
+	syslog5424Re = regexp.MustCompile(`^<\d{1,3}>1 \S+ \S+ \S+ \S+ \S+ (?:-|(?:\[(?:[^\]\\]|\\.)*\])+) ?(?:\x{FEFF})?`)
+	syslog3164Re = regexp.MustCompile(`^<\d{1,3}>(?:[A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2} \S+ )?(?:[\w./-]+(?:\[\d+\])?: )?`)
+)
+
+// syslogMessage strips the RFC 5424 or RFC 3164 header of a syslog message
+func syslogMessage(msg string) string {
+	msg = strings.TrimRight(msg, "\r\n\x00")
+	if loc := syslog5424Re.FindStringIndex(msg); loc != nil {
+		return msg[loc[1]:]
+	}
+	if loc := syslog3164Re.FindStringIndex(msg); loc != nil {
+		return msg[loc[1]:]
+	}
+	return msg
+}
+
+func (f *follower) listenSyslogUDP(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("listening for syslog on udp %s", addr)
+	parse := f.newParser()
+	buf := make([]byte, 64*1024)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		f.line(parse, "syslog:"+peer.String(), nil, syslogMessage(string(buf[:n])))
+	}
+}
+
+func (f *follower) listenSyslogTCP(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("listening for syslog on tcp %s", addr)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			source := "syslog:" + conn.RemoteAddr().String()
+			parse := f.newParser()
+			br := bufio.NewReader(conn)
+			for {
+				msg, err := readSyslogFrame(br)
+				if err != nil {
+					if err != io.EOF {
+						log.Printf("%s: %v", source, err)
+					}
+					return
+				}
+				f.line(parse, source, nil, syslogMessage(msg))
+			}
+		}()
+	}
+}
+
+// readSyslogFrame reads a message framed by octet counting or by a newline
+// (RFC 6587)
+func readSyslogFrame(br *bufio.Reader) (string, error) {
+	b, err := br.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if b[0] >= '1' && b[0] <= '9' {
+		l, err := br.ReadString(' ')
+		if err != nil {
+			return "", err
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(l))
+		if err != nil || n > 1024*1024 {
+			return "", io.ErrUnexpectedEOF
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(br, msg); err != nil {
+			return "", err
+		}
+		return string(msg), nil
+	}
+	l, err := br.ReadString('\n')
+	if err == io.EOF && l != "" {
+		err = nil
+	}
+	return l, err
+}
@@ -0,0 +1,180 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testTailer returns a tailer resumed at a checkpoint, and a function
+// polling it and returning the lines read
+func testTailer(t *testing.T, path string, cp followCheckpoint) (*tailer, func() []string) {
+	tl := &tailer{path: path, newParser: func() logParser {
+		return func(string) (logRecord, bool) { return logRecord{}, false }
+	}}
+	if err := tl.resume(cp); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if tl.f != nil {
+			tl.f.Close()
+		}
+	})
+	return tl, func() []string {
+		var lines []string
+		if err := tl.poll(func(offset int64, text string) { lines = append(lines, text) }); err != nil {
+			t.Fatal(err)
+		}
+		return lines
+	}
+}
+
+func writeTestFile(t *testing.T, path, content string, flag int) {
+	f, err := os.OpenFile(path, flag|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTailerRotation(t *testing.T) {
+	defer func(v bool) { scanFromStart = v }(scanFromStart)
+	scanFromStart = true
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	writeTestFile(t, path, "one\ntwo\n", os.O_TRUNC)
+	_, poll := testTailer(t, path, followCheckpoint{})
+
+	steps := []struct {
+		name   string
+		change func()
+		want   []string
+	}{
+		{"start", func() {}, []string{"one", "two"}},
+		{"unchanged", func() {}, nil},
+		{"partial line", func() { writeTestFile(t, path, "three\nfo", os.O_APPEND) }, []string{"three"}},
+		{"line completed", func() { writeTestFile(t, path, "ur\n", os.O_APPEND) }, []string{"four"}},
+		{"renamed", func() {
+			if err := os.Rename(path, path+".1"); err != nil {
+				t.Fatal(err)
+			}
+			// written before the program logging reopens its file
+			writeTestFile(t, path+".1", "five\n", os.O_APPEND)
+			writeTestFile(t, path, "six\n", os.O_TRUNC)
+		}, []string{"five", "six"}},
+		{"new file", func() { writeTestFile(t, path, "seven\n", os.O_APPEND) }, []string{"seven"}},
+	}
+	for _, s := range steps {
+		s.change()
+		if got := poll(); !reflect.DeepEqual(got, s.want) {
+			t.Errorf("%s: got %q, want %q", s.name, got, s.want)
+		}
+	}
+}
+
+func TestTailerTruncation(t *testing.T) {
+	defer func(v bool) { scanFromStart = v }(scanFromStart)
+	scanFromStart = true
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	writeTestFile(t, path, "first line\nsecond line\n", os.O_TRUNC)
+	tl, poll := testTailer(t, path, followCheckpoint{})
+
+	steps := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"start", "", []string{"first line", "second line"}},
+		{"truncated", "short\n", []string{"short"}},
+		// copytruncate, with more written since than was read before
+		{"truncated and grown past the offset", "a much longer first line\nand more\n", []string{"a much longer first line", "and more"}},
+	}
+	for _, s := range steps {
+		if s.content != "" {
+			writeTestFile(t, path, s.content, os.O_TRUNC)
+		}
+		if got := poll(); !reflect.DeepEqual(got, s.want) {
+			t.Errorf("%s: got %q, want %q", s.name, got, s.want)
+		}
+		if size := int64(len(s.content)); s.content != "" && tl.offset != size {
+			t.Errorf("%s: offset %d, want %d", s.name, tl.offset, size)
+		}
+	}
+}
+
+func TestTailerResume(t *testing.T) {
+	defer func(v bool, s string) { scanFromStart, scanCheckpoint = v, s }(scanFromStart, scanCheckpoint)
+	dir := t.TempDir()
+	scanCheckpoint = filepath.Join(dir, "checkpoint.json")
+	path := filepath.Join(dir, "access.log")
+
+	writeTestFile(t, path, "#fields\tts\tclient\none\ntwo\n", os.O_TRUNC)
+	scanFromStart = true
+	tl, poll := testTailer(t, path, followCheckpoint{})
+	poll()
+	saveCheckpoints([]*tailer{tl})
+
+	b, err := ioutil.ReadFile(scanCheckpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var checkpoints map[string]followCheckpoint
+	if err := json.Unmarshal(b, &checkpoints); err != nil {
+		t.Fatal(err)
+	}
+	cp := checkpoints[path]
+	if cp.Offset != 26 || cp.Head == "" {
+		t.Fatalf("checkpoint %+v", cp)
+	}
+
+	// the same file resumes at the checkpoint
+	writeTestFile(t, path, "three\n", os.O_APPEND)
+	scanFromStart = false
+	_, poll = testTailer(t, path, cp)
+	if got, want := poll(), []string{"three"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("same file: got %q, want %q", got, want)
+	}
+
+	// another file starts over
+	writeTestFile(t, path, "#fields\tts\tclient\nfour\nfive\nsix\n", os.O_TRUNC)
+	_, poll = testTailer(t, path, cp)
+	if got, want := poll(), []string{"#fields\tts\tclient", "four", "five", "six"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("other file: got %q, want %q", got, want)
+	}
+
+	// without checkpoint, only what is appended is read
+	_, poll = testTailer(t, path, followCheckpoint{})
+	writeTestFile(t, path, "seven\n", os.O_APPEND)
+	if got, want := poll(), []string{"seven"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("no checkpoint: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGlobRegexp(t *testing.T) {
+	tests := []struct {
+		glob, expr string
+	}{
+		{"*.log", `[^/]*\.log`},
+		{"file?.txt", `file[^/]\.txt`},
+		{"**/build", `(?:.*/)?build`},
+		{"logs/**", `logs/.*`},
+		{"a/**/b", `a/(?:.*/)?b`},
+		{"a**b", `a.*b`},
+		{"[abc].js", `[abc]\.js`},
+		{"[!abc].js", `[^abc]\.js`},
+		{"[a", `\[a`},
+		{`\*.md`, `\*\.md`},
+		{`\#notes`, `#notes`},
+	}
+	for _, tt := range tests {
+		if got := globRegexp(tt.glob); got != tt.expr {
+			t.Errorf("%s: got %s, want %s", tt.glob, got, tt.expr)
+		}
+	}
+}
+
+func TestGitignore(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		".git/info/exclude": "secret.txt\n",
+		".gitignore": `# comment
+*.log
+!keep.log
+/root-only.js
+build/
+docs/**/*.html
+file?.txt
+trailing.txt   
+escaped\ 
+\!bang
+\#hash
+vendor/**
+`,
+		"sub/.gitignore":      "local.js\n!*.log\n/anchored.js\n",
+		"sub/deep/.gitignore": "*.js\n",
+	}
+	for name, content := range files {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g := newGitignore(root)
+	g.load("")
+	g.load("sub")
+	g.load("sub/deep")
+
+	tests := []struct {
+		path    string
+		dir     bool
+		ignored bool
+	}{
+		{"a.log", false, true},
+		{"x/y/a.log", false, true},
+		{"keep.log", false, false},
+		{"x/keep.log", false, false},
+		{"root-only.js", false, true},
+		{"x/root-only.js", false, false},
+		{"build", true, true},
+		{"x/build", true, true},
+		{"build", false, false},
+		{"docs/a.html", false, true},
+		{"docs/x/y/a.html", false, true},
+		{"other/a.html", false, false},
+		{"file1.txt", false, true},
+		{"file10.txt", false, false},
+		{"trailing.txt", false, true},
+		{"escaped ", false, true},
+		{"escaped", false, false},
+		{"!bang", false, true},
+		{"#hash", false, true},
+		{"comment", false, false},
+		{"vendor/a/b.js", false, true},
+		{"vendor", true, false},
+		{"secret.txt", false, true},
+		{"sub/local.js", false, true},
+		{"local.js", false, false},
+		{"sub/a.log", false, false},
+		{"sub/anchored.js", false, true},
+		{"sub/x/anchored.js", false, false},
+		{"sub/deep/a.js", false, true},
+		{"sub/deep/a.log", false, false},
+		{"sub/a.js", false, false},
+	}
+	for _, tt := range tests {
+		if got := g.ignored(tt.path, tt.dir); got != tt.ignored {
+			t.Errorf("%s (dir %v): ignored %v", tt.path, tt.dir, got)
+		}
+	}
+}
@@ -0,0 +1,482 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	icapListen        string
+	icapBlockStatus   int
+	icapBlockTemplate string
+	icapBlockHosts    bool
+	icapMaxBody       int64
+	icapPreview       int
+)
+
+// icapSection is an entry of the Encapsulated header
+type icapSection struct {
+	name   string
+	offset int
+}
+
+// icapRequest is an ICAP request with its encapsulated HTTP headers
+type icapRequest struct {
+	method   string
+	service  string
+	header   textproto.MIMEHeader
+	sections []icapSection
+	reqHdr   []byte
+	resHdr   []byte
+	hasBody  bool
+	preview  int // -1 without preview
+}
+
+// icapCmd represents the icap-serve command
+var icapCmd = &cobra.Command{
+	Use:   "icap-serve",
+	Short: "Run an ICAP server blocking URLs and payloads listed on URLhaus",
+	Long: `This command runs an ICAP (RFC 3507) server for enterprise proxies.
+
+The reqmod service checks the URL, or the host of CONNECT requests, of
+every request (and its host with --block-hosts). The respmod service hashes
+response bodies up to --max-body bytes and checks their SHA256 hash as a
+payload. Listed requests and responses are replaced by the block response,
+built from --block-template (an html/template given the verdict) with the
+--block-status status code.
+
+Payload hashes are checked in the --payload-mirror, and with the API if
+--api is set or no mirror is given.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		tmpl := blockPage
+		if icapBlockTemplate != "" {
+			var err error
+			if tmpl, err = template.ParseFiles(icapBlockTemplate); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		c, err := newChecker()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !c.checksPayloads() {
+			log.Print("the mirror has no payloads, respmod lets every response through: use --payload-mirror or --api")
+		}
+		s := &icapServer{checker: c, block: tmpl, istag: strconv.FormatInt(time.Now().Unix(), 36)}
+
+		l, err := net.Listen("tcp", icapListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("listening on %s", icapListen)
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Fatal(err)
+			}
+			go s.serve(conn)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(icapCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// icapCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// icapCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	icapCmd.Flags().StringVarP(&icapListen, "listen", "l", "127.0.0.1:1344", "The address to listen on")
+	icapCmd.Flags().IntVar(&icapBlockStatus, "block-status", http.StatusForbidden, "The HTTP status of the block response")
+	icapCmd.Flags().StringVar(&icapBlockTemplate, "block-template", "", "An HTML template file for the block response")
+	icapCmd.Flags().BoolVar(&icapBlockHosts, "block-hosts", false, "Also block requests whose host is listed")
+	icapCmd.Flags().Int64Var(&icapMaxBody, "max-body", 32<<20, "The largest response body hashed, in bytes")
+	icapCmd.Flags().IntVar(&icapPreview, "preview", 0, "The preview size offered in OPTIONS responses")
+	addCheckerFlags(icapCmd)
+}
+
+type icapServer struct {
+	checker *checker
+	block   *template.Template
+	istag   string
+}
+
+func (s *icapServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		req, err := readICAPRequest(r)
+		if err != nil {
+			if err != io.EOF {
+				s.writeStatus(w, 400, "Bad Request")
+				w.Flush()
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		switch req.method {
+		case "OPTIONS":
+			err = s.options(w, req)
+		case "REQMOD":
+			err = s.reqmod(r, w, req)
+		case "RESPMOD":
+			err = s.respmod(r, w, req)
+		default:
+			s.writeStatus(w, 405, "Method Not Allowed")
+			w.Flush()
+			return
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			log.Printf("%s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+func (s *icapServer) writeStatus(w io.Writer, code int, text string) {
+	fmt.Fprintf(w, "ICAP/1.0 %d %s\r\nISTag: \"%s\"\r\nEncapsulated: null-body=0\r\n\r\n", code, text, s.istag)
+}
+
+func (s *icapServer) options(w io.Writer, req *icapRequest) error {
+	method := "REQMOD"
+	if strings.Contains(req.service, "resp") {
+		method = "RESPMOD"
+	}
+	fmt.Fprintf(w, "ICAP/1.0 200 OK\r\n")
+	fmt.Fprintf(w, "Methods: %s\r\n", method)
+	fmt.Fprintf(w, "Service: urlhaus-cli\r\n")
+	fmt.Fprintf(w, "ISTag: \"%s\"\r\n", s.istag)
+	fmt.Fprintf(w, "Allow: 204\r\n")
+	fmt.Fprintf(w, "Preview: %d\r\n", icapPreview)
+	fmt.Fprintf(w, "Transfer-Preview: *\r\n")
+	fmt.Fprintf(w, "Options-TTL: 3600\r\n")
+	fmt.Fprintf(w, "Encapsulated: null-body=0\r\n\r\n")
+	return nil
+}
+
+func (s *icapServer) reqmod(r *bufio.Reader, w *bufio.Writer, req *icapRequest) error {
+	hreq, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(req.reqHdr)))
+	if err != nil {
+		return err
+	}
+
+	var v verdict
+	if hreq.Method == http.MethodConnect {
+		host, _, err := net.SplitHostPort(hreq.RequestURI)
+		if err != nil {
+			host = hreq.RequestURI
+		}
+		v, err = s.checker.check("host", strings.ToLower(host))
+	} else {
+		u := hreq.URL
+		if !u.IsAbs() {
+			u.Scheme, u.Host = "http", hreq.Host
+		}
+		v, err = s.checker.check("url", u.String())
+		if err == nil && !v.Listed && icapBlockHosts {
+			v, err = s.checker.check("host", strings.ToLower(u.Hostname()))
+		}
+	}
+	if err != nil {
+		log.Printf("REQMOD: %v", err)
+	}
+
+	if v.Listed || req.noContentAllowed() {
+		if err := s.readBody(r, w, req, ioutil.Discard, false); err != nil {
+			return err
+		}
+		if v.Listed {
+			log.Printf("blocked %s %s: %s", v.Type, v.Indicator, v.Reference)
+			return s.writeBlock(w, v)
+		}
+		s.writeStatus(w, 204, "No Content")
+		return nil
+	}
+
+	var body bytes.Buffer
+	if err := s.readBody(r, w, req, &body, true); err != nil {
+		return err
+	}
+	return s.writeUnmodified(w, "req", req.reqHdr, req.hasBody, body.Bytes())
+}
+
+func (s *icapServer) respmod(r *bufio.Reader, w *bufio.Writer, req *icapRequest) error {
+	allow204 := strings.Contains(req.header.Get("Allow"), "204")
+	if !req.hasBody {
+		if req.noContentAllowed() {
+			s.writeStatus(w, 204, "No Content")
+			return nil
+		}
+		return s.writeUnmodified(w, "res", req.resHdr, false, nil)
+	}
+
+	// the body is only kept when it has to be sent back
+	h := sha256.New()
+	hashed := &limitedWriter{w: h, n: icapMaxBody}
+	var body bytes.Buffer
+	var dst io.Writer = hashed
+	if !allow204 {
+		dst = io.MultiWriter(hashed, &body)
+	}
+	if err := s.readBody(r, w, req, dst, true); err != nil {
+		return err
+	}
+
+	if hashed.n >= 0 {
+		sum := hex.EncodeToString(h.Sum(nil))
+		v, err := s.checker.check("sha256", sum)
+		if err != nil {
+			log.Printf("RESPMOD: %v", err)
+		}
+		if v.Listed {
+			log.Printf("blocked payload %s: %s", sum, v.Reference)
+			return s.writeBlock(w, v)
+		}
+	}
+
+	if allow204 {
+		s.writeStatus(w, 204, "No Content")
+		return nil
+	}
+	return s.writeUnmodified(w, "res", req.resHdr, true, body.Bytes())
+}
+
+// readBody reads the encapsulated body into dst. After a preview, the rest
+// of the body is requested only if all of it is wanted.
+func (s *icapServer) readBody(r *bufio.Reader, w *bufio.Writer, req *icapRequest, dst io.Writer, all bool) error {
+	if !req.hasBody {
+		return nil
+	}
+	if req.preview >= 0 {
+		ieof, err := readICAPChunks(r, dst)
+		if err != nil || ieof || !all {
+			return err
+		}
+		fmt.Fprintf(w, "ICAP/1.0 100 Continue\r\n\r\n")
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	_, err := readICAPChunks(r, dst)
+	return err
+}
+
+// writeUnmodified sends the HTTP message back as it was received
+func (s *icapServer) writeUnmodified(w io.Writer, kind string, hdr []byte, hasBody bool, body []byte) error {
+	encapsulated := fmt.Sprintf("%s-hdr=0, null-body=%d", kind, len(hdr))
+	if hasBody {
+		encapsulated = fmt.Sprintf("%s-hdr=0, %s-body=%d", kind, kind, len(hdr))
+	}
+	fmt.Fprintf(w, "ICAP/1.0 200 OK\r\nISTag: \"%s\"\r\nEncapsulated: %s\r\n\r\n", s.istag, encapsulated)
+	w.Write(hdr)
+	if hasBody {
+		writeICAPChunk(w, body)
+		writeICAPChunk(w, nil)
+	}
+	return nil
+}
+
+// writeBlock replaces the HTTP message with the block response
+func (s *icapServer) writeBlock(w io.Writer, v verdict) error {
+	var page bytes.Buffer
+	if err := s.block.Execute(&page, v); err != nil {
+		return err
+	}
+
+	var hdr bytes.Buffer
+	fmt.Fprintf(&hdr, "HTTP/1.1 %d %s\r\n", icapBlockStatus, http.StatusText(icapBlockStatus))
+	fmt.Fprintf(&hdr, "Content-Type: text/html; charset=utf-8\r\n")
+	fmt.Fprintf(&hdr, "Content-Length: %d\r\n", page.Len())
+	fmt.Fprintf(&hdr, "Cache-Control: no-store\r\n")
+	fmt.Fprintf(&hdr, "Connection: close\r\n\r\n")
+
+	fmt.Fprintf(w, "ICAP/1.0 200 OK\r\nISTag: \"%s\"\r\nEncapsulated: res-hdr=0, res-body=%d\r\n\r\n", s.istag, hdr.Len())
+	w.Write(hdr.Bytes())
+	writeICAPChunk(w, page.Bytes())
+	writeICAPChunk(w, nil)
+	return nil
+}
+
+// noContentAllowed reports whether the message may be left unmodified with
+// a 204 response
+func (req *icapRequest) noContentAllowed() bool {
+	return req.preview >= 0 || strings.Contains(req.header.Get("Allow"), "204")
+}
+
+// readICAPRequest reads an ICAP request up to its encapsulated body
+func readICAPRequest(r *bufio.Reader) (*icapRequest, error) {
+	tp := textproto.NewReader(r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Fields(line)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "ICAP/") {
+		return nil, fmt.Errorf("malformed ICAP request line %q", line)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	req := &icapRequest{method: parts[0], service: parts[1], header: header, preview: -1}
+	if p := header.Get("Preview"); p != "" {
+		if req.preview, err = strconv.Atoi(p); err != nil {
+			return nil, fmt.Errorf("malformed Preview header %q", p)
+		}
+	}
+
+	for _, e := range strings.Split(header.Get("Encapsulated"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(e), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		offset, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed Encapsulated header %q", header.Get("Encapsulated"))
+		}
+		req.sections = append(req.sections, icapSection{kv[0], offset})
+	}
+
+	for i, sec := range req.sections {
+		switch sec.name {
+		case "req-hdr", "res-hdr":
+			if i+1 >= len(req.sections) || req.sections[i+1].offset < sec.offset {
+				return nil, errors.New("malformed Encapsulated header")
+			}
+			hdr := make([]byte, req.sections[i+1].offset-sec.offset)
+			if _, err := io.ReadFull(r, hdr); err != nil {
+				return nil, err
+			}
+			if sec.name == "req-hdr" {
+				req.reqHdr = hdr
+			} else {
+				req.resHdr = hdr
+			}
+		case "req-body", "res-body":
+			req.hasBody = true
+		}
+	}
+	return req, nil
+}
+
+// readICAPChunks reads a chunked body up to its last chunk and reports
+// whether the last chunk carries the ieof extension.
+func readICAPChunks(r *bufio.Reader, dst io.Writer) (bool, error) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return false, err
+		}
+		line = strings.TrimSpace(line)
+		size, ext := line, ""
+		if i := strings.Index(line, ";"); i >= 0 {
+			size, ext = strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		}
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil || n < 0 {
+			return false, fmt.Errorf("malformed chunk size %q", line)
+		}
+
+		if n == 0 {
+			// skip the trailer up to the empty line
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return false, err
+				}
+				if strings.TrimSpace(l) == "" {
+					return ext == "ieof", nil
+				}
+			}
+		}
+
+		if _, err := io.CopyN(dst, r, n); err != nil {
+			return false, err
+		}
+		if _, err := r.ReadString('\n'); err != nil {
+			return false, err
+		}
+	}
+}
+
+// writeICAPChunk writes a chunk, the last one when data is empty
+func writeICAPChunk(w io.Writer, data []byte) {
+	if len(data) == 0 {
+		io.WriteString(w, "0\r\n\r\n")
+		return
+	}
+	fmt.Fprintf(w, "%x\r\n", len(data))
+	w.Write(data)
+	io.WriteString(w, "\r\n")
+}
+
+// limitedWriter writes up to n bytes to w and discards the rest, leaving n
+// negative once the limit has been exceeded
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.n < 0 {
+		return len(p), nil
+	}
+	if int64(len(p)) > l.n {
+		l.n = -1
+		return len(p), nil
+	}
+	l.n -= int64(len(p))
+	return l.w.Write(p)
+}
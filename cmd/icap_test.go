@@ -0,0 +1,197 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPayloadDump = `# firstseen,url,filetype,md5,sha256,signature
+"2024-01-02 10:00:00","http://1.2.3.4:8080/Mozi.m","elf","b36e7b1b3c95c05d52fed09fab8ddd16","6f3e6d992dbf984ca244efa671e3c71e89073c74126fdb372fab7378908f1997","Mozi"
+"2024-01-02 10:00:00","http://1.2.3.5/Mozi.a","elf","b36e7b1b3c95c05d52fed09fab8ddd16","6f3e6d992dbf984ca244efa671e3c71e89073c74126fdb372fab7378908f1997","Mozi"
+`
+
+// testPayloadChecker returns a checker backed by testDump and
+// testPayloadDump only
+func testPayloadChecker(t *testing.T) *checker {
+	t.Helper()
+	c := testChecker(t)
+	p, err := parsePayloadMirror(strings.NewReader(testPayloadDump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.payloads = p
+	return c
+}
+
+// icapMessage builds an ICAP request encapsulating an HTTP header and an
+// optional chunked body
+func icapMessage(method, service string, headers []string, kind, hdr, body string) string {
+	encapsulated := fmt.Sprintf("%s-hdr=0, null-body=%d", kind, len(hdr))
+	if body != "" {
+		encapsulated = fmt.Sprintf("%s-hdr=0, %s-body=%d", kind, kind, len(hdr))
+	}
+	if kind == "res" {
+		req := "GET http://a.example/ HTTP/1.1\r\nHost: a.example\r\n\r\n"
+		encapsulated = fmt.Sprintf("req-hdr=0, res-hdr=%d, res-body=%d", len(req), len(req)+len(hdr))
+		hdr = req + hdr
+	}
+	msg := method + " icap://127.0.0.1/" + service + " ICAP/1.0\r\nHost: 127.0.0.1\r\n"
+	for _, h := range headers {
+		msg += h + "\r\n"
+	}
+	msg += "Encapsulated: " + encapsulated + "\r\n\r\n" + hdr
+	if body != "" {
+		msg += fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", len(body), body)
+	}
+	return msg
+}
+
+func TestReadICAPRequest(t *testing.T) {
+	hdr := "GET http://a.example/ HTTP/1.1\r\nHost: a.example\r\n\r\n"
+	tests := []struct {
+		name    string
+		msg     string
+		method  string
+		preview int
+		hasBody bool
+		err     bool
+	}{
+		{"options", "OPTIONS icap://h/reqmod ICAP/1.0\r\nEncapsulated: null-body=0\r\n\r\n", "OPTIONS", -1, false, false},
+		{"reqmod", icapMessage("REQMOD", "reqmod", nil, "req", hdr, ""), "REQMOD", -1, false, false},
+		{"preview", icapMessage("REQMOD", "reqmod", []string{"Preview: 0"}, "req", hdr, "body"), "REQMOD", 0, true, false},
+		{"respmod", icapMessage("RESPMOD", "respmod", nil, "res", "HTTP/1.1 200 OK\r\n\r\n", "body"), "RESPMOD", -1, true, false},
+		{"HTTP request line", "GET / HTTP/1.1\r\n\r\n", "", 0, false, true},
+		{"bad preview", "REQMOD icap://h/ ICAP/1.0\r\nPreview: x\r\nEncapsulated: null-body=0\r\n\r\n", "", 0, false, true},
+		{"bad offset", "REQMOD icap://h/ ICAP/1.0\r\nEncapsulated: req-hdr=x\r\n\r\n", "", 0, false, true},
+		{"decreasing offsets", "REQMOD icap://h/ ICAP/1.0\r\nEncapsulated: req-hdr=10, null-body=0\r\n\r\n", "", 0, false, true},
+		{"last header", "REQMOD icap://h/ ICAP/1.0\r\nEncapsulated: req-hdr=0\r\n\r\n", "", 0, false, true},
+		{"truncated header", "REQMOD icap://h/ ICAP/1.0\r\nEncapsulated: req-hdr=0, null-body=100\r\n\r\nGET", "", 0, false, true},
+	}
+	for _, tt := range tests {
+		req, err := readICAPRequest(bufio.NewReader(strings.NewReader(tt.msg)))
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if req.method != tt.method || req.preview != tt.preview || req.hasBody != tt.hasBody {
+			t.Errorf("%s: got %s, preview %d, body %v", tt.name, req.method, req.preview, req.hasBody)
+		}
+		if tt.method == "REQMOD" && string(req.reqHdr) != hdr {
+			t.Errorf("%s: request header %q", tt.name, req.reqHdr)
+		}
+	}
+}
+
+func TestReadICAPChunks(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		body string
+		ieof bool
+		err  bool
+	}{
+		{"chunks", "3\r\nabc\r\n2\r\nde\r\n0\r\n\r\n", "abcde", false, false},
+		{"ieof", "3\r\nabc\r\n0; ieof\r\n\r\n", "abc", true, false},
+		{"extension and trailer", "3;name=x\r\nabc\r\n0\r\nX-Trailer: y\r\n\r\n", "abc", false, false},
+		{"bad size", "zz\r\nabc\r\n0\r\n\r\n", "", false, true},
+		{"negative size", "-1\r\n\r\n", "", false, true},
+		{"truncated", "10\r\nabc", "", false, true},
+	}
+	for _, tt := range tests {
+		var body bytes.Buffer
+		ieof, err := readICAPChunks(bufio.NewReader(strings.NewReader(tt.data)), &body)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if err == nil && (body.String() != tt.body || ieof != tt.ieof) {
+			t.Errorf("%s: got %q, ieof %v", tt.name, body.String(), ieof)
+		}
+	}
+}
+
+func TestICAPServe(t *testing.T) {
+	s := &icapServer{checker: testPayloadChecker(t), block: blockPage, istag: "test"}
+	ok := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\n\r\n"
+
+	tests := []struct {
+		name   string
+		msg    string
+		status string
+		block  bool
+	}{
+		{"listed URL", icapMessage("REQMOD", "reqmod", nil, "req", "GET http://bad.example/x.doc HTTP/1.1\r\nHost: bad.example\r\n\r\n", ""), "ICAP/1.0 200 OK", true},
+		{"listed CONNECT host", icapMessage("REQMOD", "reqmod", nil, "req", "CONNECT 1.2.3.4:443 HTTP/1.1\r\nHost: 1.2.3.4:443\r\n\r\n", ""), "ICAP/1.0 200 OK", true},
+		{"unlisted URL", icapMessage("REQMOD", "reqmod", []string{"Allow: 204"}, "req", "GET http://good.example/ HTTP/1.1\r\nHost: good.example\r\n\r\n", ""), "ICAP/1.0 204 No Content", false},
+		{"listed payload", icapMessage("RESPMOD", "respmod", nil, "res", ok, "malware payload\n"), "ICAP/1.0 200 OK", true},
+		{"unlisted payload", icapMessage("RESPMOD", "respmod", []string{"Allow: 204"}, "res", ok, "harmless\n"), "ICAP/1.0 204 No Content", false},
+		{"unlisted payload without 204", icapMessage("RESPMOD", "respmod", nil, "res", ok, "harmless\n"), "ICAP/1.0 200 OK", false},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		go s.serve(server)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		go func(msg string) {
+			client.Write([]byte(msg))
+		}(tt.msg)
+
+		r := bufio.NewReader(client)
+		status, err := r.ReadString('\n')
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			client.Close()
+			continue
+		}
+		if strings.TrimSpace(status) != tt.status {
+			t.Errorf("%s: status %q", tt.name, status)
+		}
+		header, err := textproto.NewReader(r).ReadMIMEHeader()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			client.Close()
+			continue
+		}
+		// the encapsulated HTTP header ends at the second offset
+		var hdr []byte
+		if sections := strings.Split(header.Get("Encapsulated"), ","); len(sections) == 2 {
+			var n int
+			fmt.Sscanf(sections[1][strings.Index(sections[1], "=")+1:], "%d", &n)
+			hdr = make([]byte, n)
+			io.ReadFull(r, hdr)
+		}
+		if blocked := bytes.Contains(hdr, []byte("403 Forbidden")); blocked != tt.block {
+			t.Errorf("%s: blocked %v, HTTP header %q", tt.name, blocked, hdr)
+		}
+		client.Close()
+	}
+}
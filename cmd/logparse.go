@@ -0,0 +1,246 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logIndicator is something found in a log line to check against URLhaus:
+// an url, a host, a md5 or a sha256
+type logIndicator struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// logRecord is what a log line tells about a request. ID identifies the
+// event in the sensor logs, such as the Zeek uid or the Suricata flow_id.
+// NoHost is set when the request target could not be made an URL for lack
+// of a host.
+type logRecord struct {
+	Time       time.Time
+	Client     string
+	ID         string
+	Indicators []logIndicator
+	NoHost     bool
+}
+
+// noHostWarning explains why requests without a host are not checked
+const noHostWarning = "some requests have no host to make URLs of, only their Referer is checked: log the virtual host, e.g. with Apache's vhost_combined or nginx's $host"
+
+// logParser parses a log line, returning false for lines to ignore
+type logParser func(line string) (logRecord, bool)
+
+var (
+	combinedRe = regexp.MustCompile(`^(?:(\S+) )?(\S+) \S+ (?:"[^"]*"|\S+) \[([^\]]+)\] "([^"]*)"(?: \S+ \S+ "([^"]*)")?`)
+	haproxyRe  = regexp.MustCompile(`(\S+):\d+ \[([^\]]+)\] \S+ \S+ \S+ \d+ \S+ \S+ \S+ \S+ \S+ \S+ (?:\{([^}]*)\} )?(?:\{[^}]*\} )?"([^"]*)"`)
+)
+
+// newLogParser returns a function returning a parser of a log format for
+// each file: combined (Apache and nginx, with an optional leading virtual
+// host), squid (native access.log), haproxy (HTTP log format), zeek
+// (http, dns, ssl and files logs, TSV or JSON), eve (Suricata) or regex.
+// The regex format uses the url, host, path, client and time named groups
+// of re, and layout to parse the time.
+func newLogParser(format, re, layout string) (func() logParser, error) {
+	var parse logParser
+	switch format {
+	case "combined":
+		parse = parseCombined
+	case "squid":
+		parse = parseSquid
+	case "haproxy":
+		parse = parseHAProxy
+	case "eve":
+		parse = parseEVE
+	case "zeek":
+		return newZeekParser, nil
+	case "regex":
+		var err error
+		if parse, err = newRegexParser(re, layout); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	return func() logParser { return parse }, nil
+}
+
+// parseCombined parses the combined format, optionally preceded by the
+// virtual host as in Apache's vhost_combined. Without the virtual host,
+// only absolute request targets and the Referer give URLs.
+func parseCombined(line string) (logRecord, bool) {
+	m := combinedRe.FindStringSubmatch(line)
+	if m == nil {
+		return logRecord{}, false
+	}
+	rec := logRecord{Client: m[2]}
+	rec.Time, _ = time.Parse("02/Jan/2006:15:04:05 -0700", m[3])
+
+	req := strings.Fields(m[4])
+	if len(req) < 2 {
+		return logRecord{}, false
+	}
+	rec.Indicators = requestIndicators(req[0], req[1], m[1])
+	rec.NoHost = len(rec.Indicators) == 0 && strings.HasPrefix(req[1], "/")
+	if ref := m[5]; strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://") {
+		rec.Indicators = append(rec.Indicators, logIndicator{"url", ref})
+	}
+	return rec, true
+}
+
+// parseSquid parses Squid's native access.log format
+func parseSquid(line string) (logRecord, bool) {
+	f := strings.Fields(line)
+	if len(f) < 7 {
+		return logRecord{}, false
+	}
+	ts, err := strconv.ParseFloat(f[0], 64)
+	if err != nil {
+		return logRecord{}, false
+	}
+	rec := logRecord{
+		Time:   time.Unix(int64(ts), int64((ts-float64(int64(ts)))*1e9)),
+		Client: f[2],
+	}
+	rec.Indicators = requestIndicators(f[5], f[6], "")
+	return rec, true
+}
+
+// parseHAProxy parses the HAProxy HTTP log format, taking the host from the
+// first captured request header when it is there
+func parseHAProxy(line string) (logRecord, bool) {
+	m := haproxyRe.FindStringSubmatch(line)
+	if m == nil {
+		return logRecord{}, false
+	}
+	rec := logRecord{Client: m[1]}
+	rec.Time, _ = time.Parse("02/Jan/2006:15:04:05.000", m[2])
+
+	req := strings.Fields(m[4])
+	if len(req) < 2 {
+		return logRecord{}, false
+	}
+	host := strings.SplitN(m[3], "|", 2)[0]
+	rec.Indicators = requestIndicators(req[0], req[1], host)
+	return rec, true
+}
+
+func newRegexParser(expr, layout string) (logParser, error) {
+	if expr == "" {
+		return nil, fmt.Errorf("the regex format requires --regex")
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	groups := map[string]int{}
+	for i, name := range re.SubexpNames() {
+		if name != "" {
+			groups[name] = i
+		}
+	}
+	if groups["url"] == 0 && groups["host"] == 0 {
+		return nil, fmt.Errorf("--regex needs an url or a host named group")
+	}
+
+	return func(line string) (logRecord, bool) {
+		m := re.FindStringSubmatch(line)
+		if m == nil {
+			return logRecord{}, false
+		}
+		group := func(name string) string {
+			if i, ok := groups[name]; ok {
+				return m[i]
+			}
+			return ""
+		}
+
+		rec := logRecord{Client: group("client")}
+		if t := group("time"); t != "" {
+			rec.Time = parseLogTime(t, layout)
+		}
+		switch u, host, path := group("url"), group("host"), group("path"); {
+		case u != "":
+			rec.Indicators = requestIndicators("GET", u, host)
+		case host != "" && path != "":
+			rec.Indicators = requestIndicators("GET", path, host)
+		case host != "":
+			rec.Indicators = []logIndicator{{"host", hostWithoutPort(host)}}
+		}
+		return rec, len(rec.Indicators) > 0
+	}, nil
+}
+
+// parseLogTime parses a time with layout or, without one, as RFC 3339, the
+// combined log format or a Unix timestamp
+func parseLogTime(s, layout string) time.Time {
+	if layout != "" {
+		t, _ := time.Parse(layout, s)
+		return t
+	}
+	for _, l := range []string{time.RFC3339Nano, "02/Jan/2006:15:04:05 -0700", "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(l, s); err == nil {
+			return t
+		}
+	}
+	if ts, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(int64(ts), int64((ts-float64(int64(ts)))*1e9))
+	}
+	return time.Time{}
+}
+
+// requestIndicators returns the URL requested, given the method, the
+// request target and the virtual host if known, or the host of a CONNECT
+func requestIndicators(method, target, vhost string) []logIndicator {
+	switch {
+	case method == "CONNECT":
+		return []logIndicator{{"host", hostWithoutPort(target)}}
+	case strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://"):
+		return []logIndicator{{"url", target}}
+	case strings.HasPrefix(target, "/") && vhost != "" && vhost != "-":
+		scheme := "http://"
+		if _, port, err := net.SplitHostPort(vhost); err == nil {
+			switch port {
+			case "80":
+				vhost = strings.TrimSuffix(vhost, ":80")
+			case "443":
+				scheme = "https://"
+				vhost = strings.TrimSuffix(vhost, ":443")
+			}
+		}
+		return []logIndicator{{"url", scheme + vhost + target}}
+	}
+	return nil
+}
+
+// hostWithoutPort strips the port and brackets from a host
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.Trim(host, "[]")
+}
@@ -0,0 +1,86 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCombined(t *testing.T) {
+	tests := []struct {
+		name       string
+		line       string
+		client     string
+		indicators []logIndicator
+		noHost     bool
+		ok         bool
+	}{
+		{
+			"combined with a Referer",
+			`10.0.0.1 - - [02/Jan/2024:10:00:00 +0000] "GET /x HTTP/1.1" 200 12 "http://evil.example/a?b=c" "curl/8"`,
+			"10.0.0.1", []logIndicator{{"url", "http://evil.example/a?b=c"}}, true, true,
+		},
+		{
+			"combined without a Referer",
+			`10.0.0.1 - - [02/Jan/2024:10:00:00 +0000] "GET /x HTTP/1.1" 200 12 "-" "curl/8"`,
+			"10.0.0.1", nil, true, true,
+		},
+		{
+			"common",
+			`10.0.0.1 - frank [02/Jan/2024:10:00:00 +0000] "GET /x HTTP/1.1" 200 12`,
+			"10.0.0.1", nil, true, true,
+		},
+		{
+			"vhost_combined",
+			`www.example.com:443 10.0.0.1 - - [02/Jan/2024:10:00:00 +0000] "GET /x HTTP/1.1" 200 12 "https://www.example.com/" "curl/8"`,
+			"10.0.0.1", []logIndicator{{"url", "https://www.example.com/x"}, {"url", "https://www.example.com/"}}, false, true,
+		},
+		{
+			"proxy request",
+			`10.0.0.1 - - [02/Jan/2024:10:00:00 +0000] "GET http://evil.example/x HTTP/1.1" 200 12 "-" "-"`,
+			"10.0.0.1", []logIndicator{{"url", "http://evil.example/x"}}, false, true,
+		},
+		{
+			"CONNECT",
+			`10.0.0.1 - - [02/Jan/2024:10:00:00 +0000] "CONNECT evil.example:443 HTTP/1.1" 200 12 "-" "-"`,
+			"10.0.0.1", []logIndicator{{"host", "evil.example"}}, false, true,
+		},
+		{"garbage", "not a log line", "", nil, false, false},
+		{"empty request", `10.0.0.1 - - [02/Jan/2024:10:00:00 +0000] "-" 400 0 "-" "-"`, "", nil, false, false},
+	}
+	for _, tt := range tests {
+		rec, ok := parseCombined(tt.line)
+		if ok != tt.ok {
+			t.Errorf("%s: ok %v", tt.name, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if rec.Client != tt.client || rec.NoHost != tt.noHost || !reflect.DeepEqual(rec.Indicators, tt.indicators) {
+			t.Errorf("%s: got %s %v %v", tt.name, rec.Client, rec.Indicators, rec.NoHost)
+		}
+		if rec.Time.IsZero() {
+			t.Errorf("%s: no time", tt.name)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	lookupType     string
+	lookupWithHost bool
+	lookupFormat   string
+	lookupDetails  bool
+)
+
+// lookupTypes maps the --type values to the lookups they perform
+var lookupTypes = map[string]string{
+	"url":       "url",
+	"domain":    "host",
+	"ip":        "host",
+	"host":      "host",
+	"md5":       "md5",
+	"sha256":    "sha256",
+	"tag":       "tag",
+	"signature": "signature",
+}
+
+// lookupView is the unified verdict about an argument of the lookup command
+type lookupView struct {
+	Input        string      `json:"input"`
+	Type         string      `json:"type"`
+	Endpoint     string      `json:"endpoint"`
+	Query        string      `json:"query"`
+	Listed       bool        `json:"listed"`
+	Status       string      `json:"status,omitempty"`
+	Threat       string      `json:"threat,omitempty"`
+	Signatures   []string    `json:"signatures,omitempty"`
+	Tags         []string    `json:"tags,omitempty"`
+	FirstSeen    string      `json:"firstseen,omitempty"`
+	LastSeen     string      `json:"lastseen,omitempty"`
+	URLCount     int         `json:"url_count"`
+	OnlineURLs   int         `json:"online_url_count"`
+	PayloadCount int         `json:"payload_count"`
+	Blacklists   []string    `json:"blacklists,omitempty"`
+	Reference    string      `json:"urlhaus_reference,omitempty"`
+	Host         *lookupView `json:"host,omitempty"`
+	Error        string      `json:"error,omitempty"`
+}
+
+// classifyLookup returns the type (url, domain, ip, md5, sha256 or word) of
+// an argument and the value to look up
+func classifyLookup(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	switch classifyIndicator(s) {
+	case "url":
+		return "url", s
+	case "md5":
+		return "md5", strings.ToLower(s)
+	case "sha256":
+		return "sha256", strings.ToLower(s)
+	case "host":
+		h := normalizeIndicator("host", s).Value
+		if isIP(h) {
+			return "ip", h
+		}
+		return "domain", h
+	}
+	// a host followed by a path or a port is an URL missing its scheme
+	if i := strings.IndexAny(s, "/:"); i > 0 && classifyIndicator(strings.Trim(s[:i], "[]")) == "host" {
+		return "url", "http://" + s
+	}
+	return "word", s
+}
+
+// lookupArg looks up an argument, as the given type or the classified one.
+// Words are looked up both as signatures and tags.
+func lookupArg(arg, typ string) []*lookupView {
+	value := strings.TrimSpace(arg)
+	if typ == "auto" {
+		typ, value = classifyLookup(arg)
+	} else if typ == "domain" || typ == "ip" || typ == "host" {
+		value = normalizeIndicator("host", value).Value
+	}
+
+	if typ != "word" {
+		v := lookupOne(arg, typ, value)
+		if typ == "url" && lookupWithHost && v.Error == "" {
+			if h := hostOf(value); h != "" {
+				ht := "domain"
+				if isIP(h) {
+					ht = "ip"
+				}
+				v.Host = lookupOne(h, ht, h)
+			}
+		}
+		return []*lookupView{v}
+	}
+
+	var views []*lookupView
+	var tag *lookupView
+	for _, typ := range []string{"signature", "tag"} {
+		v := lookupOne(arg, typ, value)
+		if v.Listed || v.Error != "" {
+			views = append(views, v)
+		}
+		tag = v
+	}
+	if len(views) == 0 {
+		// neither, reported as the tag it is not
+		views = append(views, tag)
+	}
+	return views
+}
+
+// lookupOne queries the endpoint of a type and summarizes its result
+func lookupOne(input, typ, value string) *lookupView {
+	v := &lookupView{Input: input, Type: typ, Query: value}
+	r, err := lookupResult(lookupTypes[typ], value)
+	if err != nil {
+		v.Error = err.Error()
+		return v
+	}
+	v.Endpoint = r.kind
+	res := normalizeResult(r)
+	switch res.QueryStatus {
+	case "ok":
+		v.Listed = true
+	case "no_results":
+		return v
+	default:
+		v.Error = res.QueryStatus
+		return v
+	}
+
+	v.FirstSeen = res.FirstSeen
+	v.LastSeen = res.LastSeen
+	v.URLCount = res.URLCount
+	if v.URLCount == 0 {
+		v.URLCount = len(res.URLs)
+	}
+	v.PayloadCount = res.PayloadCount
+	if v.PayloadCount == 0 {
+		v.PayloadCount = len(res.Payloads)
+	}
+	for _, e := range res.URLs {
+		if e.Status == "online" {
+			v.OnlineURLs++
+		}
+		if v.Threat == "" {
+			v.Threat = e.Threat
+		}
+		if e.Signature != "" {
+			v.Signatures = appendUnique(v.Signatures, e.Signature)
+		}
+		v.Tags = appendUnique(v.Tags, e.Tags...)
+	}
+	for _, p := range res.Payloads {
+		if p.Signature != "" {
+			v.Signatures = appendUnique(v.Signatures, p.Signature)
+		}
+	}
+
+	switch r.kind {
+	case "url":
+		v.Status = res.URLs[0].Status
+		v.Blacklists = res.URLs[0].listedOn()
+		v.Reference = res.URLs[0].Reference
+	case "host":
+		v.Blacklists = urlEntry{Blacklists: res.Blacklists}.listedOn()
+		v.Reference = "https://urlhaus.abuse.ch/host/" + value + "/"
+	case "payload":
+		if s := str(r.data, "signature"); s != "" {
+			v.Signatures = appendUnique([]string{s}, v.Signatures...)
+		}
+		v.FirstSeen = str(r.data, "firstseen")
+		v.LastSeen = str(r.data, "lastseen")
+		v.URLCount = len(res.URLs)
+		v.PayloadCount = 0
+		v.Reference = "https://urlhaus.abuse.ch/browse.php?search=" + str(r.data, "sha256_hash")
+	case "tag", "signature":
+		v.Reference = "https://urlhaus.abuse.ch/browse/" + r.kind + "/" + url.PathEscape(value) + "/"
+	}
+	if v.Status == "" && len(res.URLs) > 0 {
+		v.Status = "offline"
+		if v.OnlineURLs > 0 {
+			v.Status = "online"
+		}
+	}
+	return v
+}
+
+// writeText writes a view as an indented block
+func (v *lookupView) writeText(w io.Writer, indent string) {
+	state := "not listed"
+	if v.Error != "" {
+		state = "error: " + v.Error
+	} else if v.Listed {
+		state = "LISTED"
+	}
+	fmt.Fprintf(w, "%s%s %s: %s\n", indent, v.Type, v.Query, state)
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(w, "%s  %-12s %s\n", indent, name+":", value)
+		}
+	}
+	if v.Listed {
+		field("Status", v.Status)
+		field("Threat", v.Threat)
+		field("Signatures", strings.Join(v.Signatures, ", "))
+		field("Tags", strings.Join(v.Tags, ", "))
+		field("First seen", v.FirstSeen)
+		field("Last seen", v.LastSeen)
+		if v.Endpoint != "url" {
+			field("URLs", fmt.Sprintf("%d (%d online)", v.URLCount, v.OnlineURLs))
+		}
+		if v.PayloadCount > 0 {
+			field("Payloads", fmt.Sprint(v.PayloadCount))
+		}
+		field("Blacklists", strings.Join(v.Blacklists, ", "))
+		field("Reference", v.Reference)
+	}
+	if v.Host != nil {
+		v.Host.writeText(w, indent+"  ")
+	}
+}
+
+// lookupDetail runs the command of the endpoint of a view, to print the
+// whole result the way it does
+func lookupDetail(v *lookupView) {
+	var c *cobra.Command
+	switch v.Type {
+	case "url":
+		c = urlCmd
+	case "domain", "ip", "host":
+		c = hostCmd
+	case "md5", "sha256":
+		printPayload(v.Type, v.Query)
+		return
+	case "tag":
+		c = tagCmd
+	case "signature":
+		c = signatureCmd
+	default:
+		return
+	}
+	c.Run(c, []string{v.Query})
+}
+
+// lookupCmd represents the lookup command
+var lookupCmd = &cobra.Command{
+	Use:   "lookup indicator...",
+	Short: "Look up anything, guessing what it is",
+	Long: `This command looks up each argument on the endpoint matching its type:
+URLs (with or without a scheme), domains and IP addresses, MD5 and SHA256
+hashes, and otherwise tags and signatures, which are both looked up. The
+--type flag overrides the guess: url, domain, ip, md5, sha256, tag or
+signature.
+
+The verdicts are printed in a unified view. With --with-host, the host of
+an URL is looked up as well, so that a known-bad host shows up even when
+the exact URL is not listed. With --details, the full result of each
+lookup is printed the way the url, host, payload, tag and signature
+commands print it, raw with --raw; it can not be combined with --format
+json.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if lookupType != "auto" && lookupTypes[lookupType] == "" {
+			log.Fatalf("unknown type %q", lookupType)
+		}
+		switch lookupFormat {
+		case "text", "json":
+		default:
+			log.Fatalf("unknown format %q", lookupFormat)
+		}
+		if lookupDetails && lookupFormat == "json" {
+			log.Fatal("--details prints the results as text: use --details --raw for the JSON results")
+		}
+
+		var views []*lookupView
+		for _, arg := range args {
+			for _, v := range lookupArg(arg, lookupType) {
+				if v.Error != "" {
+					log.Printf("%s %s: %s", v.Type, v.Query, v.Error)
+				}
+				views = append(views, v)
+			}
+		}
+
+		if lookupDetails {
+			for _, v := range views {
+				if v.Listed {
+					lookupDetail(v)
+				}
+				if v.Host != nil && v.Host.Listed {
+					lookupDetail(v.Host)
+				}
+			}
+			return
+		}
+
+		if lookupFormat == "json" {
+			out := &ndjsonLogger{w: os.Stdout}
+			if err := out.log(views); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		w := bufio.NewWriter(os.Stdout)
+		for i, v := range views {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			v.writeText(w, "")
+		}
+		if err := w.Flush(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(lookupCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// lookupCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// lookupCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	lookupCmd.Flags().StringVarP(&lookupType, "type", "t", "auto", "The type of the arguments: url, domain, ip, md5, sha256, tag, signature or auto")
+	lookupCmd.Flags().BoolVar(&lookupWithHost, "with-host", false, "Also look up the host of URLs")
+	lookupCmd.Flags().StringVarP(&lookupFormat, "format", "f", "text", "The output format: text or json")
+	lookupCmd.Flags().BoolVar(&lookupDetails, "details", false, "Print the full result of the listed indicators instead")
+}
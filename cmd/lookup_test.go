@@ -0,0 +1,131 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestClassifyLookup(t *testing.T) {
+	tests := []struct {
+		arg, typ, value string
+	}{
+		{"https://evil.example.com/a.exe", "url", "https://evil.example.com/a.exe"},
+		{"evil.example.com/a.exe", "url", "http://evil.example.com/a.exe"},
+		{"evil.example.com:8080", "url", "http://evil.example.com:8080"},
+		{"198.51.100.7:8080/bins/mozi.m", "url", "http://198.51.100.7:8080/bins/mozi.m"},
+		{"  Evil.Example.COM ", "domain", "evil.example.com"},
+		{"198.51.100.7", "ip", "198.51.100.7"},
+		{"2001:db8::1", "ip", "2001:db8::1"},
+		{"D41D8CD98F00B204E9800998ECF8427E", "md5", "d41d8cd98f00b204e9800998ecf8427e"},
+		{"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "sha256", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"Emotet", "word", "Emotet"},
+		{"Cobalt Strike", "word", "Cobalt Strike"},
+	}
+	for _, tt := range tests {
+		typ, value := classifyLookup(tt.arg)
+		if typ != tt.typ || value != tt.value {
+			t.Errorf("%q: got %s %q, want %s %q", tt.arg, typ, value, tt.typ, tt.value)
+		}
+	}
+}
+
+func TestLookupArg(t *testing.T) {
+	// the fake API knows one URL, its host, a signature and a tag
+	responses := map[string]map[string]string{
+		"url":       {"http://evil.example.com/a.exe": `{"query_status":"ok","url":"http://evil.example.com/a.exe","url_status":"online","host":"evil.example.com","threat":"malware_download","tags":["exe"]}`},
+		"host":      {"evil.example.com": `{"query_status":"ok","host":"evil.example.com","url_count":"1","urls":[{"url":"http://evil.example.com/a.exe","url_status":"online"}]}`},
+		"signature": {"Emotet": `{"query_status":"ok","urls":[{"url":"http://evil.example.com/a.exe","url_status":"offline"}]}`},
+		"tag":       {"elf": `{"query_status":"ok","urls":[{"url":"http://198.51.100.7/mozi.m","url_status":"online"}]}`},
+	}
+	var mu sync.Mutex
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint := path.Base(r.URL.Path)
+		value := r.PostFormValue(endpoint)
+		mu.Lock()
+		calls = append(calls, endpoint+" "+value)
+		mu.Unlock()
+		if resp, ok := responses[endpoint][value]; ok {
+			w.Write([]byte(resp))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"query_status": "no_results"})
+	}))
+	defer srv.Close()
+
+	defer func(u url.URL, withHost bool) { baseURL, lookupWithHost = u, withHost }(baseURL, lookupWithHost)
+	u, err := url.Parse(srv.URL + "/v1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseURL = *u
+
+	tests := []struct {
+		arg, typ string
+		withHost bool
+		views    []string
+		calls    []string
+	}{
+		{"evil.example.com/a.exe", "auto", false, []string{"url http://evil.example.com/a.exe listed"}, []string{"url http://evil.example.com/a.exe"}},
+		{"evil.example.com/a.exe", "auto", true, []string{"url http://evil.example.com/a.exe listed", "domain evil.example.com listed"},
+			[]string{"url http://evil.example.com/a.exe", "host evil.example.com"}},
+		{"EVIL.example.com", "auto", false, []string{"domain evil.example.com listed"}, []string{"host evil.example.com"}},
+		{"EVIL.example.com", "host", false, []string{"host evil.example.com listed"}, []string{"host evil.example.com"}},
+		{"Emotet", "auto", false, []string{"signature Emotet listed"}, []string{"signature Emotet", "tag Emotet"}},
+		{"elf", "auto", false, []string{"tag elf listed"}, []string{"signature elf", "tag elf"}},
+		{"unknown", "auto", false, []string{"tag unknown not listed"}, []string{"signature unknown", "tag unknown"}},
+		{"elf", "signature", false, []string{"signature elf not listed"}, []string{"signature elf"}},
+	}
+	summary := func(v *lookupView) string {
+		switch {
+		case v.Error != "":
+			return v.Type + " " + v.Query + " " + v.Error
+		case v.Listed:
+			return v.Type + " " + v.Query + " listed"
+		}
+		return v.Type + " " + v.Query + " not listed"
+	}
+	for _, tt := range tests {
+		calls = nil
+		lookupWithHost = tt.withHost
+		var views []string
+		for _, v := range lookupArg(tt.arg, tt.typ) {
+			views = append(views, summary(v))
+			if v.Host != nil {
+				views = append(views, summary(v.Host))
+			}
+		}
+		if !reflect.DeepEqual(views, tt.views) {
+			t.Errorf("%s as %s: got %q, want %q", tt.arg, tt.typ, views, tt.views)
+		}
+		if !reflect.DeepEqual(calls, tt.calls) {
+			t.Errorf("%s as %s: called %q, want %q", tt.arg, tt.typ, calls, tt.calls)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiMetrics records the requests made to the URLhaus API
+var apiMetrics = newClientMetrics()
+
+// latencyBuckets are the upper bounds of the request duration histogram
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// clientMetrics are the latency histograms and error counts of the API
+// requests, per endpoint
+type clientMetrics struct {
+	mu        sync.Mutex
+	latencies map[string]*histogram
+	errors    map[[2]string]uint64
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newClientMetrics() *clientMetrics {
+	return &clientMetrics{
+		latencies: map[string]*histogram{},
+		errors:    map[[2]string]uint64{},
+	}
+}
+
+// observe records a request to endpoint, which failed if errType is not
+// empty
+func (m *clientMetrics) observe(endpoint string, d time.Duration, errType string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.latencies[endpoint]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latencies[endpoint] = h
+	}
+	s := d.Seconds()
+	for i, le := range latencyBuckets {
+		if s <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += s
+
+	if errType != "" {
+		m.errors[[2]string{endpoint, errType}]++
+	}
+}
+
+// write writes the metrics in the Prometheus text format
+func (m *clientMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var endpoints []string
+	for endpoint := range m.latencies {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	writeMetricHeader(w, "urlhaus_api_request_duration_seconds", "histogram", "Duration of the requests to the URLhaus API.")
+	for _, endpoint := range endpoints {
+		h := m.latencies[endpoint]
+		for i, le := range latencyBuckets {
+			writeMetric(w, "urlhaus_api_request_duration_seconds_bucket", float64(h.counts[i]), "endpoint", endpoint, "le", formatFloat(le))
+		}
+		writeMetric(w, "urlhaus_api_request_duration_seconds_bucket", float64(h.count), "endpoint", endpoint, "le", "+Inf")
+		writeMetric(w, "urlhaus_api_request_duration_seconds_sum", h.sum, "endpoint", endpoint)
+		writeMetric(w, "urlhaus_api_request_duration_seconds_count", float64(h.count), "endpoint", endpoint)
+	}
+
+	var keys [][2]string
+	for k := range m.errors {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	writeMetricHeader(w, "urlhaus_api_errors_total", "counter", "Failed requests to the URLhaus API, by type of error.")
+	for _, k := range keys {
+		writeMetric(w, "urlhaus_api_errors_total", float64(m.errors[k]), "endpoint", k[0], "type", k[1])
+	}
+}
+
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeMetric writes a sample with labels given as name, value pairs
+func writeMetric(w io.Writer, name string, value float64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(labelEscaper.Replace(labels[i+1]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(value))
+	b.WriteByte('\n')
+	io.WriteString(w, b.String())
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,291 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// mirror is an in-memory copy of a URLhaus database dump
+// (https://urlhaus.abuse.ch/downloads/csv/), indexed by URL and host.
+type mirror struct {
+	urls   []urlEntry
+	byURL  map[string]int
+	byHost map[string][]int
+}
+
+var (
+	mirrorOnce sync.Once
+	mirrorData *mirror
+	mirrorErr  error
+)
+
+// localMirror loads the dump given by --mirror the first time it is called.
+// It returns nil if no mirror is configured.
+func localMirror() (*mirror, error) {
+	if mirrorPath == "" {
+		return nil, nil
+	}
+	mirrorOnce.Do(func() {
+		mirrorData, mirrorErr = loadMirror(mirrorPath)
+	})
+	return mirrorData, mirrorErr
+}
+
+// loadMirror reads a URLhaus CSV dump, either plain or zipped
+func loadMirror(name string) (*mirror, error) {
+	r, err := readDump(name)
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseMirror(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return m, nil
+}
+
+// readDump returns the content of a dump, either plain or zipped
+func readDump(name string) (io.Reader, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, []byte("PK\x03\x04")) {
+		return bytes.NewReader(b), nil
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, err
+	}
+	if len(zr.File) == 0 {
+		return nil, fmt.Errorf("%s: empty archive", name)
+	}
+	f, err := zr.File[0].Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if b, err = ioutil.ReadAll(f); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return bytes.NewReader(b), nil
+}
+
+// parseMirror parses the CSV dump. The column names are taken from the
+// commented header line since they changed over time.
+func parseMirror(r io.Reader) (*mirror, error) {
+	columns := []string{"id", "dateadded", "url", "url_status", "last_online", "threat", "tags", "urlhaus_link", "reporter"}
+
+	var data bytes.Buffer
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if strings.HasPrefix(line, "#") {
+			h := strings.TrimSpace(strings.TrimPrefix(line, "#"))
+			if strings.HasPrefix(h, "id,") {
+				columns = strings.Split(h, ",")
+			}
+		} else {
+			data.WriteString(line)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	m := &mirror{byURL: map[string]int{}, byHost: map[string][]int{}}
+
+	cr := csv.NewReader(&data)
+	cr.FieldsPerRecord = -1
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		row := map[string]string{}
+		for i, c := range columns {
+			if i < len(rec) {
+				row[c] = rec[i]
+			}
+		}
+
+		e := urlEntry{
+			URL:       row["url"],
+			Status:    row["url_status"],
+			Host:      hostOf(row["url"]),
+			Threat:    row["threat"],
+			DateAdded: row["dateadded"],
+			Reporter:  row["reporter"],
+			Reference: row["urlhaus_link"],
+		}
+		if row["tags"] != "" && row["tags"] != "None" {
+			e.Tags = strings.Split(row["tags"], ",")
+		}
+		m.add(e)
+	}
+	return m, nil
+}
+
+func (m *mirror) add(e urlEntry) {
+	if _, ok := m.byURL[e.URL]; ok {
+		return
+	}
+	m.byURL[e.URL] = len(m.urls)
+	m.byHost[e.Host] = append(m.byHost[e.Host], len(m.urls))
+	m.urls = append(m.urls, e)
+}
+
+// lookupURL returns the entry of an URL
+func (m *mirror) lookupURL(u string) (urlEntry, bool) {
+	i, ok := m.byURL[u]
+	if !ok {
+		return urlEntry{}, false
+	}
+	return m.urls[i], true
+}
+
+// lookupHost returns the entries of all URLs on a host
+func (m *mirror) lookupHost(host string) []urlEntry {
+	var entries []urlEntry
+	for _, i := range m.byHost[strings.ToLower(host)] {
+		entries = append(entries, m.urls[i])
+	}
+	return entries
+}
+
+// payloadMirror is an in-memory copy of a URLhaus payloads dump
+// (https://urlhaus.abuse.ch/downloads/payloads/), indexed by hash.
+type payloadMirror struct {
+	payloads []payloadEntry
+	// urls are the number of URLs each payload was downloaded from
+	urls   []int
+	byHash map[string]int
+}
+
+var (
+	payloadMirrorOnce sync.Once
+	payloadMirrorData *payloadMirror
+	payloadMirrorErr  error
+)
+
+// localPayloadMirror loads the dump given by --payload-mirror the first
+// time it is called. It returns nil if no payload mirror is configured.
+func localPayloadMirror() (*payloadMirror, error) {
+	if payloadMirrorPath == "" {
+		return nil, nil
+	}
+	payloadMirrorOnce.Do(func() {
+		r, err := readDump(payloadMirrorPath)
+		if err != nil {
+			payloadMirrorErr = err
+			return
+		}
+		payloadMirrorData, payloadMirrorErr = parsePayloadMirror(r)
+		if payloadMirrorErr != nil {
+			payloadMirrorErr = fmt.Errorf("%s: %v", payloadMirrorPath, payloadMirrorErr)
+		}
+	})
+	return payloadMirrorData, payloadMirrorErr
+}
+
+// parsePayloadMirror parses the CSV payloads dump, with one line per URL
+// a payload was downloaded from
+func parsePayloadMirror(r io.Reader) (*payloadMirror, error) {
+	columns := []string{"firstseen", "url", "filetype", "md5", "sha256", "signature"}
+	m := &payloadMirror{byHash: map[string]int{}}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.Comment = '#'
+	cr.LazyQuotes = true
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(rec) > 0 && strings.HasPrefix(rec[0], "firstseen") {
+			columns = rec
+			continue
+		}
+
+		row := map[string]string{}
+		for i, c := range columns {
+			if i < len(rec) {
+				row[strings.TrimSpace(c)] = rec[i]
+			}
+		}
+		sha := strings.ToLower(row["sha256"])
+		if sha == "" {
+			continue
+		}
+		if i, ok := m.byHash[sha]; ok {
+			m.urls[i]++
+			continue
+		}
+
+		e := payloadEntry{
+			MD5:        strings.ToLower(row["md5"]),
+			SHA256:     sha,
+			FileType:   row["filetype"],
+			Signature:  row["signature"],
+			FirstSeen:  row["firstseen"],
+			Reference:  "https://urlhaus.abuse.ch/browse.php?search=" + sha,
+			VirusTotal: -1,
+		}
+		if e.Signature == "None" || e.Signature == "null" {
+			e.Signature = ""
+		}
+		m.byHash[sha] = len(m.payloads)
+		if e.MD5 != "" {
+			m.byHash[e.MD5] = len(m.payloads)
+		}
+		m.payloads = append(m.payloads, e)
+		m.urls = append(m.urls, 1)
+	}
+	return m, nil
+}
+
+// lookup returns the payload of a MD5 or SHA256 hash, and the number of
+// URLs it was downloaded from
+func (m *payloadMirror) lookup(hash string) (payloadEntry, int, bool) {
+	i, ok := m.byHash[strings.ToLower(hash)]
+	if !ok {
+		return payloadEntry{}, 0, false
+	}
+	return m.payloads[i], m.urls[i], true
+}
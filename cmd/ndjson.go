@@ -0,0 +1,87 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// ndjsonLogger writes one JSON object per line, safely from many goroutines
+type ndjsonLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newNDJSONLogger logs to a file, appending to it, or to stdout for -
+func newNDJSONLogger(name string) (*ndjsonLogger, error) {
+	if name == "" || name == "-" {
+		return &ndjsonLogger{w: os.Stdout}, nil
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &ndjsonLogger{w: f}, nil
+}
+
+func (l *ndjsonLogger) log(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(append(b, '\n'))
+	return err
+}
+
+// scanReport is the report of a scan, with the records written one per
+// line in the ndjson format
+type scanReport interface {
+	writeText(w io.Writer)
+	records() []interface{}
+}
+
+// writeScanReport writes a report as text, as one JSON document, or as
+// JSON lines
+func writeScanReport(out *ndjsonLogger, format string, r scanReport) error {
+	switch format {
+	case "ndjson":
+		for _, v := range r.records() {
+			if err := out.log(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "json":
+		return out.log(r)
+	case "text":
+		w := bufio.NewWriter(out.w)
+		r.writeText(w)
+		return w.Flush()
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
@@ -0,0 +1,566 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// notification is a finding delivered to the notification sinks
+type notification struct {
+	Time      time.Time   `json:"time"`
+	Source    string      `json:"source"`
+	Summary   string      `json:"summary"`
+	Reference string      `json:"urlhaus_reference,omitempty"`
+	Event     interface{} `json:"event"`
+
+	// Key identifies the finding to avoid sending it twice
+	Key string `json:"-"`
+}
+
+// notifierConfig is the JSON file configuring the notification sinks
+type notifierConfig struct {
+	DedupFile string       `json:"dedup_file"`
+	DedupTTL  string       `json:"dedup_ttl"`
+	Retries   int          `json:"retries"`
+	Sinks     []sinkConfig `json:"sinks"`
+}
+
+// sinkConfig configures one sink. Which fields apply depends on the type:
+// webhook (url, secret), slack and teams (url), smtp (address, username,
+// password, from, to, subject) or syslog (network, address, ca_file,
+// facility, severity, app_name).
+type sinkConfig struct {
+	Type     string   `json:"type"`
+	Template string   `json:"template"`
+	URL      string   `json:"url"`
+	Secret   string   `json:"secret"`
+	Address  string   `json:"address"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	Subject  string   `json:"subject"`
+	Network  string   `json:"network"`
+	CAFile   string   `json:"ca_file"`
+	Facility int      `json:"facility"`
+	Severity *int     `json:"severity"`
+	AppName  string   `json:"app_name"`
+}
+
+// sink delivers notifications somewhere
+type sink interface {
+	send(n notification) error
+}
+
+// notifier sends notifications to every sink, retrying the failed
+// deliveries with an exponential backoff, and drops those already sent.
+type notifier struct {
+	sinks   []sink
+	names   []string
+	retries int
+
+	mu        sync.Mutex
+	queue     []delivery
+	inflight  int
+	wake      chan struct{}
+	idle      *sync.Cond
+	dedupFile string
+	dedupTTL  time.Duration
+	// sent holds when each sink delivered a notification, by sentKey, and
+	// pending the keys of those still queued
+	sent    map[string]time.Time
+	pending map[string]bool
+}
+
+type delivery struct {
+	sink     int
+	n        notification
+	attempts int
+	next     time.Time
+}
+
+// sentKey identifies the delivery of a notification by a sink, so that
+// the sinks failing to deliver it are tried again later
+func sentKey(sink int, n notification) string {
+	return strconv.Itoa(sink) + " " + n.Key
+}
+
+// newNotifier reads the notifier configuration file
+func newNotifier(name string) (*notifier, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var conf notifierConfig
+	if err := json.Unmarshal(b, &conf); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	nt := &notifier{
+		retries:   5,
+		wake:      make(chan struct{}, 1),
+		dedupFile: conf.DedupFile,
+		dedupTTL:  30 * 24 * time.Hour,
+		sent:      map[string]time.Time{},
+		pending:   map[string]bool{},
+	}
+	nt.idle = sync.NewCond(&nt.mu)
+	if conf.Retries > 0 {
+		nt.retries = conf.Retries
+	}
+	if conf.DedupTTL != "" {
+		if nt.dedupTTL, err = time.ParseDuration(conf.DedupTTL); err != nil {
+			return nil, fmt.Errorf("%s: dedup_ttl: %v", name, err)
+		}
+	}
+	if nt.dedupFile != "" {
+		b, err := ioutil.ReadFile(nt.dedupFile)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, err
+		default:
+			if err := json.Unmarshal(b, &nt.sent); err != nil {
+				return nil, fmt.Errorf("%s: %v", nt.dedupFile, err)
+			}
+		}
+	}
+
+	for i, sc := range conf.Sinks {
+		s, err := newSink(sc)
+		if err != nil {
+			return nil, fmt.Errorf("%s: sink %d: %v", name, i+1, err)
+		}
+		nt.sinks = append(nt.sinks, s)
+		nt.names = append(nt.names, sc.Type)
+	}
+	if len(nt.sinks) == 0 {
+		return nil, fmt.Errorf("%s: no sink", name)
+	}
+
+	go nt.run()
+	return nt, nil
+}
+
+func newSink(c sinkConfig) (sink, error) {
+	if c.Template == "" {
+		c.Template = "{{.Summary}}{{if .Reference}} {{.Reference}}{{end}}"
+	}
+	t, err := template.New("").Parse(c.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c.Type {
+	case "webhook", "slack", "teams":
+		if c.URL == "" {
+			return nil, errors.New("missing url")
+		}
+		return &webhookSink{kind: c.Type, url: c.URL, secret: []byte(c.Secret), templ: t}, nil
+	case "smtp":
+		if c.Address == "" || c.From == "" || len(c.To) == 0 {
+			return nil, errors.New("address, from and to are required")
+		}
+		if c.Subject == "" {
+			c.Subject = "URLhaus: {{.Summary}}"
+		}
+		subject, err := template.New("").Parse(c.Subject)
+		if err != nil {
+			return nil, err
+		}
+		return &smtpSink{conf: c, templ: t, subject: subject}, nil
+	case "syslog":
+		return newSyslogSink(c, t)
+	default:
+		return nil, fmt.Errorf("unknown type %q", c.Type)
+	}
+}
+
+// notify queues a notification for every sink that has not delivered or
+// queued it yet
+func (nt *notifier) notify(n notification) {
+	nt.mu.Lock()
+	defer nt.mu.Unlock()
+
+	now := time.Now()
+	for i := range nt.sinks {
+		if n.Key != "" {
+			k := sentKey(i, n)
+			if t, ok := nt.sent[k]; (ok && now.Sub(t) < nt.dedupTTL) || nt.pending[k] {
+				continue
+			}
+			nt.pending[k] = true
+		}
+		nt.queue = append(nt.queue, delivery{sink: i, n: n, next: now})
+	}
+	select {
+	case nt.wake <- struct{}{}:
+	default:
+	}
+}
+
+// saveSent writes the keys of the notifications delivered to the dedup
+// file. nt.mu must be held.
+func (nt *notifier) saveSent() {
+	if nt.dedupFile == "" {
+		return
+	}
+	now := time.Now()
+	for k, t := range nt.sent {
+		if now.Sub(t) >= nt.dedupTTL {
+			delete(nt.sent, k)
+		}
+	}
+	b, err := json.Marshal(nt.sent)
+	if err == nil {
+		tmp := filepath.Join(filepath.Dir(nt.dedupFile), "."+filepath.Base(nt.dedupFile)+".tmp")
+		if err = ioutil.WriteFile(tmp, b, 0644); err == nil {
+			err = os.Rename(tmp, nt.dedupFile)
+		}
+	}
+	if err != nil {
+		log.Printf("notify: %v", err)
+	}
+}
+
+// run delivers the queued notifications
+func (nt *notifier) run() {
+	for {
+		nt.mu.Lock()
+		var due []delivery
+		var pending []delivery
+		wait := time.Hour
+		now := time.Now()
+		for _, d := range nt.queue {
+			if !d.next.After(now) {
+				due = append(due, d)
+				continue
+			}
+			pending = append(pending, d)
+			if d.next.Sub(now) < wait {
+				wait = d.next.Sub(now)
+			}
+		}
+		nt.queue = pending
+		nt.inflight = len(due)
+		if len(due) == 0 && len(pending) == 0 {
+			nt.idle.Broadcast()
+		}
+		nt.mu.Unlock()
+
+		if len(due) == 0 {
+			select {
+			case <-nt.wake:
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		for _, d := range due {
+			err := nt.sinks[d.sink].send(d.n)
+			if err == nil {
+				nt.delivered(d, true)
+				continue
+			}
+			d.attempts++
+			if d.attempts > nt.retries {
+				log.Printf("notify: %s: giving up: %v", nt.names[d.sink], err)
+				nt.delivered(d, false)
+				continue
+			}
+			backoff := time.Duration(1<<uint(d.attempts-1)) * 5 * time.Second
+			log.Printf("notify: %s: %v, retrying in %s", nt.names[d.sink], err, backoff)
+			d.next = time.Now().Add(backoff)
+			nt.mu.Lock()
+			nt.queue = append(nt.queue, d)
+			nt.mu.Unlock()
+		}
+
+		nt.mu.Lock()
+		nt.inflight = 0
+		if len(nt.queue) == 0 {
+			nt.idle.Broadcast()
+		}
+		nt.mu.Unlock()
+	}
+}
+
+// delivered records that a delivery is no longer queued, and whether it
+// succeeded so that it is not sent again
+func (nt *notifier) delivered(d delivery, ok bool) {
+	if d.n.Key == "" {
+		return
+	}
+	nt.mu.Lock()
+	defer nt.mu.Unlock()
+	k := sentKey(d.sink, d.n)
+	delete(nt.pending, k)
+	if ok {
+		nt.sent[k] = time.Now()
+		nt.saveSent()
+	}
+}
+
+// flush waits until the queue is empty or timeout has passed
+func (nt *notifier) flush(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		nt.mu.Lock()
+		for len(nt.queue) > 0 || nt.inflight > 0 {
+			nt.idle.Wait()
+		}
+		nt.mu.Unlock()
+		close(done)
+	}()
+	select {
+	case nt.wake <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		nt.mu.Lock()
+		log.Printf("notify: %d notifications not delivered", len(nt.queue)+nt.inflight)
+		nt.mu.Unlock()
+	}
+}
+
+func render(t *template.Template, n notification) (string, error) {
+	var b bytes.Buffer
+	err := t.Execute(&b, n)
+	return b.String(), err
+}
+
+var notifyClient = &http.Client{Timeout: 30 * time.Second}
+
+// webhookSink posts the notification as JSON to a generic webhook, or as a
+// Slack or Teams message. Generic webhooks are signed with the secret in
+// the X-URLhaus-Signature header, as the hex HMAC-SHA256 of the
+// X-URLhaus-Timestamp header, a dot and the body.
+type webhookSink struct {
+	kind   string
+	url    string
+	secret []byte
+	templ  *template.Template
+}
+
+func (s *webhookSink) send(n notification) error {
+	text, err := render(s.templ, n)
+	if err != nil {
+		return err
+	}
+
+	var payload interface{}
+	switch s.kind {
+	case "slack":
+		payload = map[string]string{"text": text}
+	case "teams":
+		payload = map[string]string{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"summary":    n.Summary,
+			"themeColor": "D70000",
+			"title":      "URLhaus",
+			"text":       text,
+		}
+	default:
+		payload = struct {
+			notification
+			Message string `json:"message"`
+		}{n, text}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.kind == "webhook" && len(s.secret) > 0 {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write([]byte(ts + "."))
+		mac.Write(body)
+		req.Header.Set("X-URLhaus-Timestamp", ts)
+		req.Header.Set("X-URLhaus-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+// smtpSink mails the notifications
+type smtpSink struct {
+	conf    sinkConfig
+	templ   *template.Template
+	subject *template.Template
+}
+
+func (s *smtpSink) send(n notification) error {
+	body, err := render(s.templ, n)
+	if err != nil {
+		return err
+	}
+	subject, err := render(s.subject, n)
+	if err != nil {
+		return err
+	}
+	subject = strings.Join(strings.Fields(subject), " ")
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.conf.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.conf.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	msg.WriteString("\r\n")
+
+	var auth smtp.Auth
+	if s.conf.Username != "" {
+		host, _, _ := net.SplitHostPort(s.conf.Address)
+		auth = smtp.PlainAuth("", s.conf.Username, s.conf.Password, host)
+	}
+	return smtp.SendMail(s.conf.Address, auth, s.conf.From, s.conf.To, msg.Bytes())
+}
+
+// syslogSink sends RFC 5424 messages over UDP, or over TCP and TLS with
+// octet counting framing (RFC 6587 and RFC 5425).
+type syslogSink struct {
+	conf     sinkConfig
+	templ    *template.Template
+	tls      *tls.Config
+	hostname string
+	conn     net.Conn
+}
+
+func newSyslogSink(c sinkConfig, t *template.Template) (*syslogSink, error) {
+	if c.Address == "" {
+		return nil, errors.New("missing address")
+	}
+	switch c.Network {
+	case "":
+		c.Network = "udp"
+	case "udp", "tcp", "tls":
+	default:
+		return nil, fmt.Errorf("unknown network %q", c.Network)
+	}
+	if c.Facility == 0 {
+		c.Facility = 1
+	}
+	if c.AppName == "" {
+		c.AppName = "urlhaus-cli"
+	}
+
+	s := &syslogSink{conf: c, templ: t, hostname: "-"}
+	if h, err := os.Hostname(); err == nil {
+		s.hostname = h
+	}
+	if c.Network == "tls" {
+		s.tls = &tls.Config{}
+		if c.CAFile != "" {
+			pem, err := ioutil.ReadFile(c.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			s.tls.RootCAs = x509.NewCertPool()
+			if !s.tls.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("%s: no certificate", c.CAFile)
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s *syslogSink) send(n notification) error {
+	text, err := render(s.templ, n)
+	if err != nil {
+		return err
+	}
+	severity := 4
+	if s.conf.Severity != nil {
+		severity = *s.conf.Severity
+	}
+	msgid := n.Source
+	if msgid == "" {
+		msgid = "-"
+	}
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d %s - \xef\xbb\xbf%s",
+		s.conf.Facility*8+severity, n.Time.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		s.hostname, s.conf.AppName, os.Getpid(), msgid, strings.Replace(text, "\n", " ", -1))
+
+	if s.conn == nil {
+		if s.tls != nil {
+			s.conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", s.conf.Address, s.tls)
+		} else {
+			s.conn, err = net.DialTimeout(s.conf.Network, s.conf.Address, 10*time.Second)
+		}
+		if err != nil {
+			s.conn = nil
+			return err
+		}
+	}
+
+	if s.conf.Network != "udp" {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
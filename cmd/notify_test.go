@@ -0,0 +1,118 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSink fails the first fails deliveries and records the others
+type testSink struct {
+	mu    sync.Mutex
+	fails int
+	sent  []string
+}
+
+func (s *testSink) send(n notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fails > 0 {
+		s.fails--
+		return errors.New("unavailable")
+	}
+	s.sent = append(s.sent, n.Key)
+	return nil
+}
+
+func (s *testSink) delivered() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.sent...)
+}
+
+func testNotifier(dedupFile string, sinks ...sink) *notifier {
+	nt := &notifier{
+		sinks:     sinks,
+		retries:   0,
+		wake:      make(chan struct{}, 1),
+		dedupFile: dedupFile,
+		dedupTTL:  time.Hour,
+		sent:      map[string]time.Time{},
+		pending:   map[string]bool{},
+	}
+	for range sinks {
+		nt.names = append(nt.names, "test")
+	}
+	nt.idle = sync.NewCond(&nt.mu)
+	go nt.run()
+	return nt
+}
+
+func TestNotifierRecordsDeliveredOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dedup := filepath.Join(dir, "sent.json")
+
+	ok, failing := &testSink{}, &testSink{fails: 1}
+	nt := testNotifier(dedup, ok, failing)
+	nt.notify(notification{Key: "a"})
+	nt.notify(notification{Key: "a"})
+	nt.flush(5 * time.Second)
+
+	if got := ok.delivered(); len(got) != 1 {
+		t.Errorf("first sink delivered %v", got)
+	}
+	if got := failing.delivered(); len(got) != 0 {
+		t.Errorf("failing sink delivered %v", got)
+	}
+	b, err := ioutil.ReadFile(dedup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"0 a"`) || strings.Contains(string(b), `"1 a"`) {
+		t.Errorf("dedup file %s", b)
+	}
+
+	// the next run only sends to the sink that failed
+	nt = testNotifier(dedup, ok, failing)
+	if err := json.Unmarshal(b, &nt.sent); err != nil {
+		t.Fatal(err)
+	}
+	nt.notify(notification{Key: "a"})
+	nt.flush(5 * time.Second)
+	if got := ok.delivered(); len(got) != 1 {
+		t.Errorf("first sink delivered %v again", got)
+	}
+	if got := failing.delivered(); len(got) != 1 {
+		t.Errorf("failing sink delivered %v on the next run", got)
+	}
+}
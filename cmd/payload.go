@@ -70,46 +70,52 @@ var payloadCmd = &cobra.Command{
 URLhaus has retrieved.`,
 	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		var data io.Reader
-		if hashType == "sha256" {
-			data = strings.NewReader("sha256_hash=" + args[0])
-		} else {
-			data = strings.NewReader("md5_hash=" + args[0])
-		}
-
-		resp, err := http.Post(URL("payload"), "application/x-www-form-urlencoded", data)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer resp.Body.Close()
-
-		b, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		if len(b) == 0 {
-			return
-		}
-
-		if rawOutput {
-			fmt.Printf("%s", b)
-			return
-		}
-
-		t := template.Must(template.New("").Parse(payloadTempl))
-
-		m := map[string]interface{}{}
-		if err := json.Unmarshal([]byte(b), &m); err != nil {
-			log.Fatal(err)
-		}
-
-		if err := t.Execute(os.Stdout, m); err != nil {
-			log.Fatal(err)
-		}
+		printPayload(hashType, args[0])
 	},
 }
 
+// printPayload looks up a payload by its md5 or sha256 hash and prints the
+// result
+func printPayload(typ, hash string) {
+	var data io.Reader
+	if typ == "sha256" {
+		data = strings.NewReader("sha256_hash=" + hash)
+	} else {
+		data = strings.NewReader("md5_hash=" + hash)
+	}
+
+	resp, err := http.Post(URL("payload"), "application/x-www-form-urlencoded", data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(b) == 0 {
+		return
+	}
+
+	if rawOutput {
+		fmt.Printf("%s", b)
+		return
+	}
+
+	t := template.Must(template.New("").Parse(payloadTempl))
+
+	m := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(b), &m); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := t.Execute(os.Stdout, m); err != nil {
+		log.Fatal(err)
+	}
+}
+
 func init() {
 	rootCmd.AddCommand(payloadCmd)
 
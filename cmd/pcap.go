@@ -0,0 +1,552 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// link types of the captures that can be decoded
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLoop     = 108
+	linkSLL      = 113
+	linkIPv4     = 228
+	linkIPv6     = 229
+	linkSLL2     = 276
+)
+
+// capturedFrame is a frame read from a capture file
+type capturedFrame struct {
+	time     time.Time
+	linkType int
+	data     []byte
+}
+
+// pcapReader reads the frames of a pcap or pcapng file
+type pcapReader struct {
+	r     *bufio.Reader
+	ng    bool
+	order binary.ByteOrder
+
+	// pcap
+	linkType int
+	nano     bool
+
+	// pcapng interfaces
+	ifaces []pcapngInterface
+}
+
+type pcapngInterface struct {
+	linkType int
+	units    float64 // timestamp units per second
+}
+
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	pr := &pcapReader{r: bufio.NewReaderSize(r, 1<<16)}
+	magic, err := pr.r.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+
+	switch binary.LittleEndian.Uint32(magic) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		pr.order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		pr.order = binary.BigEndian
+	case 0x0a0d0d0a:
+		pr.ng = true
+		return pr, nil
+	default:
+		return nil, errors.New("not a pcap or pcapng file")
+	}
+
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(pr.r, header); err != nil {
+		return nil, err
+	}
+	pr.nano = pr.order.Uint32(header) == 0xa1b23c4d
+	pr.linkType = int(pr.order.Uint32(header[20:]) & 0xffff)
+	return pr, nil
+}
+
+// next returns the next frame, or io.EOF
+func (pr *pcapReader) next() (capturedFrame, error) {
+	if pr.ng {
+		return pr.nextBlock()
+	}
+
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(pr.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return capturedFrame{}, err
+	}
+	sec := int64(pr.order.Uint32(header))
+	frac := int64(pr.order.Uint32(header[4:]))
+	capLen := pr.order.Uint32(header[8:])
+	if capLen > 1<<24 {
+		return capturedFrame{}, fmt.Errorf("invalid record length %d", capLen)
+	}
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(pr.r, data); err != nil {
+		return capturedFrame{}, io.EOF
+	}
+	if !pr.nano {
+		frac *= 1000
+	}
+	return capturedFrame{time: time.Unix(sec, frac), linkType: pr.linkType, data: data}, nil
+}
+
+// nextBlock reads pcapng blocks up to the next packet
+func (pr *pcapReader) nextBlock() (capturedFrame, error) {
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(pr.r, header); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return capturedFrame{}, err
+		}
+
+		if binary.LittleEndian.Uint32(header) == 0x0a0d0d0a {
+			// section header: the byte order comes after the length
+			bom, err := pr.r.Peek(4)
+			if err != nil {
+				return capturedFrame{}, io.EOF
+			}
+			if binary.LittleEndian.Uint32(bom) == 0x1a2b3c4d {
+				pr.order = binary.LittleEndian
+			} else {
+				pr.order = binary.BigEndian
+			}
+			pr.ifaces = nil
+		}
+
+		typ := pr.order.Uint32(header)
+		length := pr.order.Uint32(header[4:])
+		if length < 12 || length > 1<<24 {
+			return capturedFrame{}, fmt.Errorf("invalid block length %d", length)
+		}
+		body := make([]byte, length-8)
+		if _, err := io.ReadFull(pr.r, body); err != nil {
+			return capturedFrame{}, io.EOF
+		}
+		body = body[:len(body)-4]
+
+		switch typ {
+		case 1: // interface description
+			if len(body) < 8 {
+				continue
+			}
+			iface := pcapngInterface{linkType: int(pr.order.Uint16(body)), units: 1e6}
+			for opts := body[8:]; len(opts) >= 4; {
+				code, n := pr.order.Uint16(opts), int(pr.order.Uint16(opts[2:]))
+				if code == 0 || 4+n > len(opts) {
+					break
+				}
+				if code == 9 && n >= 1 {
+					v := opts[4]
+					if v&0x80 == 0 {
+						iface.units = math.Pow(10, float64(v))
+					} else {
+						iface.units = math.Pow(2, float64(v&0x7f))
+					}
+				}
+				// the padding of the last option may be missing
+				padded := 4 + (n+3)/4*4
+				if padded > len(opts) {
+					break
+				}
+				opts = opts[padded:]
+			}
+			pr.ifaces = append(pr.ifaces, iface)
+
+		case 6: // enhanced packet
+			if len(body) < 20 {
+				continue
+			}
+			id := int(pr.order.Uint32(body))
+			if id >= len(pr.ifaces) {
+				continue
+			}
+			iface := pr.ifaces[id]
+			ts := uint64(pr.order.Uint32(body[4:]))<<32 | uint64(pr.order.Uint32(body[8:]))
+			capLen := int(pr.order.Uint32(body[12:]))
+			if 20+capLen > len(body) {
+				continue
+			}
+			sec := float64(ts) / iface.units
+			t := time.Unix(int64(sec), int64((sec-math.Floor(sec))*1e9))
+			return capturedFrame{time: t, linkType: iface.linkType, data: body[20 : 20+capLen]}, nil
+
+		case 3: // simple packet, without timestamp
+			if len(body) < 4 || len(pr.ifaces) == 0 {
+				continue
+			}
+			return capturedFrame{linkType: pr.ifaces[0].linkType, data: body[4:]}, nil
+		}
+	}
+}
+
+// ipPacket is a decoded TCP or UDP packet
+type ipPacket struct {
+	time             time.Time
+	src, dst         netip.Addr
+	proto            int
+	srcPort, dstPort uint16
+	seq              uint32
+	flags            byte
+	payload          []byte
+}
+
+const (
+	protoTCP = 6
+	protoUDP = 17
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+)
+
+// decodeFrame decodes the IP packet of a frame, if it is TCP or UDP
+func decodeFrame(f capturedFrame) (ipPacket, bool) {
+	b := f.data
+	var ethertype uint16
+
+	switch f.linkType {
+	case linkEthernet:
+		if len(b) < 14 {
+			return ipPacket{}, false
+		}
+		ethertype, b = binary.BigEndian.Uint16(b[12:]), b[14:]
+		for (ethertype == 0x8100 || ethertype == 0x88a8) && len(b) >= 4 {
+			ethertype, b = binary.BigEndian.Uint16(b[2:]), b[4:]
+		}
+	case linkSLL:
+		if len(b) < 16 {
+			return ipPacket{}, false
+		}
+		ethertype, b = binary.BigEndian.Uint16(b[14:]), b[16:]
+	case linkSLL2:
+		if len(b) < 20 {
+			return ipPacket{}, false
+		}
+		ethertype, b = binary.BigEndian.Uint16(b), b[20:]
+	case linkNull, linkLoop:
+		if len(b) < 4 {
+			return ipPacket{}, false
+		}
+		b = b[4:]
+	case linkRaw, linkIPv4, linkIPv6:
+	default:
+		return ipPacket{}, false
+	}
+	if len(b) == 0 {
+		return ipPacket{}, false
+	}
+	switch {
+	case ethertype == 0x0800 || ethertype == 0 && b[0]>>4 == 4:
+		return decodeIPv4(f.time, b)
+	case ethertype == 0x86dd || ethertype == 0 && b[0]>>4 == 6:
+		return decodeIPv6(f.time, b)
+	}
+	return ipPacket{}, false
+}
+
+func decodeIPv4(t time.Time, b []byte) (ipPacket, bool) {
+	if len(b) < 20 {
+		return ipPacket{}, false
+	}
+	ihl := int(b[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(b[2:]))
+	if ihl < 20 || total < ihl || len(b) < ihl {
+		return ipPacket{}, false
+	}
+	if total < len(b) {
+		b = b[:total]
+	}
+	if frag := binary.BigEndian.Uint16(b[6:]); frag&0x3fff != 0 {
+		// fragments are not reassembled
+		return ipPacket{}, false
+	}
+	p := ipPacket{time: t, proto: int(b[9])}
+	p.src, _ = netip.AddrFromSlice(b[12:16])
+	p.dst, _ = netip.AddrFromSlice(b[16:20])
+	return decodeTransport(p, b[ihl:])
+}
+
+func decodeIPv6(t time.Time, b []byte) (ipPacket, bool) {
+	if len(b) < 40 {
+		return ipPacket{}, false
+	}
+	if n := 40 + int(binary.BigEndian.Uint16(b[4:])); n < len(b) {
+		b = b[:n]
+	}
+	p := ipPacket{time: t}
+	p.src, _ = netip.AddrFromSlice(b[8:24])
+	p.dst, _ = netip.AddrFromSlice(b[24:40])
+	next, b := int(b[6]), b[40:]
+	for {
+		switch next {
+		case 0, 43, 60: // hop-by-hop, routing and destination options
+			if len(b) < 8 {
+				return ipPacket{}, false
+			}
+			n := 8 * (int(b[1]) + 1)
+			if len(b) < n {
+				return ipPacket{}, false
+			}
+			next, b = int(b[0]), b[n:]
+			continue
+		case 44: // fragment
+			return ipPacket{}, false
+		}
+		p.proto = next
+		return decodeTransport(p, b)
+	}
+}
+
+func decodeTransport(p ipPacket, b []byte) (ipPacket, bool) {
+	switch p.proto {
+	case protoTCP:
+		if len(b) < 20 {
+			return ipPacket{}, false
+		}
+		off := int(b[12]>>4) * 4
+		if off < 20 || len(b) < off {
+			return ipPacket{}, false
+		}
+		p.srcPort = binary.BigEndian.Uint16(b)
+		p.dstPort = binary.BigEndian.Uint16(b[2:])
+		p.seq = binary.BigEndian.Uint32(b[4:])
+		p.flags = b[13]
+		p.payload = b[off:]
+		return p, true
+	case protoUDP:
+		if len(b) < 8 {
+			return ipPacket{}, false
+		}
+		p.srcPort = binary.BigEndian.Uint16(b)
+		p.dstPort = binary.BigEndian.Uint16(b[2:])
+		if n := int(binary.BigEndian.Uint16(b[4:])); n >= 8 && n < len(b) {
+			b = b[:n]
+		}
+		p.payload = b[8:]
+		return p, true
+	}
+	return ipPacket{}, false
+}
+
+// flowKey identifies one direction of a TCP connection
+type flowKey struct {
+	src, dst netip.AddrPort
+}
+
+// tcpConn is a TCP connection being reassembled. The client is the side
+// sending the SYN, or the first packet seen when the handshake is missing.
+type tcpConn struct {
+	client, server netip.AddrPort
+	time           time.Time
+
+	// streams are the data sent by the client and by the server
+	streams [2]halfStream
+}
+
+// halfStream is the data sent by one side of a TCP connection, in order
+type halfStream struct {
+	base    uint32
+	started bool
+	closed  bool
+	decided bool
+	limit   int
+	data    []byte
+	times   []segmentTime
+	pending map[int]pendingSegment
+}
+
+type segmentTime struct {
+	offset int
+	time   time.Time
+}
+
+type pendingSegment struct {
+	data []byte
+	time time.Time
+}
+
+// tcpAssembler reassembles the TCP connections of a capture. limit is
+// called with the first bytes of each stream to tell how many of them to
+// keep, and done with each connection once closed or at the end.
+type tcpAssembler struct {
+	conns map[flowKey]*tcpConn
+	limit func(c *tcpConn, dir int, head []byte) int
+	done  func(c *tcpConn)
+}
+
+func newTCPAssembler(limit func(*tcpConn, int, []byte) int, done func(*tcpConn)) *tcpAssembler {
+	return &tcpAssembler{conns: map[flowKey]*tcpConn{}, limit: limit, done: done}
+}
+
+// add adds a TCP packet to its connection
+func (a *tcpAssembler) add(p ipPacket) {
+	src, dst := netip.AddrPortFrom(p.src, p.srcPort), netip.AddrPortFrom(p.dst, p.dstPort)
+	c, ok := a.conns[flowKey{src, dst}]
+	if !ok {
+		if p.flags&tcpRST != 0 {
+			return
+		}
+		c = &tcpConn{client: src, server: dst, time: p.time}
+		if p.flags&(tcpSYN|0x10) == tcpSYN|0x10 {
+			// SYN-ACK: the sender is the server
+			c.client, c.server = dst, src
+		}
+		a.conns[flowKey{c.client, c.server}] = c
+		a.conns[flowKey{c.server, c.client}] = c
+	}
+	dir := 0
+	if src != c.client {
+		dir = 1
+	}
+
+	s := &c.streams[dir]
+	if p.flags&tcpRST != 0 {
+		c.streams[0].closed, c.streams[1].closed = true, true
+	} else {
+		s.add(p)
+		if s.started && !s.decided && (len(s.data) >= 8 || s.closed) {
+			s.decided = true
+			s.limit = a.limit(c, dir, s.data)
+			if len(s.data) > s.limit {
+				s.data = s.data[:s.limit]
+			}
+		}
+	}
+	if c.streams[0].closed && c.streams[1].closed {
+		a.close(c)
+	}
+}
+
+func (a *tcpAssembler) close(c *tcpConn) {
+	delete(a.conns, flowKey{c.client, c.server})
+	delete(a.conns, flowKey{c.server, c.client})
+	a.done(c)
+}
+
+// flush hands the connections still open over to done
+func (a *tcpAssembler) flush() {
+	var open []*tcpConn
+	for k, c := range a.conns {
+		if k.src == c.client {
+			open = append(open, c)
+		}
+	}
+	sort.Slice(open, func(i, j int) bool { return open[i].time.Before(open[j].time) })
+	for _, c := range open {
+		a.close(c)
+	}
+}
+
+func (s *halfStream) add(p ipPacket) {
+	if p.flags&tcpSYN != 0 {
+		s.base, s.started = p.seq+1, true
+		return
+	}
+	if len(p.payload) > 0 {
+		if !s.started {
+			s.base, s.started = p.seq, true
+		}
+		off, data := int(int32(p.seq-s.base)), p.payload
+		if off < 0 {
+			if -off >= len(data) {
+				return
+			}
+			data, off = data[-off:], 0
+		}
+		s.insert(off, data, p.time)
+	}
+	if p.flags&tcpFIN != 0 {
+		s.closed = true
+	}
+}
+
+func (s *halfStream) insert(off int, data []byte, t time.Time) {
+	if s.full() {
+		return
+	}
+	if off > len(s.data) {
+		if s.pending == nil {
+			s.pending = map[int]pendingSegment{}
+		}
+		if len(s.pending) < 4096 {
+			s.pending[off] = pendingSegment{data, t}
+		}
+		return
+	}
+	s.append(off, data, t)
+
+	for progress := true; progress && len(s.pending) > 0; {
+		progress = false
+		for o, seg := range s.pending {
+			if o <= len(s.data) {
+				delete(s.pending, o)
+				s.append(o, seg.data, seg.time)
+				progress = true
+			}
+		}
+	}
+}
+
+func (s *halfStream) append(off int, data []byte, t time.Time) {
+	if off+len(data) <= len(s.data) || s.full() {
+		return
+	}
+	data = data[len(s.data)-off:]
+	if s.decided && len(s.data)+len(data) > s.limit {
+		data = data[:s.limit-len(s.data)]
+	}
+	s.times = append(s.times, segmentTime{len(s.data), t})
+	s.data = append(s.data, data...)
+}
+
+func (s *halfStream) full() bool {
+	return s.decided && len(s.data) >= s.limit
+}
+
+// timeAt returns the time of the packet carrying a byte of the stream
+func (s *halfStream) timeAt(off int) time.Time {
+	i := sort.Search(len(s.times), func(i int) bool { return s.times[i].offset > off })
+	if i == 0 {
+		return time.Time{}
+	}
+	return s.times[i-1].time
+}
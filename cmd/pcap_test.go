@@ -0,0 +1,342 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// testIPv4 returns an IPv4 packet
+func testIPv4(src, dst string, proto byte, payload []byte) []byte {
+	b := make([]byte, 20, 20+len(payload))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:], uint16(20+len(payload)))
+	b[8], b[9] = 64, proto
+	s, d := netip.MustParseAddr(src).As4(), netip.MustParseAddr(dst).As4()
+	copy(b[12:], s[:])
+	copy(b[16:], d[:])
+	return append(b, payload...)
+}
+
+// testTCP returns a TCP segment
+func testTCP(sport, dport uint16, seq uint32, flags byte, data string) []byte {
+	b := make([]byte, 20, 20+len(data))
+	binary.BigEndian.PutUint16(b, sport)
+	binary.BigEndian.PutUint16(b[2:], dport)
+	binary.BigEndian.PutUint32(b[4:], seq)
+	b[12], b[13] = 5<<4, flags
+	return append(b, data...)
+}
+
+// testEthernet wraps an IPv4 packet in an Ethernet frame, with a VLAN tag
+// if vlan is set
+func testEthernet(ip []byte, vlan bool) []byte {
+	b := make([]byte, 12)
+	if vlan {
+		b = append(b, 0x81, 0x00, 0x00, 0x07)
+	}
+	return append(append(b, 0x08, 0x00), ip...)
+}
+
+var pcapTestTimes = []time.Time{
+	time.Unix(1700000000, 250000000),
+	time.Unix(1700000001, 500000000),
+}
+
+// testPcap returns a pcap file of frames
+func testPcap(order binary.ByteOrder, nano bool, linkType uint32, frames ...[]byte) []byte {
+	var b bytes.Buffer
+	magic := uint32(0xa1b2c3d4)
+	if nano {
+		magic = 0xa1b23c4d
+	}
+	binary.Write(&b, order, []uint32{magic, 2 | 4<<16, 0, 0, 65535, linkType})
+	for i, f := range frames {
+		t := pcapTestTimes[i%len(pcapTestTimes)]
+		frac := uint32(t.Nanosecond() / 1000)
+		if nano {
+			frac = uint32(t.Nanosecond())
+		}
+		binary.Write(&b, order, []uint32{uint32(t.Unix()), frac, uint32(len(f)), uint32(len(f))})
+		b.Write(f)
+	}
+	return b.Bytes()
+}
+
+// pcapngBlock returns a pcapng block, padded
+func pcapngBlock(order binary.AppendByteOrder, typ uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	b := order.AppendUint32(nil, typ)
+	b = order.AppendUint32(b, uint32(12+len(body)))
+	b = append(b, body...)
+	return order.AppendUint32(b, uint32(12+len(body)))
+}
+
+// testPcapng returns a pcapng file of frames, with timestamps in units of
+// 10^-tsresol seconds
+func testPcapng(order binary.AppendByteOrder, linkType uint16, tsresol byte, frames ...[]byte) []byte {
+	shb := order.AppendUint32(nil, 0x1a2b3c4d)
+	shb = order.AppendUint16(shb, 1)
+	shb = order.AppendUint16(shb, 0)
+	shb = order.AppendUint64(shb, ^uint64(0))
+	b := pcapngBlock(order, 0x0a0d0d0a, shb)
+
+	idb := order.AppendUint16(nil, linkType)
+	idb = order.AppendUint16(idb, 0)
+	idb = order.AppendUint32(idb, 0)
+	idb = order.AppendUint16(idb, 9)
+	idb = order.AppendUint16(idb, 1)
+	idb = append(idb, tsresol, 0, 0, 0)
+	idb = append(idb, 0, 0, 0, 0)
+	b = append(b, pcapngBlock(order, 1, idb)...)
+
+	// a block of an unknown type, skipped
+	b = append(b, pcapngBlock(order, 5, []byte{1, 2, 3})...)
+
+	for i, f := range frames {
+		t := pcapTestTimes[i%len(pcapTestTimes)]
+		ts := uint64(t.UnixNano())
+		for r := tsresol; r < 9; r++ {
+			ts /= 10
+		}
+		epb := order.AppendUint32(nil, 0)
+		epb = order.AppendUint32(epb, uint32(ts>>32))
+		epb = order.AppendUint32(epb, uint32(ts))
+		epb = order.AppendUint32(epb, uint32(len(f)))
+		epb = order.AppendUint32(epb, uint32(len(f)))
+		b = append(b, pcapngBlock(order, 6, append(epb, f...))...)
+	}
+	return b
+}
+
+func TestPcapReader(t *testing.T) {
+	frames := [][]byte{
+		testEthernet(testIPv4("10.0.0.1", "10.0.0.2", protoTCP, testTCP(1000, 80, 1, tcpSYN, "")), false),
+		testEthernet(testIPv4("10.0.0.2", "10.0.0.1", protoTCP, testTCP(80, 1000, 1, tcpSYN|0x10, "")), true),
+	}
+	tests := []struct {
+		name  string
+		file  []byte
+		times []time.Time
+	}{
+		{"pcap little endian", testPcap(binary.LittleEndian, false, linkEthernet, frames...), pcapTestTimes},
+		{"pcap big endian", testPcap(binary.BigEndian, false, linkEthernet, frames...), pcapTestTimes},
+		{"pcap nanoseconds", testPcap(binary.LittleEndian, true, linkEthernet, frames...), pcapTestTimes},
+		{"pcapng microseconds", testPcapng(binary.LittleEndian, linkEthernet, 6, frames...), pcapTestTimes},
+		{"pcapng big endian milliseconds", testPcapng(binary.BigEndian, linkEthernet, 3, frames...), pcapTestTimes},
+		{"truncated pcap", testPcap(binary.LittleEndian, false, linkEthernet, frames...)[:24+16+len(frames[0])+10], pcapTestTimes[:1]},
+	}
+	for _, tt := range tests {
+		pr, err := newPcapReader(bytes.NewReader(tt.file))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got []capturedFrame
+		for {
+			f, err := pr.next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+				break
+			}
+			got = append(got, f)
+		}
+		if len(got) != len(tt.times) {
+			t.Errorf("%s: %d frames", tt.name, len(got))
+			continue
+		}
+		for i, f := range got {
+			if f.linkType != linkEthernet || !bytes.Equal(f.data, frames[i]) {
+				t.Errorf("%s: frame %d is %d %x", tt.name, i, f.linkType, f.data)
+			}
+			if d := f.time.Sub(tt.times[i]); d < -time.Microsecond || d > time.Microsecond {
+				t.Errorf("%s: frame %d at %v", tt.name, i, f.time)
+			}
+		}
+	}
+
+	// an interface description whose last option misses its padding
+	order := binary.LittleEndian
+	b := testPcapng(order, linkEthernet, 6)
+	idb := order.AppendUint32(nil, 1)
+	idb = order.AppendUint32(idb, 25)
+	idb = order.AppendUint16(idb, linkEthernet)
+	idb = append(idb, 0, 0, 0, 0, 0, 0)
+	idb = order.AppendUint16(idb, 9)
+	idb = order.AppendUint16(idb, 1)
+	idb = append(idb, 3)
+	b = append(b, order.AppendUint32(idb, 25)...)
+	epb := order.AppendUint32(nil, 1)
+	ts := uint64(pcapTestTimes[0].UnixNano() / int64(time.Millisecond))
+	epb = order.AppendUint32(epb, uint32(ts>>32))
+	epb = order.AppendUint32(epb, uint32(ts))
+	epb = order.AppendUint32(epb, uint32(len(frames[0])))
+	epb = order.AppendUint32(epb, uint32(len(frames[0])))
+	b = append(b, pcapngBlock(order, 6, append(epb, frames[0]...))...)
+	pr, err := newPcapReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, err := pr.next(); err != nil || !bytes.Equal(f.data, frames[0]) || !f.time.Equal(pcapTestTimes[0]) {
+		t.Errorf("unpadded option: %v %v %x", err, f.time, f.data)
+	}
+
+	if _, err := newPcapReader(bytes.NewReader([]byte("GET / HTTP/1.1\r\n"))); err == nil {
+		t.Error("a text file was read as a capture")
+	}
+}
+
+func TestDecodeFrame(t *testing.T) {
+	tcp := testTCP(1000, 80, 42, 0x18, "data")
+	ipv4 := testIPv4("10.0.0.1", "10.0.0.2", protoTCP, tcp)
+	fragment := append([]byte(nil), ipv4...)
+	fragment[6] = 0x20 // more fragments
+
+	sll := append(make([]byte, 14), 0x08, 0x00)
+	ipv6 := make([]byte, 40)
+	ipv6[0] = 0x60
+	binary.BigEndian.PutUint16(ipv6[4:], uint16(8+len(tcp)))
+	ipv6[6] = 0 // hop-by-hop options
+	ipv6[23], ipv6[39] = 1, 2
+	ipv6 = append(ipv6, protoTCP, 0, 0, 0, 0, 0, 0, 0)
+	ipv6 = append(ipv6, tcp...)
+
+	udp := []byte{0xd0, 0x00, 0x00, 0x35, 0x00, 0x0c, 0x00, 0x00, 'q', 'u', 'e', 'r', 'y', 'p', 'a', 'd'}
+
+	tests := []struct {
+		name     string
+		frame    capturedFrame
+		src, dst string
+		proto    int
+		payload  string
+		ok       bool
+	}{
+		{"ethernet", capturedFrame{linkType: linkEthernet, data: testEthernet(ipv4, false)}, "10.0.0.1", "10.0.0.2", protoTCP, "data", true},
+		{"ethernet with a VLAN tag", capturedFrame{linkType: linkEthernet, data: testEthernet(ipv4, true)}, "10.0.0.1", "10.0.0.2", protoTCP, "data", true},
+		{"Linux cooked", capturedFrame{linkType: linkSLL, data: append(sll, ipv4...)}, "10.0.0.1", "10.0.0.2", protoTCP, "data", true},
+		{"loopback", capturedFrame{linkType: linkNull, data: append([]byte{2, 0, 0, 0}, ipv4...)}, "10.0.0.1", "10.0.0.2", protoTCP, "data", true},
+		{"raw IPv6 with options", capturedFrame{linkType: linkRaw, data: ipv6}, "::1", "::2", protoTCP, "data", true},
+		{"UDP with padding", capturedFrame{linkType: linkIPv4, data: testIPv4("10.0.0.1", "8.8.8.8", protoUDP, udp)}, "10.0.0.1", "8.8.8.8", protoUDP, "quer", true},
+		{"IP fragment", capturedFrame{linkType: linkRaw, data: fragment}, "", "", 0, "", false},
+		{"truncated", capturedFrame{linkType: linkRaw, data: ipv4[:30]}, "", "", 0, "", false},
+		{"unknown link", capturedFrame{linkType: 147, data: ipv4}, "", "", 0, "", false},
+		{"ICMP", capturedFrame{linkType: linkRaw, data: testIPv4("10.0.0.1", "10.0.0.2", 1, make([]byte, 8))}, "", "", 0, "", false},
+	}
+	for _, tt := range tests {
+		p, ok := decodeFrame(tt.frame)
+		if ok != tt.ok {
+			t.Errorf("%s: ok %v", tt.name, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if p.src.String() != tt.src || p.dst.String() != tt.dst || p.proto != tt.proto || string(p.payload) != tt.payload {
+			t.Errorf("%s: got %v %v %d %q", tt.name, p.src, p.dst, p.proto, p.payload)
+		}
+	}
+}
+
+func TestTCPAssembler(t *testing.T) {
+	client, server := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	// segment is a packet from the client (dir 0) or the server (dir 1)
+	type segment struct {
+		dir   int
+		seq   uint32
+		flags byte
+		data  string
+	}
+	tests := []struct {
+		name           string
+		limit          int
+		segments       []segment
+		client, server string
+		closed         bool
+	}{
+		{
+			"in order",
+			100,
+			[]segment{{0, 99, tcpSYN, ""}, {1, 499, tcpSYN | 0x10, ""}, {0, 100, 0x18, "GET / HTTP/1.1\r\n"}, {1, 500, 0x18, "HTTP/1.1 200 OK\r\n"}, {0, 116, tcpFIN, ""}, {1, 517, tcpFIN, ""}},
+			"GET / HTTP/1.1\r\n", "HTTP/1.1 200 OK\r\n", true,
+		},
+		{
+			"out of order and retransmitted",
+			100,
+			[]segment{{0, 99, tcpSYN, ""}, {0, 108, 0x18, "TP/1.1\r\n"}, {0, 100, 0x18, "GET / HT"}, {0, 104, 0x18, "/ HTTP/1"}, {0, 116, 0x18, "Host: x\r\n"}},
+			"GET / HTTP/1.1\r\nHost: x\r\n", "", false,
+		},
+		{
+			"without the handshake, the server first",
+			100,
+			[]segment{{1, 500, 0x18, "HTTP/1.1 200 OK\r\n"}, {0, 100, 0x18, "GET / HTTP/1.1\r\n"}},
+			"GET / HTTP/1.1\r\n", "HTTP/1.1 200 OK\r\n", false,
+		},
+		{
+			"over the limit",
+			10,
+			[]segment{{0, 99, tcpSYN, ""}, {0, 100, 0x18, "GET / HTTP/1.1\r\n"}, {0, 116, 0x18, "more"}},
+			"GET / HTTP", "", false,
+		},
+		{
+			"reset",
+			100,
+			[]segment{{0, 99, tcpSYN, ""}, {0, 100, 0x18, "GET / HTTP/1.1\r\n"}, {1, 0, tcpRST, ""}},
+			"GET / HTTP/1.1\r\n", "", true,
+		},
+	}
+	for _, tt := range tests {
+		var conns []*tcpConn
+		closed := false
+		a := newTCPAssembler(func(*tcpConn, int, []byte) int { return tt.limit }, func(c *tcpConn) { conns = append(conns, c) })
+		for i, s := range tt.segments {
+			p := ipPacket{time: time.Unix(int64(i), 0), proto: protoTCP, src: client, dst: server, srcPort: 1000, dstPort: 80, seq: s.seq, flags: s.flags, payload: []byte(s.data)}
+			if s.dir == 1 {
+				p.src, p.dst, p.srcPort, p.dstPort = p.dst, p.src, p.dstPort, p.srcPort
+			}
+			a.add(p)
+			closed = len(conns) > 0
+		}
+		a.flush()
+
+		if len(conns) == 0 {
+			t.Errorf("%s: no connection", tt.name)
+			continue
+		}
+		c := conns[0]
+		streams := [2]string{string(c.streams[0].data), string(c.streams[1].data)}
+		if c.client.Addr() != client {
+			// the side sending first is taken as the client
+			streams[0], streams[1] = streams[1], streams[0]
+		}
+		if len(conns) != 1 || closed != tt.closed || streams[0] != tt.client || streams[1] != tt.server {
+			t.Errorf("%s: %d connections, closed %v, streams %q", tt.name, len(conns), closed, streams)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	proxyListen     string
+	proxyAllow      []string
+	proxyAllowlist  string
+	proxyLog        string
+	proxyFailClosed bool
+	proxyBlockHosts bool
+)
+
+const blockPageTempl = `<!DOCTYPE html>
+<html>
+<head><title>Blocked by URLhaus</title></head>
+<body>
+<h1>Access blocked</h1>
+<p>The {{.Type}} <code>{{.Indicator}}</code> is listed on URLhaus as serving malware.</p>
+<ul>
+{{if .Threat}}<li>Threat: {{.Threat}}</li>{{end}}
+{{if .Status}}<li>Status: {{.Status}}</li>{{end}}
+{{if .Signature}}<li>Signature: {{.Signature}}</li>{{end}}
+{{if .Tags}}<li>Tags: {{range $index, $element := .Tags}}{{if $index}}, {{end}}{{$element}}{{end}}</li>{{end}}
+{{if .Reference}}<li>Reference: <a href="{{.Reference}}">{{.Reference}}</a></li>{{end}}
+</ul>
+</body>
+</html>
+`
+
+var blockPage = template.Must(template.New("").Parse(blockPageTempl))
+
+// hopHeaders are the hop-by-hop headers a proxy must not forward
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// proxyDecision is the NDJSON log record of a request
+type proxyDecision struct {
+	Time    string   `json:"time"`
+	Client  string   `json:"client"`
+	Method  string   `json:"method"`
+	URL     string   `json:"url,omitempty"`
+	Host    string   `json:"host"`
+	SNI     string   `json:"sni,omitempty"`
+	Action  string   `json:"action"`
+	Reason  string   `json:"reason"`
+	Verdict *verdict `json:"verdict,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// proxyCmd represents the proxy command
+var proxyCmd = &cobra.Command{
+	Use:   "proxy",
+	Short: "Run an HTTP proxy refusing URLs listed on URLhaus",
+	Long: `This command runs an HTTP forward proxy that checks every request against
+URLhaus. Plain HTTP requests are checked by URL (and host with
+--block-hosts) and answered with a block page explaining the match. CONNECT
+requests are checked by host and by the server name (SNI) of the TLS
+ClientHello sent through the tunnel, before connecting upstream, and closed
+when listed. Tunnels whose server name cannot be read are let through with
+a warning.
+
+Hosts on the allowlist, and their subdomains, are never checked. Every
+decision is logged as a JSON object per line. When URLhaus cannot be
+reached, requests are let through unless --fail-closed is set.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newChecker()
+		if err != nil {
+			log.Fatal(err)
+		}
+		logger, err := newNDJSONLogger(proxyLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		allow := proxyAllow
+		if proxyAllowlist != "" {
+			hosts, err := readLines(proxyAllowlist)
+			if err != nil {
+				log.Fatal(err)
+			}
+			allow = append(allow, hosts...)
+		}
+
+		p := &proxyServer{
+			checker: c,
+			allow:   allow,
+			log:     logger,
+			transport: &http.Transport{
+				Proxy:                 nil,
+				MaxIdleConns:          100,
+				IdleConnTimeout:       90 * time.Second,
+				ResponseHeaderTimeout: time.Minute,
+			},
+		}
+		log.Printf("listening on %s", proxyListen)
+		log.Fatal(http.ListenAndServe(proxyListen, p))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(proxyCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// proxyCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// proxyCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	proxyCmd.Flags().StringVarP(&proxyListen, "listen", "l", "127.0.0.1:3128", "The address to listen on")
+	proxyCmd.Flags().StringSliceVar(&proxyAllow, "allow", nil, "Hosts never blocked")
+	proxyCmd.Flags().StringVar(&proxyAllowlist, "allowlist", "", "A file of hosts never blocked, one per line")
+	proxyCmd.Flags().StringVar(&proxyLog, "log", "-", "The file decisions are logged to (- for stdout)")
+	proxyCmd.Flags().BoolVar(&proxyFailClosed, "fail-closed", false, "Block requests when URLhaus cannot be reached")
+	proxyCmd.Flags().BoolVar(&proxyBlockHosts, "block-hosts", false, "Also block URLs whose host is listed")
+	addCheckerFlags(proxyCmd)
+}
+
+type proxyServer struct {
+	checker   *checker
+	allow     []string
+	log       *ndjsonLogger
+	transport *http.Transport
+}
+
+// readLines reads the non-empty, non-comment lines of a file
+func readLines(name string) ([]string, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimSpace(l)
+		if l != "" && !strings.HasPrefix(l, "#") {
+			lines = append(lines, l)
+		}
+	}
+	return lines, nil
+}
+
+// allowed reports whether a host or one of its parent domains is allowed
+func (p *proxyServer) allowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, a := range p.allow {
+		a = strings.ToLower(strings.TrimPrefix(a, "."))
+		if host == a || strings.HasSuffix(host, "."+a) {
+			return true
+		}
+	}
+	return false
+}
+
+// decide checks an indicator and fills in the decision accordingly
+func (p *proxyServer) decide(d *proxyDecision, typ, indicator string) bool {
+	v, err := p.checker.check(typ, indicator)
+	if err != nil {
+		d.Error = err.Error()
+		d.Reason = "lookup failed"
+		if proxyFailClosed {
+			d.Action = "block"
+			return true
+		}
+		d.Action = "allow"
+		return false
+	}
+	if v.Listed {
+		d.Action, d.Reason, d.Verdict = "block", "listed", &v
+		return true
+	}
+	d.Action, d.Reason = "allow", "not listed"
+	return false
+}
+
+func (p *proxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d := &proxyDecision{
+		Time:   time.Now().UTC().Format(time.RFC3339),
+		Client: r.RemoteAddr,
+		Method: r.Method,
+	}
+
+	if r.Method == http.MethodConnect {
+		p.connect(w, r, d)
+		return
+	}
+
+	if !r.URL.IsAbs() {
+		http.Error(w, "This is a proxy server, requests must use absolute URLs", http.StatusBadRequest)
+		return
+	}
+	d.URL = r.URL.String()
+	d.Host = strings.ToLower(r.URL.Hostname())
+
+	blocked := false
+	if p.allowed(d.Host) {
+		d.Action, d.Reason = "allow", "allowlist"
+	} else {
+		blocked = p.decide(d, "url", d.URL)
+		if !blocked && d.Error == "" && proxyBlockHosts {
+			blocked = p.decide(d, "host", d.Host)
+		}
+	}
+	p.log.log(d)
+
+	if blocked {
+		p.writeBlockPage(w, d)
+		return
+	}
+
+	out := r.WithContext(r.Context())
+	out.RequestURI = ""
+	out.Header = cloneHeader(r.Header)
+	removeHopHeaders(out.Header)
+
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// connect checks the host of a CONNECT request and the server name of the
+// TLS ClientHello going through the tunnel.
+func (p *proxyServer) connect(w http.ResponseWriter, r *http.Request, d *proxyDecision) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	d.Host = strings.ToLower(host)
+
+	allowed := p.allowed(d.Host)
+	if allowed {
+		d.Action, d.Reason = "allow", "allowlist"
+	} else if p.decide(d, "host", d.Host) {
+		p.log.log(d)
+		p.writeBlockPage(w, d)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+	// check the server name of the ClientHello before going upstream
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	hello, record, err := readClientHello(rw.Reader)
+	conn.SetReadDeadline(time.Time{})
+	if len(hello) == 0 && err == io.EOF {
+		p.log.log(d)
+		return
+	}
+	sni := ""
+	if err == nil {
+		sni, err = parseSNI(record)
+	}
+	if err == nil {
+		d.SNI = strings.ToLower(sni)
+		if !allowed && d.SNI != d.Host && !p.allowed(d.SNI) && p.decide(d, "host", d.SNI) {
+			p.log.log(d)
+			return
+		}
+	} else if err != errNoSNI && !allowed {
+		d.Error = err.Error()
+		log.Printf("%s: letting the tunnel through without checking its server name: %v", d.Host, err)
+	}
+
+	upstream, err := net.DialTimeout("tcp", r.Host, 30*time.Second)
+	if err != nil {
+		d.Action, d.Reason, d.Error = "allow", "upstream unreachable", err.Error()
+		p.log.log(d)
+		return
+	}
+	defer upstream.Close()
+	p.log.log(d)
+	if _, err := upstream.Write(hello); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, rw.Reader)
+		if c, ok := upstream.(*net.TCPConn); ok {
+			c.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+func (p *proxyServer) writeBlockPage(w http.ResponseWriter, d *proxyDecision) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+
+	v := d.Verdict
+	if v == nil {
+		// blocked because URLhaus could not be reached
+		v = &verdict{Type: "host", Indicator: d.Host, Status: "unknown, URLhaus could not be reached"}
+	}
+	blockPage.Execute(w, v)
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, vv := range h {
+		c[k] = append([]string(nil), vv...)
+	}
+	return c
+}
+
+// removeHopHeaders removes the hop-by-hop headers, including those listed
+// in the Connection header
+func removeHopHeaders(h http.Header) {
+	for _, f := range h["Connection"] {
+		for _, k := range strings.Split(f, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				h.Del(k)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
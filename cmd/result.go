@@ -0,0 +1,418 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// result is a decoded URLhaus API response together with the name of the
+// endpoint (url, host, payload, tag or signature) that produced it and the
+// value looked up, if known.
+type result struct {
+	kind  string
+	query string
+	data  map[string]interface{}
+}
+
+// urlEntry is a malware URL flattened out of any kind of result
+type urlEntry struct {
+	URL        string            `json:"url"`
+	Status     string            `json:"url_status,omitempty"`
+	Host       string            `json:"host,omitempty"`
+	Threat     string            `json:"threat,omitempty"`
+	DateAdded  string            `json:"date_added,omitempty"`
+	Reporter   string            `json:"reporter,omitempty"`
+	Reference  string            `json:"urlhaus_reference,omitempty"`
+	Tags       []string          `json:"tags,omitempty"`
+	Blacklists map[string]string `json:"blacklists,omitempty"`
+	Signature  string            `json:"signature,omitempty"`
+	MD5        string            `json:"md5_hash,omitempty"`
+	SHA256     string            `json:"sha256_hash,omitempty"`
+}
+
+// payloadEntry is a malware payload flattened out of any kind of result.
+// VirusTotal is the detection percentage, -1 when unknown.
+type payloadEntry struct {
+	MD5        string  `json:"md5_hash,omitempty"`
+	SHA256     string  `json:"sha256_hash,omitempty"`
+	FileType   string  `json:"file_type,omitempty"`
+	Signature  string  `json:"signature,omitempty"`
+	FirstSeen  string  `json:"firstseen,omitempty"`
+	Reference  string  `json:"urlhaus_reference,omitempty"`
+	VirusTotal float64 `json:"virustotal_percent"`
+}
+
+// lookupResult queries the endpoint of the given kind for a single value
+func lookupResult(kind, value string) (result, error) {
+	form := url.Values{}
+	switch kind {
+	case "url", "host", "tag", "signature":
+		form.Set(kind, value)
+	case "md5":
+		kind = "payload"
+		form.Set("md5_hash", value)
+	case "sha256":
+		kind = "payload"
+		form.Set("sha256_hash", value)
+	default:
+		return result{}, fmt.Errorf("unknown lookup type %q", kind)
+	}
+
+	m, err := query(kind, form)
+	if err != nil {
+		return result{}, err
+	}
+	return result{kind: kind, query: value, data: m}, nil
+}
+
+// readResults decodes a stream of raw (--raw) URLhaus responses and guesses
+// the endpoint of each from its fields.
+func readResults(r io.Reader) ([]result, error) {
+	var results []result
+
+	dec := json.NewDecoder(r)
+	for {
+		m := map[string]interface{}{}
+		if err := dec.Decode(&m); err == io.EOF {
+			return results, nil
+		} else if err != nil {
+			return nil, err
+		}
+		results = append(results, result{kind: resultKind(m), data: m})
+	}
+}
+
+// resultKind guesses which endpoint a raw response came from
+func resultKind(m map[string]interface{}) string {
+	switch {
+	case m["payloads"] != nil || m["url"] != nil:
+		return "url"
+	case m["md5_hash"] != nil || m["sha256_hash"] != nil:
+		return "payload"
+	case m["payload_count"] != nil:
+		return "signature"
+	case m["host"] != nil:
+		return "host"
+	default:
+		return "tag"
+	}
+}
+
+// ok reports whether the query found something
+func (r result) ok() bool {
+	return str(r.data, "query_status") == "ok"
+}
+
+// urls returns the malware URLs contained in the result
+func (r result) urls() []urlEntry {
+	if !r.ok() {
+		return nil
+	}
+
+	if r.kind == "url" {
+		e := newURLEntry(r.data)
+		for _, p := range objects(r.data, "payloads") {
+			if e.Signature == "" {
+				e.Signature = str(p, "signature")
+			}
+		}
+		return []urlEntry{e}
+	}
+
+	var entries []urlEntry
+	for _, u := range objects(r.data, "urls") {
+		e := newURLEntry(u)
+		switch r.kind {
+		case "host":
+			e.Host = str(r.data, "host")
+			e.Blacklists = strMap(r.data, "blacklists")
+		case "payload":
+			e.Signature = str(r.data, "signature")
+			e.MD5 = str(r.data, "md5_hash")
+			e.SHA256 = str(r.data, "sha256_hash")
+		}
+		if e.Host == "" {
+			e.Host = hostOf(e.URL)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// payloads returns the malware payloads contained in the result
+func (r result) payloads() []payloadEntry {
+	if !r.ok() {
+		return nil
+	}
+
+	switch r.kind {
+	case "url":
+		var entries []payloadEntry
+		for _, p := range objects(r.data, "payloads") {
+			entries = append(entries, payloadEntry{
+				MD5:        str(p, "response_md5"),
+				SHA256:     str(p, "response_sha256"),
+				FileType:   str(p, "file_type"),
+				Signature:  str(p, "signature"),
+				FirstSeen:  str(p, "firstseen"),
+				Reference:  str(r.data, "urlhaus_reference"),
+				VirusTotal: vtPercent(p),
+			})
+		}
+		return entries
+	case "payload":
+		return []payloadEntry{{
+			MD5:        str(r.data, "md5_hash"),
+			SHA256:     str(r.data, "sha256_hash"),
+			FileType:   str(r.data, "file_type"),
+			Signature:  str(r.data, "signature"),
+			FirstSeen:  str(r.data, "firstseen"),
+			VirusTotal: vtPercent(r.data),
+		}}
+	case "signature":
+		var entries []payloadEntry
+		for _, u := range objects(r.data, "urls") {
+			entries = append(entries, payloadEntry{
+				MD5:        str(u, "md5_hash"),
+				SHA256:     str(u, "sha256_hash"),
+				FileType:   str(u, "file_type"),
+				FirstSeen:  str(u, "firstseen"),
+				Reference:  str(u, "urlhaus_reference"),
+				VirusTotal: vtPercent(u),
+			})
+		}
+		return entries
+	}
+	return nil
+}
+
+func newURLEntry(m map[string]interface{}) urlEntry {
+	e := urlEntry{
+		URL:        str(m, "url"),
+		Status:     str(m, "url_status"),
+		Host:       str(m, "host"),
+		Threat:     str(m, "threat"),
+		DateAdded:  str(m, "date_added"),
+		Reporter:   str(m, "reporter"),
+		Reference:  str(m, "urlhaus_reference"),
+		Tags:       strs(m, "tags"),
+		Blacklists: strMap(m, "blacklists"),
+		MD5:        str(m, "md5_hash"),
+		SHA256:     str(m, "sha256_hash"),
+	}
+	if e.DateAdded == "" {
+		e.DateAdded = str(m, "dateadded")
+	}
+	if e.DateAdded == "" {
+		e.DateAdded = str(m, "firstseen")
+	}
+	return e
+}
+
+// collectURLs merges the URLs of all results, dropping duplicates
+func collectURLs(results []result) []urlEntry {
+	var entries []urlEntry
+	seen := map[string]int{}
+	for _, r := range results {
+		for _, e := range r.urls() {
+			if i, ok := seen[e.URL]; ok {
+				entries[i] = mergeURLEntry(entries[i], e)
+				continue
+			}
+			seen[e.URL] = len(entries)
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// collectPayloads merges the payloads of all results, dropping duplicates
+func collectPayloads(results []result) []payloadEntry {
+	var entries []payloadEntry
+	seen := map[string]bool{}
+	for _, r := range results {
+		for _, p := range r.payloads() {
+			key := p.SHA256
+			if key == "" {
+				key = p.MD5
+			}
+			if key == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			entries = append(entries, p)
+		}
+	}
+	return entries
+}
+
+// collectHosts returns the distinct lowercased hosts of the given URLs
+func collectHosts(entries []urlEntry) []string {
+	var hosts []string
+	seen := map[string]bool{}
+	for _, e := range entries {
+		h := strings.ToLower(e.Host)
+		if h == "" || seen[h] {
+			continue
+		}
+		seen[h] = true
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// mergeURLEntry fills the empty fields of a with those of b
+func mergeURLEntry(a, b urlEntry) urlEntry {
+	fill := func(dst *string, src string) {
+		if *dst == "" {
+			*dst = src
+		}
+	}
+	fill(&a.Status, b.Status)
+	fill(&a.Host, b.Host)
+	fill(&a.Threat, b.Threat)
+	fill(&a.DateAdded, b.DateAdded)
+	fill(&a.Reporter, b.Reporter)
+	fill(&a.Reference, b.Reference)
+	fill(&a.Signature, b.Signature)
+	fill(&a.MD5, b.MD5)
+	fill(&a.SHA256, b.SHA256)
+	if len(a.Tags) == 0 {
+		a.Tags = b.Tags
+	}
+	if len(a.Blacklists) == 0 {
+		a.Blacklists = b.Blacklists
+	}
+	return a
+}
+
+// hostOf returns the lowercased host (without port) of a URL
+func hostOf(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// listedOn returns the blacklists an URL or host is listed on
+func (e urlEntry) listedOn() []string {
+	var names []string
+	for name, status := range e.Blacklists {
+		if status != "" && status != "not listed" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseTime parses the timestamps found in API responses and dumps
+func parseTime(s string) (time.Time, bool) {
+	for _, layout := range []string{"2006-01-02 15:04:05 MST", "2006-01-02 15:04:05", time.RFC3339} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// isIP reports whether a host is an IP address rather than a domain name
+func isIP(host string) bool {
+	return net.ParseIP(strings.Trim(host, "[]")) != nil
+}
+
+// str returns the field of a JSON object as a string
+func str(m map[string]interface{}, key string) string {
+	switch v := m[key].(type) {
+	case string:
+		return v
+	case float64:
+		return fmt.Sprint(v)
+	case bool:
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// strs returns the field of a JSON object as a list of strings
+func strs(m map[string]interface{}, key string) []string {
+	var s []string
+	l, _ := m[key].([]interface{})
+	for _, v := range l {
+		if v, ok := v.(string); ok {
+			s = append(s, v)
+		}
+	}
+	return s
+}
+
+// strMap returns the field of a JSON object as a map of strings
+func strMap(m map[string]interface{}, key string) map[string]string {
+	obj, ok := m[key].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	s := map[string]string{}
+	for k := range obj {
+		s[k] = str(obj, k)
+	}
+	return s
+}
+
+// objects returns the field of a JSON object as a list of objects
+func objects(m map[string]interface{}, key string) []map[string]interface{} {
+	var objs []map[string]interface{}
+	l, _ := m[key].([]interface{})
+	for _, v := range l {
+		if v, ok := v.(map[string]interface{}); ok {
+			objs = append(objs, v)
+		}
+	}
+	return objs
+}
+
+// vtPercent returns the VirusTotal detection rate of a payload, or -1
+func vtPercent(m map[string]interface{}) float64 {
+	vt, ok := m["virustotal"].(map[string]interface{})
+	if !ok {
+		return -1
+	}
+	switch v := vt["percent"].(type) {
+	case float64:
+		return v
+	case string:
+		var f float64
+		if _, err := fmt.Sscan(v, &f); err == nil {
+			return f
+		}
+	}
+	return -1
+}
@@ -27,7 +27,11 @@ import (
 	"github.com/spf13/cobra"
 )
 
-var rawOutput bool
+var (
+	rawOutput         bool
+	mirrorPath        string
+	payloadMirrorPath string
+)
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -50,4 +54,6 @@ func Execute() {
 
 func init() {
 	rootCmd.PersistentFlags().BoolVarP(&rawOutput, "raw", "r", false, "raw output")
+	rootCmd.PersistentFlags().StringVar(&mirrorPath, "mirror", "", "URLhaus database dump (CSV, optionally zipped) to use as a local mirror")
+	rootCmd.PersistentFlags().StringVar(&payloadMirrorPath, "payload-mirror", "", "URLhaus payloads dump (CSV, optionally zipped) to use as a local mirror of payloads")
 }
@@ -0,0 +1,480 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	browserFormat     string
+	browserOutput     string
+	browserCheckHosts bool
+	browserWorkers    int
+)
+
+// browserEvent is a visit or a download found in a browser history
+type browserEvent struct {
+	Time     string    `json:"time,omitempty"`
+	Browser  string    `json:"browser"`
+	Database string    `json:"database"`
+	Kind     string    `json:"kind"`
+	URL      string    `json:"url"`
+	Title    string    `json:"title,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	SHA256   string    `json:"sha256,omitempty"`
+	Verdicts []verdict `json:"verdicts,omitempty"`
+
+	time       time.Time
+	indicators []logIndicator
+}
+
+// browserReport is the outcome of a browser history scan
+type browserReport struct {
+	Databases  int             `json:"databases"`
+	Visits     int             `json:"visits"`
+	Downloads  int             `json:"downloads"`
+	Indicators int             `json:"indicators"`
+	Errors     int             `json:"errors"`
+	Hits       []*browserEvent `json:"hits"`
+}
+
+// browser history databases looked for in directories
+var browserDatabases = map[string]bool{
+	"History":          true,
+	"places.sqlite":    true,
+	"downloads.sqlite": true,
+}
+
+var errNotHistory = errors.New("not a Chrome or Firefox history database")
+
+// scanBrowserCmd represents the scan-browser command
+var scanBrowserCmd = &cobra.Command{
+	Use:   "scan-browser path...",
+	Short: "Check the URLs visited and downloaded in browser histories",
+	Long: `This command reads copies of Chrome and Chromium (History) and Firefox
+(places.sqlite, and downloads.sqlite of old versions) history databases,
+and checks the URLs visited and downloaded, along with the SHA256 hashes
+Chrome records for downloads. The visits and downloads of listed URLs and
+payloads are reported as a timeline, with the tags and signatures URLhaus
+knows about.
+
+The paths are databases, or directories such as profiles or home
+directories of an image, which are searched for databases. Committed
+changes not yet checkpointed from the write-ahead log next to a database
+are read too, so copy the -wal file along with the database. With --check-hosts, the hosts of
+the URLs are checked as well.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		switch browserFormat {
+		case "text", "json", "ndjson":
+		default:
+			log.Fatalf("unknown format %q", browserFormat)
+		}
+		c, err := newChecker()
+		if err != nil {
+			log.Fatal(err)
+		}
+		out, err := newNDJSONLogger(browserOutput)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		report := &browserReport{Hits: []*browserEvent{}}
+		var events []*browserEvent
+		for _, path := range args {
+			files, err := historyDatabases(path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, name := range files {
+				e, err := readHistory(name)
+				if err != nil {
+					log.Printf("%s: %v", name, err)
+					continue
+				}
+				report.Databases++
+				events = append(events, e...)
+			}
+		}
+		sort.SliceStable(events, func(i, j int) bool {
+			if !events[i].time.Equal(events[j].time) {
+				return events[i].time.Before(events[j].time)
+			}
+			return events[i].URL < events[j].URL
+		})
+
+		var indicators []logIndicator
+		for _, e := range events {
+			if e.Kind == "download" {
+				report.Downloads++
+			} else {
+				report.Visits++
+			}
+			indicators = append(indicators, e.indicators...)
+		}
+		verdicts, failed := checkAll(c, indicators, browserWorkers)
+		report.Indicators, report.Errors = len(verdicts), len(failed)
+
+		for _, e := range events {
+			for _, in := range e.indicators {
+				if v := verdicts[in]; v.Listed {
+					e.Verdicts = append(e.Verdicts, v)
+				}
+			}
+			if len(e.Verdicts) > 0 {
+				report.Hits = append(report.Hits, e)
+			}
+		}
+
+		if err := writeScanReport(out, browserFormat, report); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(scanBrowserCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// scanBrowserCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// scanBrowserCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	scanBrowserCmd.Flags().StringVarP(&browserFormat, "format", "f", "text", "The output format: text, json or ndjson (one hit per line)")
+	scanBrowserCmd.Flags().StringVarP(&browserOutput, "output", "o", "-", "The file the timeline is written to")
+	scanBrowserCmd.Flags().BoolVar(&browserCheckHosts, "check-hosts", false, "Also check the hosts of the URLs")
+	scanBrowserCmd.Flags().IntVar(&browserWorkers, "workers", 8, "The number of concurrent lookups")
+	addCheckerFlags(scanBrowserCmd)
+}
+
+// historyDatabases returns the path if it is a file, or the history
+// databases found under it
+func historyDatabases(path string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{path}, nil
+	}
+
+	var files []string
+	err = filepath.Walk(path, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// unreadable directories of an image
+			log.Print(err)
+			return nil
+		}
+		if fi.Mode().IsRegular() && browserDatabases[fi.Name()] {
+			files = append(files, name)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// readHistory returns the visits and downloads of a history database
+func readHistory(name string) ([]*browserEvent, error) {
+	db, err := openSQLite(name)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	tables, err := db.tables()
+	if err != nil {
+		return nil, err
+	}
+
+	h := &historyReader{db: db, tables: tables, name: name}
+	switch {
+	case tables["urls"] != nil && tables["visits"] != nil:
+		err = h.chrome()
+	case tables["moz_places"] != nil || tables["moz_downloads"] != nil:
+		err = h.firefox()
+	default:
+		err = errNotHistory
+	}
+	return h.events, err
+}
+
+// historyReader collects the events of a history database
+type historyReader struct {
+	db     *sqliteDB
+	tables map[string]*sqliteTable
+	name   string
+	events []*browserEvent
+}
+
+// scan calls fn with the rows of a table, if the table exists
+func (h *historyReader) scan(table string, fn func(row map[string]interface{})) error {
+	t := h.tables[table]
+	if t == nil {
+		return nil
+	}
+	return h.db.scan(t, func(row map[string]interface{}) error {
+		fn(row)
+		return nil
+	})
+}
+
+func (h *historyReader) add(browser, kind, u, title string, t time.Time) *browserEvent {
+	e := &browserEvent{
+		Browser:  browser,
+		Database: h.name,
+		Kind:     kind,
+		URL:      u,
+		Title:    title,
+		time:     t,
+	}
+	if !t.IsZero() {
+		e.Time = t.UTC().Format(time.RFC3339)
+	}
+	e.addURL(u)
+	h.events = append(h.events, e)
+	return e
+}
+
+// addURL adds an URL of the event to check, unless it is local
+func (e *browserEvent) addURL(u string) {
+	lower := strings.ToLower(u)
+	if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") && !strings.HasPrefix(lower, "ftp://") {
+		return
+	}
+	e.indicators = append(e.indicators, logIndicator{"url", u})
+	if browserCheckHosts {
+		if host := hostOf(u); host != "" {
+			e.indicators = append(e.indicators, logIndicator{"host", strings.ToLower(host)})
+		}
+	}
+}
+
+// chrome reads the urls, visits and downloads tables of Chrome
+func (h *historyReader) chrome() error {
+	type place struct {
+		url, title string
+		last       time.Time
+		visited    bool
+	}
+	places := map[int64]*place{}
+	err := h.scan("urls", func(row map[string]interface{}) {
+		places[rowInt(row, "id")] = &place{
+			url:   rowString(row, "url"),
+			title: rowString(row, "title"),
+			last:  webkitTime(rowInt(row, "last_visit_time")),
+		}
+	})
+	if err != nil {
+		return err
+	}
+	err = h.scan("visits", func(row map[string]interface{}) {
+		if p := places[rowInt(row, "url")]; p != nil {
+			p.visited = true
+			h.add("chrome", "visit", p.url, p.title, webkitTime(rowInt(row, "visit_time")))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	// URLs whose visits expired
+	for _, p := range places {
+		if !p.visited && p.url != "" {
+			h.add("chrome", "visit", p.url, p.title, p.last)
+		}
+	}
+
+	chains := map[int64][]string{}
+	err = h.scan("downloads_url_chains", func(row map[string]interface{}) {
+		id, i := rowInt(row, "id"), int(rowInt(row, "chain_index"))
+		for len(chains[id]) <= i && i < 1000 {
+			chains[id] = append(chains[id], "")
+		}
+		if i < 1000 {
+			chains[id][i] = rowString(row, "url")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return h.scan("downloads", func(row map[string]interface{}) {
+		chain := chains[rowInt(row, "id")]
+		u := rowString(row, "url")
+		for _, c := range chain {
+			if c != "" {
+				u = c
+			}
+		}
+		e := h.add("chrome", "download", u, "", webkitTime(rowInt(row, "start_time")))
+		for _, c := range chain {
+			if c != "" && c != u {
+				e.addURL(c)
+			}
+		}
+		e.Target = rowString(row, "target_path")
+		if hash, ok := row["hash"].([]byte); ok && len(hash) == 32 {
+			e.SHA256 = hex.EncodeToString(hash)
+			e.indicators = append(e.indicators, logIndicator{"sha256", e.SHA256})
+		}
+	})
+}
+
+// firefox reads the places, visits and download annotations of Firefox,
+// and the downloads of its older versions
+func (h *historyReader) firefox() error {
+	type place struct {
+		url, title string
+		last       time.Time
+		visited    bool
+	}
+	places := map[int64]*place{}
+	err := h.scan("moz_places", func(row map[string]interface{}) {
+		places[rowInt(row, "id")] = &place{
+			url:   rowString(row, "url"),
+			title: rowString(row, "title"),
+			last:  prTime(rowInt(row, "last_visit_date")),
+		}
+	})
+	if err != nil {
+		return err
+	}
+	err = h.scan("moz_historyvisits", func(row map[string]interface{}) {
+		if p := places[rowInt(row, "place_id")]; p != nil {
+			p.visited = true
+			h.add("firefox", "visit", p.url, p.title, prTime(rowInt(row, "visit_date")))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range places {
+		if !p.visited && p.url != "" && !p.last.IsZero() {
+			h.add("firefox", "visit", p.url, p.title, p.last)
+		}
+	}
+
+	destination := int64(-1)
+	err = h.scan("moz_anno_attributes", func(row map[string]interface{}) {
+		if rowString(row, "name") == "downloads/destinationFileURI" {
+			destination = rowInt(row, "id")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	err = h.scan("moz_annos", func(row map[string]interface{}) {
+		if rowInt(row, "anno_attribute_id") != destination {
+			return
+		}
+		if p := places[rowInt(row, "place_id")]; p != nil {
+			e := h.add("firefox", "download", p.url, p.title, prTime(rowInt(row, "dateAdded")))
+			e.Target = rowString(row, "content")
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return h.scan("moz_downloads", func(row map[string]interface{}) {
+		e := h.add("firefox", "download", rowString(row, "source"), "", prTime(rowInt(row, "startTime")))
+		e.Target = rowString(row, "target")
+	})
+}
+
+func rowInt(row map[string]interface{}, column string) int64 {
+	i, _ := row[column].(int64)
+	return i
+}
+
+func rowString(row map[string]interface{}, column string) string {
+	switch v := row[column].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+// webkitTime converts a Chrome time, in microseconds since 1601
+func webkitTime(us int64) time.Time {
+	if us <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(us/1e6-11644473600, us%1e6*1e3)
+}
+
+// prTime converts a Firefox time, in microseconds since 1970
+func prTime(us int64) time.Time {
+	if us <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(us/1e6, us%1e6*1e3)
+}
+
+func (r *browserReport) records() []interface{} {
+	records := make([]interface{}, len(r.Hits))
+	for i, v := range r.Hits {
+		records[i] = v
+	}
+	return records
+}
+
+func (r *browserReport) writeText(w io.Writer) {
+	fmt.Fprintf(w, "Scanned %d databases, %d visits, %d downloads, %d indicators, %d hits", r.Databases, r.Visits, r.Downloads, r.Indicators, len(r.Hits))
+	if r.Errors > 0 {
+		fmt.Fprintf(w, ", %d lookups failed", r.Errors)
+	}
+	fmt.Fprintln(w)
+
+	for _, e := range r.Hits {
+		t := e.Time
+		if t == "" {
+			t = "unknown time"
+		}
+		fmt.Fprintf(w, "\n%s %s %s %s\n", t, e.Browser, e.Kind, e.URL)
+		if e.Title != "" {
+			fmt.Fprintf(w, "  Title:    %s\n", e.Title)
+		}
+		if e.Target != "" {
+			fmt.Fprintf(w, "  Target:   %s\n", e.Target)
+		}
+		fmt.Fprintf(w, "  Database: %s\n", e.Database)
+		for _, v := range e.Verdicts {
+			fmt.Fprintf(w, "  %s\n", v.summary())
+		}
+	}
+}
@@ -0,0 +1,454 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	imageFormat    string
+	imageOutput    string
+	imageMaxDepth  int
+	imageMaxMemory int64
+	imageWorkers   int
+	imageFail      bool
+)
+
+// imageFile is a file of an image or archive, with its hashes
+type imageFile struct {
+	Archive string `json:"archive"`
+	Path    string `json:"path"`
+	Image   string `json:"image,omitempty"`
+	Layer   int    `json:"layer,omitempty"`
+	Size    int64  `json:"size"`
+	MD5     string `json:"md5"`
+	SHA256  string `json:"sha256"`
+
+	// entries are the names of the archive entries leading to the file
+	entries []string
+}
+
+// imageHit is a file whose payload is listed
+type imageHit struct {
+	imageFile
+	verdict
+}
+
+// imageReport is the outcome of an image scan
+type imageReport struct {
+	Files       int         `json:"files"`
+	Archives    int         `json:"archives"`
+	Payloads    int         `json:"payloads"`
+	Unsupported int         `json:"unsupported"`
+	Errors      int         `json:"errors"`
+	Hits        []*imageHit `json:"hits"`
+}
+
+// imageScanner hashes the files of archives
+type imageScanner struct {
+	report *imageReport
+	files  []*imageFile
+
+	// manifests are the small JSON files of the top-level archive, which
+	// may describe the layers of an image
+	manifests map[string][]byte
+}
+
+// scanImageCmd represents the scan-image command
+var scanImageCmd = &cobra.Command{
+	Use:   "scan-image archive...",
+	Short: "Check the payloads of container images and archives",
+	Long: `This command reads OCI and Docker image tarballs (docker save, skopeo
+or podman output) and tar, tar.gz, tar.bz2, gzip and zip archives, hashes
+every file they contain, nested archives and image layers included, and
+looks the SHA256 hashes up as payloads. Everything is streamed, nothing is
+extracted to disk; only zip archives nested in other archives are read in
+memory, up to --max-memory bytes.
+
+The hits are reported with the path of the file through the archives, and
+for images, the image and layer it belongs to. Payloads are looked up in
+the --payload-mirror if there is one, and with the API if --api is set or
+no mirror is given. With --fail, the command exits with status 3 if a
+payload is listed, to gate pipelines.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		switch imageFormat {
+		case "text", "json", "ndjson":
+		default:
+			log.Fatalf("unknown format %q", imageFormat)
+		}
+		c, err := newChecker()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !c.checksPayloads() {
+			log.Print("the mirror has no payloads, the hashes are not checked: use --payload-mirror or --api")
+		}
+		out, err := newNDJSONLogger(imageOutput)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		report := &imageReport{Hits: []*imageHit{}}
+		s := &imageScanner{report: report}
+		for _, name := range args {
+			f, err := os.Open(name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			start := len(s.files)
+			s.manifests = map[string][]byte{}
+			s.file(nil, name, f, 0)
+			f.Close()
+			s.layers(s.files[start:])
+		}
+
+		var indicators []logIndicator
+		for _, f := range s.files {
+			if f.Size > 0 {
+				indicators = append(indicators, logIndicator{"sha256", f.SHA256})
+			}
+		}
+		verdicts, failed := checkAll(c, indicators, imageWorkers)
+		report.Payloads = len(verdicts)
+		report.Errors += len(failed)
+
+		for _, f := range s.files {
+			if v := verdicts[logIndicator{"sha256", f.SHA256}]; v.Listed {
+				report.Hits = append(report.Hits, &imageHit{*f, v})
+			}
+		}
+
+		if err := writeScanReport(out, imageFormat, report); err != nil {
+			log.Fatal(err)
+		}
+		if imageFail && len(report.Hits) > 0 {
+			os.Exit(3)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(scanImageCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// scanImageCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// scanImageCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	scanImageCmd.Flags().StringVarP(&imageFormat, "format", "f", "text", "The output format: text, json or ndjson (one hit per line)")
+	scanImageCmd.Flags().StringVarP(&imageOutput, "output", "o", "-", "The file the report is written to")
+	scanImageCmd.Flags().IntVar(&imageMaxDepth, "max-depth", 4, "How deep archives nested in archives are read")
+	scanImageCmd.Flags().Int64Var(&imageMaxMemory, "max-memory", 256<<20, "The largest nested zip archive read in memory")
+	scanImageCmd.Flags().IntVar(&imageWorkers, "workers", 8, "The number of concurrent lookups")
+	scanImageCmd.Flags().BoolVar(&imageFail, "fail", false, "Exit with status 3 if a payload is listed")
+	addCheckerFlags(scanImageCmd)
+}
+
+// file hashes a file, and the files it contains if it is an archive and
+// not too deep
+func (s *imageScanner) file(entries []string, archive string, r io.Reader, depth int) {
+	md5h, sha := md5.New(), sha256.New()
+	counter := &countWriter{}
+	r = io.TeeReader(r, io.MultiWriter(md5h, sha, counter))
+
+	if depth == 1 || depth == 2 {
+		// keep the JSON files of the image, such as manifest.json,
+		// index.json and the OCI manifests in blobs
+		br := bufio.NewReader(r)
+		if b, err := br.Peek(1); err == nil && (b[0] == '{' || b[0] == '[') {
+			b, _ := ioutil.ReadAll(io.LimitReader(br, 1<<20))
+			s.manifests[strings.TrimPrefix(entries[len(entries)-1], "./")] = b
+			r = io.MultiReader(bytes.NewReader(b), br)
+		} else {
+			r = br
+		}
+	}
+
+	br := bufio.NewReaderSize(r, 1<<16)
+	if depth < imageMaxDepth {
+		if err := s.archive(entries, archive, br, depth); err != nil {
+			log.Printf("%s: %v", imagePath(archive, entries), err)
+			s.report.Errors++
+		}
+	}
+	if _, err := io.Copy(ioutil.Discard, br); err != nil {
+		log.Printf("%s: %v", imagePath(archive, entries), err)
+		s.report.Errors++
+		return
+	}
+
+	s.report.Files++
+	f := &imageFile{
+		Archive: archive,
+		Path:    strings.Join(entries, "!"),
+		Size:    counter.n,
+		MD5:     hex.EncodeToString(md5h.Sum(nil)),
+		SHA256:  hex.EncodeToString(sha.Sum(nil)),
+		entries: entries,
+	}
+	s.files = append(s.files, f)
+}
+
+// archive hashes the files of an archive, if it is one
+func (s *imageScanner) archive(entries []string, archive string, br *bufio.Reader, depth int) error {
+	magic, _ := br.Peek(512)
+	inner := func(name string) []string {
+		return append(append([]string{}, entries...), name)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		s.report.Archives++
+		s.file(inner(decompressedName(archive, entries, zr.Name, ".gz")), archive, zr, depth+1)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		s.report.Archives++
+		s.file(inner(decompressedName(archive, entries, "", ".bz2")), archive, bzip2.NewReader(br), depth+1)
+
+	case len(magic) >= 262 && string(magic[257:262]) == "ustar":
+		s.report.Archives++
+		tr := tar.NewReader(br)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if h.Typeflag == tar.TypeReg || h.Typeflag == tar.TypeRegA {
+				s.file(inner(h.Name), archive, tr, depth+1)
+			}
+		}
+
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		var zr *zip.Reader
+		if depth == 0 {
+			// the file itself can be read at random
+			f, err := os.Open(archive)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			fi, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			if zr, err = zip.NewReader(f, fi.Size()); err != nil {
+				return err
+			}
+		} else {
+			b, err := ioutil.ReadAll(io.LimitReader(br, imageMaxMemory+1))
+			if err != nil {
+				return err
+			}
+			if int64(len(b)) > imageMaxMemory {
+				s.report.Unsupported++
+				return fmt.Errorf("zip archive larger than %d bytes, not read", imageMaxMemory)
+			}
+			if zr, err = zip.NewReader(bytes.NewReader(b), int64(len(b))); err != nil {
+				return err
+			}
+		}
+		s.report.Archives++
+		for _, f := range zr.File {
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				log.Printf("%s: %v", imagePath(archive, inner(f.Name)), err)
+				s.report.Errors++
+				continue
+			}
+			s.file(inner(f.Name), archive, rc, depth+1)
+			rc.Close()
+		}
+
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}), bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0}):
+		s.report.Unsupported++
+		return fmt.Errorf("zstd and xz compressed archives are not supported")
+	}
+	return nil
+}
+
+// decompressedName names the content of a compressed file
+func decompressedName(archive string, entries []string, name, ext string) string {
+	if name != "" {
+		return name
+	}
+	base := filepath.Base(archive)
+	if len(entries) > 0 {
+		base = path.Base(entries[len(entries)-1])
+	}
+	switch {
+	case strings.HasSuffix(base, ".tgz"):
+		return strings.TrimSuffix(base, ".tgz") + ".tar"
+	case strings.HasSuffix(base, ext):
+		return strings.TrimSuffix(base, ext)
+	}
+	return "(" + strings.TrimPrefix(ext, ".") + ")"
+}
+
+func imagePath(archive string, entries []string) string {
+	return strings.Join(append([]string{archive}, entries...), "!")
+}
+
+// layers tells the image and layer of the files of an OCI or Docker image
+func (s *imageScanner) layers(files []*imageFile) {
+	type layer struct {
+		image string
+		index int
+	}
+	layers := map[string]layer{}
+
+	// docker save
+	var manifest []struct {
+		RepoTags []string
+		Layers   []string
+	}
+	if json.Unmarshal(s.manifests["manifest.json"], &manifest) == nil {
+		for _, m := range manifest {
+			for i, l := range m.Layers {
+				layers[l] = layer{strings.Join(m.RepoTags, ","), i + 1}
+			}
+		}
+	}
+
+	// OCI image layout
+	type descriptor struct {
+		MediaType   string            `json:"mediaType"`
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+	}
+	var index struct {
+		Manifests []descriptor `json:"manifests"`
+	}
+	var walk func(d descriptor, image string, depth int)
+	walk = func(d descriptor, image string, depth int) {
+		if name := d.Annotations["org.opencontainers.image.ref.name"]; name != "" {
+			image = name
+		}
+		var m struct {
+			Manifests []descriptor `json:"manifests"`
+			Layers    []descriptor `json:"layers"`
+		}
+		if depth > 4 || json.Unmarshal(s.manifests["blobs/"+strings.Replace(d.Digest, ":", "/", 1)], &m) != nil {
+			return
+		}
+		for _, sub := range m.Manifests {
+			walk(sub, image, depth+1)
+		}
+		for i, l := range m.Layers {
+			name := "blobs/" + strings.Replace(l.Digest, ":", "/", 1)
+			if _, ok := layers[name]; !ok {
+				layers[name] = layer{image, i + 1}
+			}
+		}
+	}
+	if json.Unmarshal(s.manifests["index.json"], &index) == nil {
+		for _, d := range index.Manifests {
+			walk(d, "", 0)
+		}
+	}
+
+	if len(layers) == 0 {
+		return
+	}
+	for _, f := range files {
+		for _, e := range f.entries {
+			if l, ok := layers[strings.TrimPrefix(e, "./")]; ok {
+				f.Image, f.Layer = l.image, l.index
+				break
+			}
+		}
+	}
+}
+
+// countWriter counts the bytes written to it
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	w.n += int64(len(b))
+	return len(b), nil
+}
+
+func (r *imageReport) records() []interface{} {
+	records := make([]interface{}, len(r.Hits))
+	for i, v := range r.Hits {
+		records[i] = v
+	}
+	return records
+}
+
+func (r *imageReport) writeText(w io.Writer) {
+	fmt.Fprintf(w, "Scanned %d files in %d archives, %d payloads, %d listed", r.Files, r.Archives, r.Payloads, len(r.Hits))
+	if r.Unsupported > 0 {
+		fmt.Fprintf(w, ", %d unsupported archives", r.Unsupported)
+	}
+	if r.Errors > 0 {
+		fmt.Fprintf(w, ", %d errors", r.Errors)
+	}
+	fmt.Fprintln(w)
+
+	for _, h := range r.Hits {
+		fmt.Fprintf(w, "\n%s\n", imagePath(h.Archive, h.imageFile.entries))
+		if h.Layer > 0 {
+			image := h.Image
+			if image == "" {
+				image = "untagged image"
+			}
+			fmt.Fprintf(w, "  Layer %d of %s\n", h.Layer, image)
+		}
+		fmt.Fprintf(w, "  Size: %d, MD5: %s\n", h.Size, h.MD5)
+		fmt.Fprintf(w, "  %s\n", h.summary())
+	}
+}
@@ -0,0 +1,538 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	scanLogFormat  string
+	scanRegex      string
+	scanTimeFormat string
+	scanCheckHosts bool
+	scanFormat     string
+	scanOutput     string
+	scanMaxLines   int
+	scanWorkers    int
+	scanNotify     string
+	scanFollow     bool
+	scanSyslogUDP  string
+	scanSyslogTCP  string
+	scanCheckpoint string
+	scanFromStart  bool
+	scanPoll       time.Duration
+
+	// scanSpool is the temporary copy of the standard input
+	scanSpool string
+)
+
+// logLine is a log line mentioning a listed indicator
+type logLine struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Time   string `json:"time,omitempty"`
+	Client string `json:"client,omitempty"`
+	ID     string `json:"id,omitempty"`
+	Text   string `json:"text"`
+}
+
+// logHit is a listed indicator along with where it appears in the logs
+type logHit struct {
+	verdict
+	Count     int            `json:"count"`
+	FirstSeen string         `json:"first_seen,omitempty"`
+	LastSeen  string         `json:"last_seen,omitempty"`
+	Clients   map[string]int `json:"clients"`
+	Lines     []logLine      `json:"lines"`
+
+	first, last time.Time
+}
+
+// clientSummary is what a client requested among the listed indicators
+type clientSummary struct {
+	Client     string   `json:"client"`
+	Requests   int      `json:"requests"`
+	Indicators []string `json:"indicators"`
+	FirstSeen  string   `json:"first_seen,omitempty"`
+	LastSeen   string   `json:"last_seen,omitempty"`
+
+	first, last time.Time
+}
+
+// logReport is the outcome of a log scan
+type logReport struct {
+	Lines      int              `json:"lines"`
+	Unparsed   int              `json:"unparsed"`
+	Indicators int              `json:"indicators"`
+	Errors     int              `json:"errors"`
+	Hits       []*logHit        `json:"hits"`
+	Clients    []*clientSummary `json:"clients"`
+}
+
+// scanLogsCmd represents the scan-logs command
+var scanLogsCmd = &cobra.Command{
+	Use:   "scan-logs [file...]",
+	Short: "Check the URLs and hosts of web, proxy and firewall logs",
+	Long: `This command extracts the URLs and hosts requested in log files (or the
+standard input), looks each of them up once, in the mirror first, and
+reports the listed ones along with the log lines, times and clients
+requesting them, followed by a summary per client. With --format ndjson,
+each log line mentioning a listed indicator is written as an event instead.
+
+The --log-format is one of combined (Apache and nginx, optionally preceded
+by the virtual host), squid (native access.log), haproxy (HTTP log format),
+zeek (http.log, dns.log, ssl.log and files.log, TSV or JSON), eve (Suricata
+http, dns, tls and fileinfo events) or regex. The Zeek uid and Suricata
+flow_id are kept in the report and events, and the file hashes are looked
+up as payloads. With regex, --regex must have an url or host named group, and
+may have path, client and time groups. Times are parsed with the Go
+--time-format layout, or guessed without one. Gzipped files are read too.
+
+With --check-hosts, the hosts of the URLs are checked as well, so hosts
+where URLhaus saw other malware URLs are reported.
+
+With --follow, the files are followed as they grow, across rotations by
+renaming or truncation, and every line mentioning a listed indicator is
+reported right away as an NDJSON alert. The files are read from their end,
+or from their start with --from-start, unless the --checkpoint file tells
+where the previous run stopped. With --syslog-udp or --syslog-tcp, the log
+lines are received as syslog messages instead of, or as well as, read from
+files.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		newParser, err := newLogParser(scanLogFormat, scanRegex, scanTimeFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c, err := newChecker()
+		if err != nil {
+			log.Fatal(err)
+		}
+		var nt *notifier
+		if scanNotify != "" {
+			if nt, err = newNotifier(scanNotify); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if scanFollow || scanSyslogUDP != "" || scanSyslogTCP != "" {
+			alerts, err := newNDJSONLogger(scanOutput)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !scanFollow {
+				args = nil
+			} else if len(args) == 0 {
+				log.Fatal("--follow requires log files")
+			}
+			runFollow(args, &follower{newParser: newParser, checker: c, alerts: alerts, notify: nt})
+			return
+		}
+
+		if len(args) == 0 {
+			args = []string{"-"}
+		}
+		spool := ""
+		for i, name := range args {
+			if name != "-" {
+				continue
+			}
+			// the logs are read twice
+			if spool == "" {
+				if spool, err = spoolStdin(); err != nil {
+					log.Fatal(err)
+				}
+				defer os.Remove(spool)
+			}
+			args[i] = spool
+		}
+
+		out, err := newNDJSONLogger(scanOutput)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var events *ndjsonLogger
+		switch scanFormat {
+		case "ndjson":
+			events = out
+		case "json", "text":
+		default:
+			log.Fatalf("unknown format %q", scanFormat)
+		}
+
+		scanSpool = spool
+		report, err := scanLogs(args, newParser, c, events)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, h := range report.Hits {
+			for i := range h.Lines {
+				h.Lines[i].File = displayName(h.Lines[i].File)
+			}
+		}
+
+		if nt != nil {
+			for _, h := range report.Hits {
+				nt.notify(h.notification())
+			}
+			defer nt.flush(time.Minute)
+		}
+
+		switch scanFormat {
+		case "json":
+			err = out.log(report)
+		case "text":
+			w := bufio.NewWriter(out.w)
+			report.writeText(w)
+			err = w.Flush()
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(scanLogsCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// scanLogsCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// scanLogsCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	scanLogsCmd.Flags().StringVar(&scanLogFormat, "log-format", "combined", "The log format: combined, squid, haproxy, zeek, eve or regex")
+	scanLogsCmd.Flags().StringVar(&scanRegex, "regex", "", "The regular expression of the regex log format")
+	scanLogsCmd.Flags().StringVar(&scanTimeFormat, "time-format", "", "The Go layout of the times matched by --regex")
+	scanLogsCmd.Flags().BoolVar(&scanCheckHosts, "check-hosts", false, "Also check the hosts of the URLs")
+	scanLogsCmd.Flags().StringVarP(&scanFormat, "format", "f", "text", "The output format: text, json or ndjson (one event per line)")
+	scanLogsCmd.Flags().StringVarP(&scanOutput, "output", "o", "-", "The file the report is written to")
+	scanLogsCmd.Flags().IntVar(&scanMaxLines, "max-lines", 10, "The most log lines reported per indicator")
+	scanLogsCmd.Flags().IntVar(&scanWorkers, "workers", 8, "The number of concurrent lookups")
+	scanLogsCmd.Flags().StringVar(&scanNotify, "notify", "", "A JSON file configuring where hits are notified")
+	scanLogsCmd.Flags().BoolVarP(&scanFollow, "follow", "F", false, "Follow the files as they grow and alert on each listed indicator")
+	scanLogsCmd.Flags().StringVar(&scanSyslogUDP, "syslog-udp", "", "Receive log lines as syslog messages on this UDP address")
+	scanLogsCmd.Flags().StringVar(&scanSyslogTCP, "syslog-tcp", "", "Receive log lines as syslog messages on this TCP address")
+	scanLogsCmd.Flags().StringVar(&scanCheckpoint, "checkpoint", "", "The file keeping where the followed files were read to")
+	scanLogsCmd.Flags().BoolVar(&scanFromStart, "from-start", false, "Follow files without checkpoint from their start")
+	scanLogsCmd.Flags().DurationVar(&scanPoll, "poll", time.Second, "How often the followed files are checked")
+	addCheckerFlags(scanLogsCmd)
+}
+
+// spoolStdin copies the standard input to a temporary file
+func spoolStdin() (string, error) {
+	f, err := ioutil.TempFile("", "urlhaus-logs")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, os.Stdin); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// displayName returns the name of a log file to report
+func displayName(file string) string {
+	if file == scanSpool && file != "" {
+		return "-"
+	}
+	return file
+}
+
+// openLog opens a log file, decompressing it if gzipped
+func openLog(name string) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{zr, f}, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{br, f}, nil
+}
+
+// eachLogLine calls fn with every line of the log files
+func eachLogLine(files []string, fn func(file string, n int, line string)) error {
+	for _, name := range files {
+		f, err := openLog(name)
+		if err != nil {
+			return err
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		n := 0
+		for sc.Scan() {
+			n++
+			fn(name, n, sc.Text())
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// recordIndicators returns the indicators of a record to check
+func recordIndicators(rec logRecord) []logIndicator {
+	indicators := rec.Indicators
+	if scanCheckHosts {
+		for _, in := range rec.Indicators {
+			if in.Type == "url" {
+				if h := hostOf(in.Value); h != "" {
+					indicators = append(indicators, logIndicator{"host", strings.ToLower(h)})
+				}
+			}
+		}
+	}
+	return indicators
+}
+
+// scanLogs reads the logs a first time to collect the indicators, looks
+// them up, and a second time to collect the lines of the listed ones,
+// logged to events if not nil
+func scanLogs(files []string, newParser func() logParser, c *checker, events *ndjsonLogger) (*logReport, error) {
+	report := &logReport{}
+	seen := map[logIndicator]bool{}
+	var parse logParser
+	noHost := false
+	err := eachLogLine(files, func(file string, n int, line string) {
+		if n == 1 {
+			parse = newParser()
+		}
+		report.Lines++
+		rec, ok := parse(line)
+		if !ok {
+			if !strings.HasPrefix(line, "#") {
+				report.Unparsed++
+			}
+			return
+		}
+		noHost = noHost || rec.NoHost
+		for _, in := range recordIndicators(rec) {
+			seen[in] = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if noHost {
+		log.Print(noHostWarning)
+	}
+	report.Indicators = len(seen)
+
+	var indicators []logIndicator
+	for in := range seen {
+		indicators = append(indicators, in)
+	}
+	verdicts, failed := checkAll(c, indicators, scanWorkers)
+	report.Errors = len(failed)
+	hits := map[logIndicator]*logHit{}
+	for in, v := range verdicts {
+		if v.Listed {
+			hits[in] = &logHit{verdict: v, Clients: map[string]int{}, Lines: []logLine{}}
+		}
+	}
+	if len(hits) == 0 {
+		report.Hits = []*logHit{}
+		report.Clients = []*clientSummary{}
+		return report, nil
+	}
+
+	clients := map[string]*clientSummary{}
+	err = eachLogLine(files, func(file string, n int, line string) {
+		if n == 1 {
+			parse = newParser()
+		}
+		rec, ok := parse(line)
+		if !ok {
+			return
+		}
+		var matched []string
+		for _, in := range recordIndicators(rec) {
+			if h, ok := hits[in]; ok {
+				h.add(rec, logLine{File: file, Line: n, Client: rec.Client, ID: rec.ID, Text: line})
+				matched = append(matched, in.Value)
+				if events != nil {
+					a := newLogAlert(displayName(file), rec, h.verdict, line)
+					a.Line = n
+					if err := events.log(a); err != nil {
+						log.Print(err)
+					}
+				}
+			}
+		}
+		if len(matched) == 0 {
+			return
+		}
+
+		cs, ok := clients[rec.Client]
+		if !ok {
+			cs = &clientSummary{Client: rec.Client}
+			clients[rec.Client] = cs
+		}
+		cs.Requests++
+		cs.Indicators = appendUnique(cs.Indicators, matched...)
+		cs.first, cs.last = widen(cs.first, cs.last, rec.Time)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, h := range hits {
+		h.FirstSeen, h.LastSeen = formatSpan(h.first, h.last)
+		report.Hits = append(report.Hits, h)
+	}
+	sort.Slice(report.Hits, func(i, j int) bool {
+		a, b := report.Hits[i], report.Hits[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Indicator < b.Indicator
+	})
+	for _, cs := range clients {
+		cs.FirstSeen, cs.LastSeen = formatSpan(cs.first, cs.last)
+		report.Clients = append(report.Clients, cs)
+	}
+	sort.Slice(report.Clients, func(i, j int) bool {
+		a, b := report.Clients[i], report.Clients[j]
+		if a.Requests != b.Requests {
+			return a.Requests > b.Requests
+		}
+		return a.Client < b.Client
+	})
+	return report, nil
+}
+
+// add records a log line mentioning the indicator
+func (h *logHit) add(rec logRecord, l logLine) {
+	h.Count++
+	if rec.Client != "" {
+		h.Clients[rec.Client]++
+	}
+	h.first, h.last = widen(h.first, h.last, rec.Time)
+	if !rec.Time.IsZero() {
+		l.Time = rec.Time.Format(time.RFC3339)
+	}
+	if len(h.Lines) < scanMaxLines {
+		h.Lines = append(h.Lines, l)
+	}
+}
+
+// notification returns the notification of a hit
+func (h *logHit) notification() notification {
+	return notification{
+		Time:      time.Now().UTC(),
+		Source:    "scan-logs",
+		Summary:   fmt.Sprintf("%s %s listed on URLhaus was requested %d times by %d clients", h.Type, h.Indicator, h.Count, len(h.Clients)),
+		Reference: h.Reference,
+		Event:     h,
+		Key:       "scan-logs|" + h.Type + "|" + h.Indicator,
+	}
+}
+
+// widen extends the first, last span to t
+func widen(first, last, t time.Time) (time.Time, time.Time) {
+	if t.IsZero() {
+		return first, last
+	}
+	if first.IsZero() || t.Before(first) {
+		first = t
+	}
+	if t.After(last) {
+		last = t
+	}
+	return first, last
+}
+
+func formatSpan(first, last time.Time) (string, string) {
+	if first.IsZero() {
+		return "", ""
+	}
+	return first.Format(time.RFC3339), last.Format(time.RFC3339)
+}
+
+func (r *logReport) writeText(w io.Writer) {
+	fmt.Fprintf(w, "Scanned %d lines (%d unparsed), %d indicators, %d listed", r.Lines, r.Unparsed, r.Indicators, len(r.Hits))
+	if r.Errors > 0 {
+		fmt.Fprintf(w, ", %d lookups failed", r.Errors)
+	}
+	fmt.Fprintln(w)
+
+	for _, h := range r.Hits {
+		fmt.Fprintf(w, "\n%s\n", h.summary())
+		fmt.Fprintf(w, "  %d requests from %d clients", h.Count, len(h.Clients))
+		if h.FirstSeen != "" {
+			fmt.Fprintf(w, " between %s and %s", h.FirstSeen, h.LastSeen)
+		}
+		fmt.Fprintln(w)
+		for _, l := range h.Lines {
+			fmt.Fprintf(w, "  %s:%d: %s\n", l.File, l.Line, l.Text)
+		}
+		if h.Count > len(h.Lines) {
+			fmt.Fprintf(w, "  ... %d more\n", h.Count-len(h.Lines))
+		}
+	}
+
+	if len(r.Clients) > 0 {
+		fmt.Fprintln(w, "\nClients:")
+		for _, cs := range r.Clients {
+			client := cs.Client
+			if client == "" {
+				client = "-"
+			}
+			fmt.Fprintf(w, "  %-39s %6d requests to %s", client, cs.Requests, strings.Join(cs.Indicators, ", "))
+			if cs.FirstSeen != "" {
+				fmt.Fprintf(w, " between %s and %s", cs.FirstSeen, cs.LastSeen)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
@@ -0,0 +1,477 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	pcapFormat     string
+	pcapOutput     string
+	pcapCheckHosts bool
+	pcapCarve      bool
+	pcapMaxStream  int
+	pcapWorkers    int
+)
+
+// pcapEvent is a request seen in a capture
+type pcapEvent struct {
+	file       string
+	time       time.Time
+	protocol   string
+	client     string
+	server     string
+	url        string
+	size       int
+	indicators []logIndicator
+}
+
+// pcapMatch is a request of a capture for a listed indicator
+type pcapMatch struct {
+	verdict
+	File     string `json:"file"`
+	Time     string `json:"time,omitempty"`
+	Protocol string `json:"protocol"`
+	Client   string `json:"client"`
+	Server   string `json:"server"`
+	URL      string `json:"url,omitempty"`
+	Size     int    `json:"size,omitempty"`
+}
+
+// pcapReport is the outcome of a capture scan
+type pcapReport struct {
+	Packets    int          `json:"packets"`
+	Streams    int          `json:"tcp_streams"`
+	Requests   int          `json:"requests"`
+	Indicators int          `json:"indicators"`
+	Errors     int          `json:"errors"`
+	Matches    []*pcapMatch `json:"matches"`
+}
+
+// pcapScanner collects the requests of captures
+type pcapScanner struct {
+	report *pcapReport
+	events []*pcapEvent
+	file   string
+}
+
+// scanPcapCmd represents the scan-pcap command
+var scanPcapCmd = &cobra.Command{
+	Use:   "scan-pcap file...",
+	Short: "Check the URLs, hosts and payloads of network captures",
+	Long: `This command reads pcap and pcapng files ("-" for the standard input),
+and checks the indicators of the traffic: the URLs of the HTTP requests,
+reassembled from the TCP streams, the names of the DNS queries and the
+server names of the TLS ClientHellos. The listed ones are reported along
+with the time of the packets and the client and server endpoints.
+
+With --carve, the bodies of the HTTP responses are decoded and hashed, and
+the hashes are looked up as payloads, in the --payload-mirror, and with the
+API if --api is set or no mirror is given. With --check-hosts, the hosts of
+the URLs are checked as well.
+
+Ethernet, Linux cooked, loopback and raw IP captures are supported. IP
+fragments are not reassembled, and only the first --max-stream bytes of a
+stream are kept.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		switch pcapFormat {
+		case "text", "json", "ndjson":
+		default:
+			log.Fatalf("unknown format %q", pcapFormat)
+		}
+		c, err := newChecker()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if pcapCarve && !c.checksPayloads() {
+			log.Print("the mirror has no payloads, the hashes are not checked: use --payload-mirror or --api")
+		}
+		out, err := newNDJSONLogger(pcapOutput)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		s := &pcapScanner{report: &pcapReport{}}
+		for _, name := range args {
+			if err := s.scanFile(name); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		var indicators []logIndicator
+		for _, e := range s.events {
+			indicators = append(indicators, e.indicators...)
+		}
+		verdicts, failed := checkAll(c, indicators, pcapWorkers)
+		s.report.Indicators, s.report.Errors = len(verdicts), len(failed)
+
+		sort.SliceStable(s.events, func(i, j int) bool { return s.events[i].time.Before(s.events[j].time) })
+		s.report.Matches = []*pcapMatch{}
+		for _, e := range s.events {
+			for _, in := range e.indicators {
+				if v := verdicts[in]; v.Listed {
+					s.report.Matches = append(s.report.Matches, e.match(v))
+				}
+			}
+		}
+
+		if err := writeScanReport(out, pcapFormat, s.report); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(scanPcapCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// scanPcapCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// scanPcapCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	scanPcapCmd.Flags().StringVarP(&pcapFormat, "format", "f", "text", "The output format: text, json or ndjson (one match per line)")
+	scanPcapCmd.Flags().StringVarP(&pcapOutput, "output", "o", "-", "The file the report is written to")
+	scanPcapCmd.Flags().BoolVar(&pcapCheckHosts, "check-hosts", false, "Also check the hosts of the URLs")
+	scanPcapCmd.Flags().BoolVar(&pcapCarve, "carve", false, "Hash the HTTP response bodies and look them up as payloads")
+	scanPcapCmd.Flags().IntVar(&pcapMaxStream, "max-stream", 32<<20, "The most bytes kept of a TCP stream")
+	scanPcapCmd.Flags().IntVar(&pcapWorkers, "workers", 8, "The number of concurrent lookups")
+	addCheckerFlags(scanPcapCmd)
+}
+
+// scanFile collects the requests of a capture file
+func (s *pcapScanner) scanFile(name string) error {
+	var f io.ReadCloser = ioutil.NopCloser(os.Stdin)
+	if name != "-" {
+		var err error
+		if f, err = openLog(name); err != nil {
+			return err
+		}
+	}
+	defer f.Close()
+
+	pr, err := newPcapReader(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	s.file = name
+	tcp := newTCPAssembler(streamLimit, s.conn)
+	for {
+		frame, err := pr.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Printf("%s: %v", name, err)
+			break
+		}
+		s.report.Packets++
+
+		p, ok := decodeFrame(frame)
+		if !ok {
+			continue
+		}
+		switch {
+		case p.proto == protoTCP:
+			tcp.add(p)
+		case p.proto == protoUDP && p.dstPort == 53:
+			s.dns(p.time, p.src.String(), p.srcPort, p.dst.String(), p.dstPort, p.payload)
+		}
+	}
+	tcp.flush()
+	return nil
+}
+
+// streamLimit tells how many bytes of a TCP stream are needed
+func streamLimit(c *tcpConn, dir int, head []byte) int {
+	switch {
+	case len(head) == 0:
+		return 0
+	case isHTTPRequest(head):
+		return pcapMaxStream
+	case head[0] == 0x16:
+		// the ClientHello
+		return 1 << 16
+	case c.server.Port() == 53:
+		return 1 << 16
+	case pcapCarve && bytes.HasPrefix(head, []byte("HTTP/")):
+		return pcapMaxStream
+	}
+	return 0
+}
+
+func isHTTPRequest(head []byte) bool {
+	i := bytes.IndexByte(head, ' ')
+	if i < 3 {
+		return false
+	}
+	switch string(head[:i]) {
+	case "GET", "POST", "HEAD", "PUT", "DELETE", "OPTIONS", "CONNECT", "PATCH", "TRACE":
+		return true
+	}
+	return false
+}
+
+// event adds a request to the scan
+func (s *pcapScanner) event(e *pcapEvent) {
+	e.file = s.file
+	s.report.Requests++
+	s.events = append(s.events, e)
+}
+
+// dns adds the name of a DNS query
+func (s *pcapScanner) dns(t time.Time, src string, sport uint16, dst string, dport uint16, msg []byte) {
+	q, err := parseDNSQuestion(msg)
+	if err != nil {
+		return
+	}
+	name := strings.ToLower(strings.TrimSuffix(q.name, "."))
+	if name == "" || strings.HasSuffix(name, ".arpa") {
+		return
+	}
+	s.event(&pcapEvent{
+		time:       t,
+		protocol:   "dns",
+		client:     joinEndpoint(src, sport),
+		server:     joinEndpoint(dst, dport),
+		indicators: []logIndicator{{"host", name}},
+	})
+}
+
+func joinEndpoint(ip string, port uint16) string {
+	if strings.Contains(ip, ":") {
+		return fmt.Sprintf("[%s]:%d", ip, port)
+	}
+	return fmt.Sprintf("%s:%d", ip, port)
+}
+
+// conn adds the requests of a TCP connection
+func (s *pcapScanner) conn(c *tcpConn) {
+	s.report.Streams++
+	client, server := &c.streams[0], &c.streams[1]
+	ca, sa := c.client, c.server
+	if isHTTPRequest(server.data) || len(server.data) > 0 && server.data[0] == 0x16 && !(len(client.data) > 0 && client.data[0] == 0x16) {
+		// the handshake was missed and the first packet came from the server
+		client, server = server, client
+		ca, sa = sa, ca
+	}
+	from, to := ca.String(), sa.String()
+
+	switch {
+	case len(client.data) == 0:
+	case isHTTPRequest(client.data):
+		requests := s.httpRequests(client, from, to)
+		if pcapCarve {
+			s.httpResponses(server, requests, from, to)
+		}
+	case client.data[0] == 0x16:
+		if sni, err := parseSNI(client.data); err == nil && sni != "" {
+			s.event(&pcapEvent{
+				time:       client.timeAt(0),
+				protocol:   "tls",
+				client:     from,
+				server:     to,
+				indicators: []logIndicator{{"host", strings.ToLower(sni)}},
+			})
+		}
+	case sa.Port() == 53:
+		for msg := client.data; len(msg) >= 2; {
+			n := int(binary.BigEndian.Uint16(msg))
+			if len(msg) < 2+n {
+				break
+			}
+			s.dns(client.timeAt(len(client.data)-len(msg)), ca.Addr().String(), ca.Port(), sa.Addr().String(), sa.Port(), msg[2:2+n])
+			msg = msg[2+n:]
+		}
+	}
+}
+
+// httpRequests adds the URLs requested in a stream, and returns the requests
+func (s *pcapScanner) httpRequests(stream *halfStream, client, server string) []*http.Request {
+	var requests []*http.Request
+	r := bytes.NewReader(stream.data)
+	br := bufio.NewReader(r)
+	for {
+		off := len(stream.data) - r.Len() - br.Buffered()
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			break
+		}
+		io.Copy(ioutil.Discard, req.Body)
+		requests = append(requests, req)
+
+		host := req.Host
+		if host == "" {
+			host = strings.TrimSuffix(server, ":80")
+		}
+		indicators := requestIndicators(req.Method, req.RequestURI, host)
+		if len(indicators) == 0 {
+			continue
+		}
+		if pcapCheckHosts && indicators[0].Type == "url" {
+			if h := hostOf(indicators[0].Value); h != "" {
+				indicators = append(indicators, logIndicator{"host", strings.ToLower(h)})
+			}
+		}
+		e := &pcapEvent{
+			time:       stream.timeAt(off),
+			protocol:   "http",
+			client:     client,
+			server:     server,
+			indicators: indicators,
+		}
+		if indicators[0].Type == "url" {
+			e.url = indicators[0].Value
+		}
+		s.event(e)
+	}
+	return requests
+}
+
+// httpResponses adds the hashes of the bodies of the responses to requests
+func (s *pcapScanner) httpResponses(stream *halfStream, requests []*http.Request, client, server string) {
+	r := bytes.NewReader(stream.data)
+	br := bufio.NewReader(r)
+	for _, req := range requests {
+		off := len(stream.data) - r.Len() - br.Buffered()
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			// truncated, the hash would be wrong
+			return
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			continue
+		}
+		if body, err = decodeBody(body, resp.Header.Get("Content-Encoding")); err != nil || len(body) == 0 {
+			continue
+		}
+
+		md5sum, sha256sum := md5.Sum(body), sha256.Sum256(body)
+		e := &pcapEvent{
+			time:     stream.timeAt(off),
+			protocol: "http-body",
+			client:   client,
+			server:   server,
+			size:     len(body),
+			indicators: []logIndicator{
+				{"md5", hex.EncodeToString(md5sum[:])},
+				{"sha256", hex.EncodeToString(sha256sum[:])},
+			},
+		}
+		if req.Method != "CONNECT" {
+			if in := requestIndicators(req.Method, req.RequestURI, req.Host); len(in) > 0 {
+				e.url = in[0].Value
+			}
+		}
+		s.event(e)
+	}
+}
+
+// decodeBody undoes the content encoding of a body
+func decodeBody(body []byte, encoding string) ([]byte, error) {
+	var r io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	case "deflate":
+		r = flate.NewReader(bytes.NewReader(body))
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+	return ioutil.ReadAll(r)
+}
+
+func (e *pcapEvent) match(v verdict) *pcapMatch {
+	m := &pcapMatch{
+		verdict:  v,
+		File:     e.file,
+		Protocol: e.protocol,
+		Client:   e.client,
+		Server:   e.server,
+		URL:      e.url,
+		Size:     e.size,
+	}
+	if !e.time.IsZero() {
+		m.Time = e.time.UTC().Format(time.RFC3339Nano)
+	}
+	return m
+}
+
+func (r *pcapReport) records() []interface{} {
+	records := make([]interface{}, len(r.Matches))
+	for i, v := range r.Matches {
+		records[i] = v
+	}
+	return records
+}
+
+func (r *pcapReport) writeText(w io.Writer) {
+	fmt.Fprintf(w, "Scanned %d packets, %d TCP streams, %d requests, %d indicators, %d matches", r.Packets, r.Streams, r.Requests, r.Indicators, len(r.Matches))
+	if r.Errors > 0 {
+		fmt.Fprintf(w, ", %d lookups failed", r.Errors)
+	}
+	fmt.Fprintln(w)
+
+	for _, m := range r.Matches {
+		fmt.Fprintf(w, "\n%s %s %s -> %s", m.Time, m.Protocol, m.Client, m.Server)
+		if m.URL != "" && m.Type != "url" {
+			fmt.Fprintf(w, " %s", m.URL)
+		}
+		if m.Size > 0 {
+			fmt.Fprintf(w, " (%d bytes)", m.Size)
+		}
+		fmt.Fprintf(w, " in %s\n  %s\n", m.File, m.summary())
+	}
+}
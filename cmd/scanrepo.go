@@ -0,0 +1,470 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	repoFormat       string
+	repoOutput       string
+	repoCheckHosts   bool
+	repoAllFiles     bool
+	repoNoIgnore     bool
+	repoExcludeHosts []string
+	repoMaxSize      int64
+	repoWorkers      int
+	repoFail         bool
+)
+
+// repoFileNames are the names of the build scripts and manifests scanned
+var repoFileNames = map[string]bool{
+	"Dockerfile": true, "Containerfile": true, "Makefile": true, "GNUmakefile": true,
+	"Jenkinsfile": true, "Vagrantfile": true, "Brewfile": true, "PKGBUILD": true,
+	"APKBUILD": true, "CMakeLists.txt": true, "meson.build": true, "BUILD": true,
+	"WORKSPACE": true, "Gemfile": true, "Gemfile.lock": true, "Pipfile": true,
+	"Pipfile.lock": true, "setup.py": true, "setup.cfg": true, "pyproject.toml": true,
+	"poetry.lock": true, "package.json": true, "package-lock.json": true,
+	"npm-shrinkwrap.json": true, "yarn.lock": true, "pnpm-lock.yaml": true,
+	"composer.json": true, "composer.lock": true, "Cargo.toml": true, "Cargo.lock": true,
+	"pom.xml": true, "build.xml": true, "ivy.xml": true, "go.mod": true, "flake.lock": true,
+	".npmrc": true, ".yarnrc": true, ".gitmodules": true, "pip.conf": true,
+}
+
+// repoExtensions are the extensions of the scripts and configurations
+// scanned
+var repoExtensions = map[string]bool{
+	".sh": true, ".bash": true, ".zsh": true, ".ksh": true, ".fish": true,
+	".ps1": true, ".psm1": true, ".psd1": true, ".bat": true, ".cmd": true,
+	".vbs": true, ".py": true, ".rb": true, ".pl": true, ".php": true,
+	".js": true, ".mjs": true, ".cjs": true, ".ts": true, ".lua": true,
+	".yml": true, ".yaml": true, ".dockerfile": true, ".mk": true, ".cmake": true,
+	".gradle": true, ".kts": true, ".tf": true, ".hcl": true, ".toml": true,
+	".nix": true, ".bzl": true, ".spec": true, ".ini": true, ".cfg": true,
+	".conf": true,
+}
+
+// repoFinding is a listed URL or host found in a file of the tree
+type repoFinding struct {
+	verdict
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+	Column    int    `json:"column"`
+	EndColumn int    `json:"end_column"`
+	URL       string `json:"url"`
+	Snippet   string `json:"snippet"`
+}
+
+// repoReport is the outcome of a tree scan
+type repoReport struct {
+	Files      int            `json:"files"`
+	URLs       int            `json:"urls"`
+	Indicators int            `json:"indicators"`
+	Errors     int            `json:"errors"`
+	Findings   []*repoFinding `json:"findings"`
+
+	root string
+}
+
+// repoURL is an URL found in a file
+type repoURL struct {
+	file        string
+	line        int
+	column, end int
+	url         string
+	snippet     string
+	indicators  []logIndicator
+}
+
+// scanRepoCmd represents the scan-repo command
+var scanRepoCmd = &cobra.Command{
+	Use:   "scan-repo [directory]",
+	Short: "Check the URLs of the build scripts and manifests of a source tree",
+	Long: `This command walks a source tree (the current directory by default),
+skipping what .gitignore files exclude, extracts the URLs of scripts,
+Dockerfiles, CI configurations (YAML), package manifests and lock files
+(such as the resolved URLs of package-lock.json and yarn.lock), and checks
+them. With --all-files, every text file is scanned. With --check-hosts,
+the hosts of the URLs are checked as well.
+
+The findings are written as SARIF 2.1.0 by default, to be uploaded as code
+scanning alerts with the file and line of each URL, or as text or JSON.
+With --fail, the command exits with status 3 if anything is listed.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		switch repoFormat {
+		case "sarif", "text", "json":
+		default:
+			log.Fatalf("unknown format %q", repoFormat)
+		}
+		root := "."
+		if len(args) > 0 {
+			root = args[0]
+		}
+		c, err := newChecker()
+		if err != nil {
+			log.Fatal(err)
+		}
+		out, err := newNDJSONLogger(repoOutput)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		report := &repoReport{root: root, Findings: []*repoFinding{}}
+		urls, err := scanRepo(root, report)
+		if err != nil {
+			log.Fatal(err)
+		}
+		report.URLs = len(urls)
+
+		var indicators []logIndicator
+		for _, u := range urls {
+			indicators = append(indicators, u.indicators...)
+		}
+		verdicts, failed := checkAll(c, indicators, repoWorkers)
+		report.Indicators, report.Errors = len(verdicts), len(failed)
+
+		for _, u := range urls {
+			for _, in := range u.indicators {
+				if v := verdicts[in]; v.Listed {
+					report.Findings = append(report.Findings, &repoFinding{
+						verdict:   v,
+						File:      u.file,
+						Line:      u.line,
+						Column:    u.column,
+						EndColumn: u.end,
+						URL:       u.url,
+						Snippet:   u.snippet,
+					})
+				}
+			}
+		}
+
+		if repoFormat == "sarif" {
+			err = out.log(report.sarif())
+		} else {
+			err = writeScanReport(out, repoFormat, report)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if repoFail && len(report.Findings) > 0 {
+			os.Exit(3)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(scanRepoCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// scanRepoCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// scanRepoCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	scanRepoCmd.Flags().StringVarP(&repoFormat, "format", "f", "sarif", "The output format: sarif, text or json")
+	scanRepoCmd.Flags().StringVarP(&repoOutput, "output", "o", "-", "The file the findings are written to")
+	scanRepoCmd.Flags().BoolVar(&repoCheckHosts, "check-hosts", false, "Also check the hosts of the URLs")
+	scanRepoCmd.Flags().BoolVar(&repoAllFiles, "all-files", false, "Scan every text file, not only scripts and manifests")
+	scanRepoCmd.Flags().BoolVar(&repoNoIgnore, "no-ignore", false, "Do not skip the files excluded by .gitignore")
+	scanRepoCmd.Flags().StringSliceVar(&repoExcludeHosts, "exclude-host", nil, "Hosts, with their subdomains, whose URLs are not checked")
+	scanRepoCmd.Flags().Int64Var(&repoMaxSize, "max-size", 10<<20, "The largest file scanned")
+	scanRepoCmd.Flags().IntVar(&repoWorkers, "workers", 8, "The number of concurrent lookups")
+	scanRepoCmd.Flags().BoolVar(&repoFail, "fail", false, "Exit with status 3 if anything is listed")
+	addCheckerFlags(scanRepoCmd)
+}
+
+// scanRepo returns the URLs of the files of a tree
+func scanRepo(root string, report *repoReport) ([]*repoURL, error) {
+	ignore := newGitignore(root)
+	var urls []*repoURL
+	err := filepath.Walk(root, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			log.Print(err)
+			return nil
+		}
+		rel := relPath(root, name)
+		if fi.IsDir() {
+			if fi.Name() == ".git" && rel != "." {
+				return filepath.SkipDir
+			}
+			if rel != "." && !repoNoIgnore && ignore.ignored(rel, true) {
+				return filepath.SkipDir
+			}
+			if rel == "." {
+				rel = ""
+			}
+			ignore.load(rel)
+			return nil
+		}
+		if !fi.Mode().IsRegular() || fi.Size() > repoMaxSize {
+			return nil
+		}
+		if !repoNoIgnore && ignore.ignored(rel, false) {
+			return nil
+		}
+
+		found, err := repoFileURLs(name, rel)
+		if err != nil {
+			log.Printf("%s: %v", name, err)
+			return nil
+		}
+		if found != nil {
+			report.Files++
+			urls = append(urls, found...)
+		}
+		return nil
+	})
+	return urls, err
+}
+
+// isRepoScript tells whether a file is a build script, a manifest or a
+// configuration to scan
+func isRepoScript(rel string, head []byte) bool {
+	base := path.Base(rel)
+	lower := strings.ToLower(base)
+	switch {
+	case repoFileNames[base], repoExtensions[strings.ToLower(path.Ext(base))]:
+		return true
+	case strings.HasPrefix(base, "Dockerfile"), strings.HasPrefix(base, "Containerfile"):
+		return true
+	case strings.HasPrefix(lower, "requirements") && strings.HasSuffix(lower, ".txt"):
+		return true
+	case strings.HasPrefix(rel, ".github/"), strings.HasPrefix(rel, ".circleci/"):
+		return true
+	case bytes.HasPrefix(head, []byte("#!")):
+		return true
+	}
+	return false
+}
+
+// repoFileURLs returns the URLs of a file if it is one to scan, or nil
+func repoFileURLs(name, rel string) ([]*repoURL, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	head, _ := br.Peek(8000)
+	if bytes.IndexByte(head, 0) >= 0 {
+		// binary
+		return nil, nil
+	}
+	if !repoAllFiles && !isRepoScript(rel, head) {
+		return nil, nil
+	}
+
+	urls := []*repoURL{}
+	for n := 1; ; n++ {
+		line, err := br.ReadString('\n')
+		for _, m := range urlRe.FindAllStringIndex(line, -1) {
+			u := strings.TrimRight(line[m[0]:m[1]], ".,;:!?*'")
+			if excludedHost(hostOf(u)) {
+				continue
+			}
+			r := &repoURL{
+				file:       rel,
+				line:       n,
+				column:     utf8.RuneCountInString(line[:m[0]]) + 1,
+				url:        u,
+				snippet:    repoSnippet(line, m[0], m[1]),
+				indicators: []logIndicator{{"url", u}},
+			}
+			r.end = r.column + utf8.RuneCountInString(u)
+			if repoCheckHosts {
+				if h := hostOf(u); h != "" {
+					r.indicators = append(r.indicators, logIndicator{"host", strings.ToLower(h)})
+				}
+			}
+			urls = append(urls, r)
+		}
+		if err == io.EOF {
+			return urls, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// repoSnippet returns the line of an URL, or the part around the URL if
+// the line is long such as in minified files
+func repoSnippet(line string, start, end int) string {
+	if len(line) <= 200 {
+		return strings.TrimSpace(line)
+	}
+	if start -= 40; start < 0 {
+		start = 0
+	}
+	if end += 40; end > len(line) {
+		end = len(line)
+	}
+	return strings.ToValidUTF8(strings.TrimSpace(line[start:end]), "")
+}
+
+func excludedHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range repoExcludeHosts {
+		h = strings.ToLower(h)
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// sarif rules of the findings
+var repoRules = []map[string]interface{}{
+	{
+		"id":               "URLHAUS001",
+		"name":             "ListedURL",
+		"shortDescription": map[string]string{"text": "URL listed on URLhaus"},
+		"fullDescription":  map[string]string{"text": "The URL is listed on URLhaus as distributing malware."},
+		"helpUri":          "https://urlhaus.abuse.ch/",
+		"help":             map[string]string{"text": "Remove the URL or replace it with a trusted source, and check whether the malware it served was downloaded."},
+		"properties":       map[string]interface{}{"tags": []string{"security", "malware"}, "security-severity": "9.0"},
+	},
+	{
+		"id":               "URLHAUS002",
+		"name":             "ListedHost",
+		"shortDescription": map[string]string{"text": "Host listed on URLhaus"},
+		"fullDescription":  map[string]string{"text": "The host of the URL served malware URLs listed on URLhaus."},
+		"helpUri":          "https://urlhaus.abuse.ch/",
+		"help":             map[string]string{"text": "Check that the URL is trusted, since the host distributed malware."},
+		"properties":       map[string]interface{}{"tags": []string{"security", "malware"}, "security-severity": "7.0"},
+	},
+}
+
+// sarif returns the findings as a SARIF 2.1.0 log
+func (r *repoReport) sarif() map[string]interface{} {
+	results := []map[string]interface{}{}
+	for _, f := range r.Findings {
+		rule, level := 0, "error"
+		message := "URL " + f.URL + " is listed on URLhaus"
+		if f.Type == "host" {
+			rule, level = 1, "warning"
+			message = "Host " + f.Indicator + " of URL " + f.URL + " is listed on URLhaus"
+		} else if f.Status != "online" {
+			level = "warning"
+		}
+		var details []string
+		for _, d := range []string{f.Threat, f.Status, f.Signature} {
+			if d != "" {
+				details = append(details, d)
+			}
+		}
+		if len(f.Tags) > 0 {
+			details = append(details, "tags: "+strings.Join(f.Tags, ","))
+		}
+		if len(details) > 0 {
+			message += " (" + strings.Join(details, ", ") + ")"
+		}
+		message += ": " + f.Reference
+
+		fingerprint := sha256.Sum256([]byte(f.File + "\x00" + f.Indicator + "\x00" + f.Snippet))
+		results = append(results, map[string]interface{}{
+			"ruleId":    repoRules[rule]["id"],
+			"ruleIndex": rule,
+			"level":     level,
+			"message":   map[string]string{"text": message},
+			"locations": []interface{}{map[string]interface{}{
+				"physicalLocation": map[string]interface{}{
+					"artifactLocation": map[string]string{"uri": f.File, "uriBaseId": "SRCROOT"},
+					"region": map[string]interface{}{
+						"startLine":   f.Line,
+						"startColumn": f.Column,
+						"endColumn":   f.EndColumn,
+						"snippet":     map[string]string{"text": f.Snippet},
+					},
+				},
+			}},
+			"partialFingerprints": map[string]string{"urlhausFinding/v1": hex.EncodeToString(fingerprint[:16])},
+			"properties": map[string]interface{}{
+				"indicator":         f.Indicator,
+				"urlhaus_reference": f.Reference,
+				"tags":              f.Tags,
+			},
+		})
+	}
+
+	run := map[string]interface{}{
+		"tool": map[string]interface{}{"driver": map[string]interface{}{
+			"name":           "urlhaus-cli",
+			"informationUri": "https://urlhaus.abuse.ch/",
+			"rules":          repoRules,
+		}},
+		"columnKind": "unicodeCodePoints",
+		"results":    results,
+	}
+	if abs, err := filepath.Abs(r.root); err == nil {
+		run["originalUriBaseIds"] = map[string]interface{}{
+			"SRCROOT": map[string]string{"uri": "file://" + filepath.ToSlash(abs) + "/"},
+		}
+	}
+	return map[string]interface{}{
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"version": "2.1.0",
+		"runs":    []interface{}{run},
+	}
+}
+
+func (r *repoReport) records() []interface{} {
+	records := make([]interface{}, len(r.Findings))
+	for i, v := range r.Findings {
+		records[i] = v
+	}
+	return records
+}
+
+func (r *repoReport) writeText(w io.Writer) {
+	fmt.Fprintf(w, "Scanned %d files, %d URLs, %d indicators, %d findings", r.Files, r.URLs, r.Indicators, len(r.Findings))
+	if r.Errors > 0 {
+		fmt.Fprintf(w, ", %d lookups failed", r.Errors)
+	}
+	fmt.Fprintln(w)
+
+	sort.SliceStable(r.Findings, func(i, j int) bool { return r.Findings[i].File < r.Findings[j].File })
+	for _, f := range r.Findings {
+		fmt.Fprintf(w, "\n%s:%d:%d: %s\n", f.File, f.Line, f.Column, f.Snippet)
+		fmt.Fprintf(w, "  %s\n", f.summary())
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// newZeekParser returns a parser of Zeek http, dns, ssl and files logs,
+// in the TSV format, whose header it reads, or in JSON
+func newZeekParser() logParser {
+	sep, setSep := "\t", ","
+	var fields []string
+
+	return func(line string) (logRecord, bool) {
+		if strings.HasPrefix(line, "{") {
+			var m map[string]interface{}
+			dec := json.NewDecoder(strings.NewReader(line))
+			dec.UseNumber()
+			if err := dec.Decode(&m); err != nil {
+				return logRecord{}, false
+			}
+			values := map[string]string{}
+			for k, v := range m {
+				switch v := v.(type) {
+				case string:
+					values[k] = v
+				case json.Number:
+					values[k] = v.String()
+				case []interface{}:
+					var s []string
+					for _, x := range v {
+						s = append(s, zeekJSONValue(x))
+					}
+					values[k] = strings.Join(s, ",")
+				}
+			}
+			return zeekRecord(values, ",")
+		}
+
+		if strings.HasPrefix(line, "#") {
+			switch {
+			case strings.HasPrefix(line, "#separator "):
+				sep = zeekUnescape(strings.TrimPrefix(line, "#separator "))
+			case strings.HasPrefix(line, "#set_separator"+sep):
+				setSep = zeekUnescape(strings.TrimPrefix(line, "#set_separator"+sep))
+			case strings.HasPrefix(line, "#fields"+sep):
+				fields = strings.Split(strings.TrimPrefix(line, "#fields"+sep), sep)
+			}
+			return logRecord{}, false
+		}
+		if fields == nil {
+			return logRecord{}, false
+		}
+
+		values := map[string]string{}
+		for i, v := range strings.Split(line, sep) {
+			if i < len(fields) && v != "-" && v != "(empty)" {
+				values[fields[i]] = zeekUnescape(v)
+			}
+		}
+		return zeekRecord(values, setSep)
+	}
+}
+
+func zeekJSONValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
+
+// zeekUnescape decodes the \xHH escapes of Zeek logs
+func zeekUnescape(s string) string {
+	if !strings.Contains(s, `\x`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) && s[i+1] == 'x' {
+			if n, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// zeekRecord returns the record of a Zeek log entry, whichever log it
+// comes from
+func zeekRecord(m map[string]string, setSep string) (logRecord, bool) {
+	rec := logRecord{
+		Time:   parseLogTime(m["ts"], ""),
+		Client: m["id.orig_h"],
+		ID:     m["uid"],
+	}
+	if rec.ID == "" {
+		// files.log before Zeek 5.1
+		rec.ID = strings.Split(m["conn_uids"], setSep)[0]
+	}
+	if rec.ID == "" {
+		rec.ID = m["fuid"]
+	}
+	if rec.Client == "" {
+		rec.Client = strings.Split(m["rx_hosts"], setSep)[0]
+	}
+
+	if uri, ok := m["uri"]; ok {
+		method := m["method"]
+		if method == "" {
+			method = "GET"
+		}
+		rec.Indicators = append(rec.Indicators, requestIndicators(method, uri, m["host"])...)
+	}
+	if q := m["query"]; q != "" {
+		rec.Indicators = append(rec.Indicators, logIndicator{"host", strings.ToLower(strings.TrimSuffix(q, "."))})
+	}
+	if sni := m["server_name"]; sni != "" {
+		rec.Indicators = append(rec.Indicators, logIndicator{"host", strings.ToLower(sni)})
+	}
+	if md5 := m["md5"]; md5 != "" {
+		rec.Indicators = append(rec.Indicators, logIndicator{"md5", strings.ToLower(md5)})
+	}
+	if sha256 := m["sha256"]; sha256 != "" {
+		rec.Indicators = append(rec.Indicators, logIndicator{"sha256", strings.ToLower(sha256)})
+	}
+	return rec, len(rec.Indicators) > 0
+}
+
+// eveEvent holds the fields of Suricata EVE events with indicators
+type eveEvent struct {
+	Timestamp string      `json:"timestamp"`
+	FlowID    json.Number `json:"flow_id"`
+	SrcIP     string      `json:"src_ip"`
+	HTTP      *struct {
+		Hostname string `json:"hostname"`
+		URL      string `json:"url"`
+		Method   string `json:"http_method"`
+		Port     int    `json:"http_port"`
+	} `json:"http"`
+	DNS *struct {
+		RRName  string `json:"rrname"`
+		Queries []struct {
+			RRName string `json:"rrname"`
+		} `json:"queries"`
+	} `json:"dns"`
+	TLS *struct {
+		SNI string `json:"sni"`
+	} `json:"tls"`
+	FileInfo *struct {
+		MD5    string `json:"md5"`
+		SHA256 string `json:"sha256"`
+	} `json:"fileinfo"`
+}
+
+// parseEVE parses the http, dns, tls and fileinfo parts of Suricata EVE
+// events
+func parseEVE(line string) (logRecord, bool) {
+	var ev eveEvent
+	if err := json.Unmarshal([]byte(line), &ev); err != nil {
+		return logRecord{}, false
+	}
+	rec := logRecord{Client: ev.SrcIP, ID: ev.FlowID.String()}
+	rec.Time, _ = time.Parse("2006-01-02T15:04:05.999999-0700", ev.Timestamp)
+
+	if h := ev.HTTP; h != nil && h.URL != "" {
+		host := h.Hostname
+		if h.Port != 0 && h.Port != 80 && host != "" {
+			host += ":" + strconv.Itoa(h.Port)
+		}
+		method := h.Method
+		if method == "" {
+			method = "GET"
+		}
+		rec.Indicators = append(rec.Indicators, requestIndicators(method, h.URL, host)...)
+	}
+	if d := ev.DNS; d != nil {
+		names := []string{d.RRName}
+		for _, q := range d.Queries {
+			names = append(names, q.RRName)
+		}
+		for _, name := range appendUnique(nil, names...) {
+			rec.Indicators = append(rec.Indicators, logIndicator{"host", strings.ToLower(strings.TrimSuffix(name, "."))})
+		}
+	}
+	if t := ev.TLS; t != nil && t.SNI != "" {
+		rec.Indicators = append(rec.Indicators, logIndicator{"host", strings.ToLower(t.SNI)})
+	}
+	if f := ev.FileInfo; f != nil {
+		if f.MD5 != "" {
+			rec.Indicators = append(rec.Indicators, logIndicator{"md5", strings.ToLower(f.MD5)})
+		}
+		if f.SHA256 != "" {
+			rec.Indicators = append(rec.Indicators, logIndicator{"sha256", strings.ToLower(f.SHA256)})
+		}
+	}
+	return rec, len(rec.Indicators) > 0
+}
@@ -0,0 +1,150 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestZeekParser(t *testing.T) {
+	tests := []struct {
+		name       string
+		lines      []string
+		client, id string
+		indicators []logIndicator
+	}{
+		{
+			"http TSV",
+			[]string{
+				`#separator \x09`,
+				"#set_separator\t,",
+				"#fields\tts\tuid\tid.orig_h\tmethod\thost\turi",
+				"1704189600.000000\tC1\t10.0.0.1\tGET\tevil.example\t/a\\x20b",
+			},
+			"10.0.0.1", "C1", []logIndicator{{"url", "http://evil.example/a b"}},
+		},
+		{
+			"dns TSV with a custom separator",
+			[]string{
+				`#separator \x7c`,
+				"#fields|ts|uid|id.orig_h|query",
+				"1704189600.000000|C2|10.0.0.2|Evil.Example.",
+			},
+			"10.0.0.2", "C2", []logIndicator{{"host", "evil.example"}},
+		},
+		{
+			"files TSV before Zeek 5.1",
+			[]string{
+				"#fields\tts\tfuid\trx_hosts\tconn_uids\tmd5\tsha256",
+				"1704189600.000000\tF1\t10.0.0.3,10.0.0.4\tC3,C4\t-\tABCD",
+			},
+			"10.0.0.3", "C3", []logIndicator{{"sha256", "abcd"}},
+		},
+		{
+			"ssl JSON",
+			[]string{`{"ts":1704189600.5,"uid":"C5","id.orig_h":"10.0.0.5","server_name":"Evil.Example"}`},
+			"10.0.0.5", "C5", []logIndicator{{"host", "evil.example"}},
+		},
+		{
+			"files JSON",
+			[]string{`{"ts":1704189600,"fuid":"F6","rx_hosts":["10.0.0.6"],"md5":"EF"}`},
+			"10.0.0.6", "F6", []logIndicator{{"md5", "ef"}},
+		},
+	}
+	for _, tt := range tests {
+		parse := newZeekParser()
+		var rec logRecord
+		var ok bool
+		for _, line := range tt.lines {
+			rec, ok = parse(line)
+		}
+		if !ok {
+			t.Errorf("%s: not parsed", tt.name)
+			continue
+		}
+		if rec.Client != tt.client || rec.ID != tt.id || !reflect.DeepEqual(rec.Indicators, tt.indicators) {
+			t.Errorf("%s: got %s %s %v", tt.name, rec.Client, rec.ID, rec.Indicators)
+		}
+		if rec.Time.IsZero() {
+			t.Errorf("%s: no time", tt.name)
+		}
+	}
+
+	parse := newZeekParser()
+	for _, line := range []string{"1704189600.000000\tC1\t10.0.0.1", "#close\t2024-01-02-10-00-00", "{broken"} {
+		if _, ok := parse(line); ok {
+			t.Errorf("%q parsed", line)
+		}
+	}
+}
+
+func TestParseEVE(t *testing.T) {
+	tests := []struct {
+		name       string
+		line       string
+		indicators []logIndicator
+	}{
+		{
+			"http",
+			`{"http":{"hostname":"evil.example","url":"/x","http_method":"POST","http_port":8080}}`,
+			[]logIndicator{{"url", "http://evil.example:8080/x"}},
+		},
+		{
+			"dns query",
+			`{"dns":{"type":"query","rrname":"Evil.Example"}}`,
+			[]logIndicator{{"host", "evil.example"}},
+		},
+		{
+			"dns answer in the version 3 format",
+			`{"dns":{"version":3,"type":"response","queries":[{"rrname":"evil.example"}]}}`,
+			[]logIndicator{{"host", "evil.example"}},
+		},
+		{
+			"tls",
+			`{"tls":{"sni":"Evil.Example"}}`,
+			[]logIndicator{{"host", "evil.example"}},
+		},
+		{
+			"fileinfo",
+			`{"fileinfo":{"md5":"AB","sha256":"CD"}}`,
+			[]logIndicator{{"md5", "ab"}, {"sha256", "cd"}},
+		},
+	}
+	const common = `"timestamp":"2024-01-02T10:00:00.123456+0000","flow_id":1234,"src_ip":"10.0.0.1",`
+	for _, tt := range tests {
+		rec, ok := parseEVE("{" + common + strings.TrimPrefix(tt.line, "{"))
+		if !ok {
+			t.Errorf("%s: not parsed", tt.name)
+			continue
+		}
+		if rec.Client != "10.0.0.1" || rec.ID != "1234" || rec.Time.IsZero() || !reflect.DeepEqual(rec.Indicators, tt.indicators) {
+			t.Errorf("%s: got %s %s %v %v", tt.name, rec.Client, rec.ID, rec.Time, rec.Indicators)
+		}
+	}
+
+	for _, line := range []string{`{"event_type":"flow"}`, `{"http":{"hostname":"evil.example"}}`, "{broken"} {
+		if _, ok := parseEVE(line); ok {
+			t.Errorf("%q parsed", line)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	serveListen          string
+	serveRate            float64
+	serveBurst           int
+	serveClientHeader    string
+	serveBlockHosts      bool
+	serveShutdownTimeout time.Duration
+)
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run an HTTP verdict endpoint for nginx auth_request and Envoy",
+	Long: `This command runs an HTTP service answering whether an URL, a host or a
+payload is listed on URLhaus:
+
+  GET /check?url=...      GET /check?host=...
+  GET /check?md5=...      GET /check?sha256=...
+
+The response is 403 with the verdict as JSON when listed, 200 otherwise,
+and carries the X-URLhaus-Verdict (listed or clean) and, when listed, the
+X-URLhaus-Reference headers. Without parameters, the URL is taken from the
+X-Original-URL header, or rebuilt from the Host header and the path after
+/check/ as sent by Envoy's ext_authz, e.g. for nginx:
+
+  location = /urlhaus {
+      internal;
+      proxy_pass http://127.0.0.1:8080/check;
+      proxy_set_header X-Original-URL $scheme://$host$request_uri;
+  }
+
+Clients are rate limited by address, or by the --client-header header when
+behind a proxy. /healthz tells whether the service is up and /readyz
+whether it accepts requests; it fails while shutting down.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newChecker()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		s := &verdictServer{checker: c, limiter: newRateLimiter(serveRate, serveBurst)}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/check", s.check)
+		mux.HandleFunc("/check/", s.check)
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok\n"))
+		})
+		mux.HandleFunc("/readyz", s.ready)
+
+		srv := &http.Server{Addr: serveListen, Handler: mux}
+		serveGracefully(srv, serveShutdownTimeout, func() { atomic.StoreInt32(&s.stopping, 1) })
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// serveCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// serveCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	serveCmd.Flags().StringVarP(&serveListen, "listen", "l", "127.0.0.1:8080", "The address to listen on")
+	serveCmd.Flags().Float64Var(&serveRate, "rate", 0, "The requests per second allowed per client (0 for no limit)")
+	serveCmd.Flags().IntVar(&serveBurst, "burst", 20, "The requests a client may send at once")
+	serveCmd.Flags().StringVar(&serveClientHeader, "client-header", "", "The header identifying clients, e.g. X-Real-IP")
+	serveCmd.Flags().BoolVar(&serveBlockHosts, "block-hosts", false, "Also deny URLs whose host is listed")
+	serveCmd.Flags().DurationVar(&serveShutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait for requests in flight on shutdown")
+	addCheckerFlags(serveCmd)
+}
+
+// serveGracefully runs an HTTP server until SIGINT or SIGTERM, then stops
+// accepting connections and waits up to timeout for the requests in flight.
+func serveGracefully(srv *http.Server, timeout time.Duration, stopping func()) {
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Print("shutting down")
+		if stopping != nil {
+			stopping()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Print(err)
+		}
+		close(done)
+	}()
+
+	log.Printf("listening on %s", srv.Addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+}
+
+type verdictServer struct {
+	checker  *checker
+	limiter  *rateLimiter
+	stopping int32
+}
+
+// clientID identifies the client of a request for rate limiting
+func clientID(r *http.Request, header string) string {
+	if header != "" {
+		if v := r.Header.Get(header); v != "" {
+			return strings.TrimSpace(strings.Split(v, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimited answers 429 when the client went over its rate limit
+func rateLimited(w http.ResponseWriter, r *http.Request, limiter *rateLimiter, header string) bool {
+	ok, wait := limiter.allow(clientID(r, header))
+	if ok {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "rate limit exceeded"})
+	return true
+}
+
+func (s *verdictServer) ready(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.stopping) != 0 {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func (s *verdictServer) check(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, s.limiter, serveClientHeader) {
+		return
+	}
+
+	typ, indicator := "", ""
+	q := r.URL.Query()
+	for _, t := range []string{"url", "host", "md5", "sha256"} {
+		if v := q.Get(t); v != "" {
+			typ, indicator = t, v
+			break
+		}
+	}
+	if typ == "" {
+		typ = "url"
+		if indicator = r.Header.Get("X-Original-URL"); indicator == "" && strings.HasPrefix(r.URL.Path, "/check/") {
+			scheme := r.Header.Get("X-Forwarded-Proto")
+			if scheme == "" {
+				scheme = "http"
+			}
+			indicator = scheme + "://" + r.Host + strings.TrimPrefix(r.URL.RequestURI(), "/check")
+		}
+	}
+	if indicator == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "one of url, host, md5 or sha256 is required"})
+		return
+	}
+	if typ == "host" {
+		indicator = strings.ToLower(indicator)
+	}
+
+	v, err := s.checker.check(typ, indicator)
+	if err == nil && typ == "url" && !v.Listed && serveBlockHosts {
+		v, err = s.checker.check("host", hostOf(indicator))
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+
+	status := http.StatusOK
+	w.Header().Set("X-URLhaus-Verdict", "clean")
+	if v.Listed {
+		status = http.StatusForbidden
+		w.Header().Set("X-URLhaus-Verdict", "listed")
+		w.Header().Set("X-URLhaus-Reference", v.Reference)
+	}
+	writeJSON(w, status, v)
+}
+
+// writeJSON sends a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,467 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	siemFormat         string
+	siemVendor         string
+	siemProduct        string
+	siemProductVersion string
+	siemSeverity       map[string]int
+	siemVTThreshold    float64
+)
+
+// siemEvent is a single indicator ready to be encoded
+type siemEvent struct {
+	id        string // url or payload
+	name      string
+	severity  int
+	time      time.Time
+	url       *urlEntry
+	payload   *payloadEntry
+	blacklist []string
+}
+
+// siemFormats maps each supported format to its encoder
+var siemFormats = map[string]func(w io.Writer, ev siemEvent) error{
+	"cef":  writeCEF,
+	"leef": writeLEEF,
+	"ocsf": writeOCSF,
+}
+
+// siemSeverityDefaults are the severities the --severity entries override
+var siemSeverityDefaults = map[string]int{
+	"online":      8,
+	"offline":     4,
+	"unknown":     6,
+	"blacklisted": 9,
+	"payload":     6,
+	"virustotal":  9,
+}
+
+// siemCmd represents the siem command
+var siemCmd = &cobra.Command{
+	Use:   "siem",
+	Short: "Export malware URLs and payloads as SIEM events",
+	Long: `This command exports every malware URL and payload as one SIEM event per
+line.
+
+Formats:
+  cef   ArcSight Common Event Format
+  leef  QRadar Log Event Extended Format 2.0
+  ocsf  OCSF Detection Finding (class 2004) JSON objects
+
+The severity (0-10) of an event is the highest of the --severity entries
+that apply to it, the entries not given keeping their defaults:
+  online, offline, unknown  the status of a malware URL
+  blacklisted               an URL whose host is listed on a blacklist
+  payload                   any malware payload
+  virustotal                a payload detected by at least --vt-threshold
+                            percent of the VirusTotal engines`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		write, ok := siemFormats[siemFormat]
+		if !ok {
+			log.Fatalf("unknown SIEM format %q", siemFormat)
+		}
+		// pflag replaces the whole map once the flag is set
+		for name := range siemSeverity {
+			if _, ok := siemSeverityDefaults[name]; !ok {
+				log.Fatalf("unknown severity %q", name)
+			}
+		}
+		for name, sev := range siemSeverityDefaults {
+			if _, ok := siemSeverity[name]; !ok {
+				siemSeverity[name] = sev
+			}
+		}
+
+		results, err := exportResults()
+		if err != nil {
+			log.Fatal(err)
+		}
+		entries, err := exportURLEntries(results)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		w, done, err := exportWriter()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for i := range entries {
+			if err := write(w, urlEvent(&entries[i])); err != nil {
+				log.Fatal(err)
+			}
+		}
+		payloads := collectPayloads(results)
+		for i := range payloads {
+			if err := write(w, payloadEvent(&payloads[i])); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := done(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	exportCmd.AddCommand(siemCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// siemCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// siemCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	siemCmd.Flags().StringVarP(&siemFormat, "format", "f", "cef", "The format of the events")
+	siemCmd.Flags().StringVar(&siemVendor, "vendor", "abuse.ch", "The device vendor of the events")
+	siemCmd.Flags().StringVar(&siemProduct, "product", "URLhaus", "The device product of the events")
+	siemCmd.Flags().StringVar(&siemProductVersion, "product-version", "1", "The device version of the events")
+	siemCmd.Flags().StringToIntVar(&siemSeverity, "severity", siemSeverityDefaults, "The severity of each kind of indicator")
+	siemCmd.Flags().Float64Var(&siemVTThreshold, "vt-threshold", 50, "The VirusTotal detection percentage raising a payload to the virustotal severity")
+}
+
+func urlEvent(e *urlEntry) siemEvent {
+	ev := siemEvent{
+		id:        "url",
+		name:      "Malware URL",
+		url:       e,
+		blacklist: e.listedOn(),
+	}
+	ev.severity = siemSeverity[e.Status]
+	if e.Status == "" {
+		ev.severity = siemSeverity["unknown"]
+	}
+	if len(ev.blacklist) > 0 && siemSeverity["blacklisted"] > ev.severity {
+		ev.severity = siemSeverity["blacklisted"]
+	}
+	ev.time, _ = parseTime(e.DateAdded)
+	return ev
+}
+
+func payloadEvent(p *payloadEntry) siemEvent {
+	ev := siemEvent{
+		id:       "payload",
+		name:     "Malware payload",
+		severity: siemSeverity["payload"],
+		payload:  p,
+	}
+	if p.VirusTotal >= siemVTThreshold && siemSeverity["virustotal"] > ev.severity {
+		ev.severity = siemSeverity["virustotal"]
+	}
+	ev.time, _ = parseTime(p.FirstSeen)
+	return ev
+}
+
+// clampSeverity keeps a severity within 0-10
+func clampSeverity(sev int) int {
+	if sev < 0 {
+		return 0
+	}
+	if sev > 10 {
+		return 10
+	}
+	return sev
+}
+
+// siemFields returns the fields of an event as key/value pairs, using the
+// given names for the URL, host, time and severity.
+func siemFields(ev siemEvent, keys map[string]string) [][2]string {
+	var fields [][2]string
+	add := func(key, value string) {
+		if value == "" {
+			return
+		}
+		if k, ok := keys[key]; ok {
+			key = k
+		}
+		fields = append(fields, [2]string{key, value})
+	}
+
+	if !ev.time.IsZero() {
+		add("time", strconv.FormatInt(ev.time.UnixNano()/int64(time.Millisecond), 10))
+	}
+	if e := ev.url; e != nil {
+		add("url", e.URL)
+		add("host", e.Host)
+		add("status", e.Status)
+		add("threat", e.Threat)
+		add("tags", strings.Join(e.Tags, ","))
+		add("blacklists", strings.Join(ev.blacklist, ","))
+		add("reporter", e.Reporter)
+		add("reference", e.Reference)
+		add("signature", e.Signature)
+		add("md5", e.MD5)
+		add("sha256", e.SHA256)
+	}
+	if p := ev.payload; p != nil {
+		add("md5", p.MD5)
+		add("sha256", p.SHA256)
+		add("fileType", p.FileType)
+		add("signature", p.Signature)
+		add("reference", p.Reference)
+		if p.VirusTotal >= 0 {
+			add("virustotal", strconv.FormatFloat(p.VirusTotal, 'f', -1, 64))
+		}
+	}
+	return fields
+}
+
+// cefHeader escapes a CEF header field
+var cefHeader = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ")
+
+// cefValue escapes a CEF extension value
+var cefValue = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+
+// cefKeys maps fields to CEF dictionary keys; the others become labelled
+// custom strings.
+var cefKeys = map[string]string{
+	"time":       "rt",
+	"url":        "request",
+	"host":       "dhost",
+	"status":     "outcome",
+	"threat":     "cat",
+	"sha256":     "fileHash",
+	"fileType":   "fileType",
+	"virustotal": "cfp1",
+}
+
+func writeCEF(w io.Writer, ev siemEvent) error {
+	var ext []string
+	custom := 0
+	for _, f := range siemFields(ev, cefKeys) {
+		key := f[0]
+		if !cefDictionaryKey(key) {
+			custom++
+			if custom > 6 {
+				key = "" // CEF only has six custom strings
+			} else {
+				ext = append(ext, fmt.Sprintf("cs%dLabel=%s", custom, cefValue.Replace(f[0])))
+				key = fmt.Sprintf("cs%d", custom)
+			}
+		} else if key == "cfp1" {
+			ext = append(ext, "cfp1Label=virusTotalPercent")
+		}
+		if key != "" {
+			ext = append(ext, key+"="+cefValue.Replace(f[1]))
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "CEF:0|%s|%s|%s|%s|%s|%d|%s\n",
+		cefHeader.Replace(siemVendor),
+		cefHeader.Replace(siemProduct),
+		cefHeader.Replace(siemProductVersion),
+		cefHeader.Replace(ev.id),
+		cefHeader.Replace(ev.name),
+		clampSeverity(ev.severity),
+		strings.Join(ext, " "))
+	return err
+}
+
+// cefDictionaryKey reports whether key is a CEF dictionary key
+func cefDictionaryKey(key string) bool {
+	for _, k := range cefKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// leefHeader escapes a LEEF header field
+var leefHeader = strings.NewReplacer(`|`, `\|`, "\r", " ", "\n", " ", "\t", " ")
+
+// leefValue strips the tab delimiter and line breaks from a LEEF value
+var leefValue = strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+
+// leefKeys maps fields to QRadar predefined LEEF keys
+var leefKeys = map[string]string{
+	"time":   "devTime",
+	"threat": "cat",
+}
+
+// leefTimeFormat is the devTime pattern QRadar parses, leefTimeLayout the
+// same in Go's notation
+const (
+	leefTimeFormat = "MMM dd yyyy HH:mm:ss.SSS z"
+	leefTimeLayout = "Jan 02 2006 15:04:05.000 MST"
+)
+
+func writeLEEF(w io.Writer, ev siemEvent) error {
+	attrs := []string{fmt.Sprintf("sev=%d", clampSeverity(ev.severity))}
+	for _, f := range siemFields(ev, leefKeys) {
+		if f[0] == "devTime" {
+			f[1] = ev.time.UTC().Format(leefTimeLayout)
+			attrs = append(attrs, "devTimeFormat="+leefTimeFormat)
+		}
+		attrs = append(attrs, f[0]+"="+leefValue.Replace(f[1]))
+	}
+
+	_, err := fmt.Fprintf(w, "LEEF:2.0|%s|%s|%s|%s|x09|%s\n",
+		leefHeader.Replace(siemVendor),
+		leefHeader.Replace(siemProduct),
+		leefHeader.Replace(siemProductVersion),
+		leefHeader.Replace(ev.id),
+		strings.Join(attrs, "\t"))
+	return err
+}
+
+// ocsfSeverity maps a 0-10 severity to an OCSF severity_id and caption
+func ocsfSeverity(sev int) (int, string) {
+	switch sev = clampSeverity(sev); {
+	case sev == 0:
+		return 1, "Informational"
+	case sev <= 3:
+		return 2, "Low"
+	case sev <= 6:
+		return 3, "Medium"
+	case sev <= 8:
+		return 4, "High"
+	default:
+		return 5, "Critical"
+	}
+}
+
+func writeOCSF(w io.Writer, ev siemEvent) error {
+	sevID, sev := ocsfSeverity(ev.severity)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	var osint []map[string]interface{}
+	indicator := func(typeID int, typ, value string, labels []string, ref string) {
+		if value == "" {
+			return
+		}
+		o := map[string]interface{}{
+			"type_id":     typeID,
+			"type":        typ,
+			"value":       value,
+			"vendor_name": siemVendor,
+		}
+		if len(labels) > 0 {
+			o["labels"] = labels
+		}
+		if ref != "" {
+			o["src_url"] = ref
+		}
+		osint = append(osint, o)
+	}
+
+	info := map[string]interface{}{
+		"title": ev.name,
+		"types": []string{ev.id},
+	}
+	var uid, desc string
+	if e := ev.url; e != nil {
+		uid, desc = e.URL, e.Threat
+		indicator(5, "URL", e.URL, e.Tags, e.Reference)
+		if isIP(e.Host) {
+			indicator(1, "IP Address", e.Host, nil, "")
+		} else {
+			indicator(3, "Hostname", e.Host, nil, "")
+		}
+		if e.Reference != "" {
+			info["src_url"] = e.Reference
+		}
+	}
+	if p := ev.payload; p != nil {
+		uid, desc = p.SHA256, p.Signature
+		if uid == "" {
+			uid = p.MD5
+		}
+		var labels []string
+		if p.Signature != "" {
+			labels = append(labels, p.Signature)
+		}
+		indicator(4, "Hash", p.SHA256, labels, p.Reference)
+		indicator(4, "Hash", p.MD5, labels, p.Reference)
+	}
+	info["uid"] = uid
+	if desc != "" {
+		info["desc"] = desc
+	}
+	if !ev.time.IsZero() {
+		info["first_seen_time"] = ev.time.UnixNano() / int64(time.Millisecond)
+	}
+
+	finding := map[string]interface{}{
+		"category_uid":  2,
+		"category_name": "Findings",
+		"class_uid":     2004,
+		"class_name":    "Detection Finding",
+		"activity_id":   1,
+		"activity_name": "Create",
+		"type_uid":      200401,
+		"type_name":     "Detection Finding: Create",
+		"severity_id":   sevID,
+		"severity":      sev,
+		"status_id":     1,
+		"status":        "New",
+		"time":          now,
+		"finding_info":  info,
+		"osint":         osint,
+		"metadata": map[string]interface{}{
+			"version": "1.1.0",
+			"product": map[string]interface{}{
+				"name":        siemProduct,
+				"vendor_name": siemVendor,
+				"version":     siemProductVersion,
+			},
+		},
+		"unmapped": siemUnmapped(ev),
+	}
+
+	b, err := json.Marshal(finding)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// siemUnmapped keeps the URLhaus fields OCSF has no attribute for
+func siemUnmapped(ev siemEvent) map[string]string {
+	m := map[string]string{}
+	for _, f := range siemFields(ev, nil) {
+		switch f[0] {
+		case "status", "blacklists", "reporter", "fileType", "virustotal", "signature":
+			m[f[0]] = f[1]
+		}
+	}
+	return m
+}
@@ -0,0 +1,322 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	sigmaName       string
+	sigmaMaxValues  int
+	sigmaMatchHosts bool
+	sigmaAuthor     string
+)
+
+// urlNamespace is the RFC 4122 URL namespace the UUIDs of rules and STIX
+// objects are derived in
+var urlNamespace = [16]byte{0x6b, 0xa7, 0xb8, 0x11, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}
+
+// sigmaRule is a single Sigma rule about part of a tag or signature
+type sigmaRule struct {
+	id          string
+	title       string
+	description string
+	references  []string
+	date        string
+	modified    string
+	level       string
+	logsource   string
+	selections  []sigmaSelection
+}
+
+// sigmaSelection lists the values of a field any of which a log must match,
+// or the requests (host, path and query) any of which it must match as a whole
+type sigmaSelection struct {
+	field    string
+	values   []string
+	requests [][3]string
+}
+
+// sigmaCmd represents the sigma command
+var sigmaCmd = &cobra.Command{
+	Use:   "sigma",
+	Short: "Export a tag or signature as Sigma rules",
+	Long: `This command turns the malware URLs of tags and signatures into Sigma
+rules for the proxy and dns log sources. Proxy rules match the host
+(cs-host) together with the path (c-uri) and query (c-uri-query) of each
+URL, and with --match-hosts any request to the hosts; dns rules match the
+queries for the hosts.
+
+Rule IDs are derived from the tag or signature, the log source and the part
+number so that regenerating the rules updates them instead of creating new
+ones. A rule holding more than --max-values values is split into several.
+The rules are high level when any of their URLs is still online, medium
+otherwise.
+
+Tags and signatures looked up with --tag and --signature are named after
+what was looked up; raw responses read with --input are named after
+--name.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		results, err := exportResults()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var rules []sigmaRule
+		for _, r := range results {
+			if !r.ok() || (r.kind != "tag" && r.kind != "signature") {
+				continue
+			}
+			name := r.query
+			if name == "" {
+				name = sigmaName
+			}
+			rules = append(rules, sigmaRules(r.kind, name, r)...)
+		}
+
+		w, done, err := exportWriter()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for i, rule := range rules {
+			if i > 0 {
+				fmt.Fprintln(w, "---")
+			}
+			writeSigmaRule(w, rule)
+		}
+		if err := done(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	exportCmd.AddCommand(sigmaCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// sigmaCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// sigmaCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	sigmaCmd.Flags().StringVar(&sigmaName, "name", "URLhaus", "The name of the tag or signature read with --input")
+	sigmaCmd.Flags().IntVar(&sigmaMaxValues, "max-values", 200, "The maximum number of values in a rule")
+	sigmaCmd.Flags().BoolVar(&sigmaMatchHosts, "match-hosts", false, "Also match the hosts of the URLs in proxy rules")
+	sigmaCmd.Flags().StringVar(&sigmaAuthor, "author", "urlhaus-cli", "The author of the rules")
+}
+
+// sigmaRules builds the proxy and dns rules of a tag or signature result
+func sigmaRules(kind, name string, r result) []sigmaRule {
+	entries := r.urls()
+	page := "https://urlhaus.abuse.ch/browse/" + kind + "/" + url.PathEscape(name) + "/"
+
+	var rules []sigmaRule
+	for _, logsource := range []string{"proxy", "dns"} {
+		// the values matched in this log source, and the URLs behind them
+		var values []string
+		var sources [][]urlEntry
+		index := map[string]int{}
+		addValue := func(v string, e urlEntry) {
+			if i, ok := index[v]; ok {
+				sources[i] = append(sources[i], e)
+				return
+			}
+			index[v] = len(values)
+			values = append(values, v)
+			sources = append(sources, []urlEntry{e})
+		}
+		for _, e := range entries {
+			if logsource == "proxy" {
+				if u, err := url.Parse(e.URL); err == nil && u.Hostname() != "" {
+					path := u.EscapedPath()
+					if path == "" {
+						path = "/"
+					}
+					addValue("request\x00"+u.Hostname()+"\x00"+path+"\x00"+u.RawQuery, e)
+				}
+				if sigmaMatchHosts && e.Host != "" {
+					addValue("cs-host\x00"+e.Host, e)
+				}
+			} else if e.Host != "" && !isIP(e.Host) {
+				addValue("query\x00"+e.Host, e)
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+
+		max := sigmaMaxValues
+		if max <= 0 {
+			max = len(values)
+		}
+		parts := (len(values) + max - 1) / max
+		for part := 0; part < parts; part++ {
+			lo, hi := part*max, (part+1)*max
+			if hi > len(values) {
+				hi = len(values)
+			}
+
+			title := fmt.Sprintf("URLhaus %s %s malware URLs in %s logs", kind, name, logsource)
+			if parts > 1 {
+				title += fmt.Sprintf(" (part %d of %d)", part+1, parts)
+			}
+			description := fmt.Sprintf("Detects requests to malware URLs that URLhaus associates with the %s %s.", kind, name)
+			if logsource == "dns" {
+				description = fmt.Sprintf("Detects DNS queries for hosts serving malware URLs that URLhaus associates with the %s %s.", kind, name)
+			}
+			rule := sigmaRule{
+				id:          uuid5(urlNamespace, fmt.Sprintf("%s#%s/%d", page, logsource, part+1)),
+				title:       title,
+				description: description,
+				references:  []string{page},
+				level:       "medium",
+				logsource:   logsource,
+			}
+
+			fields := map[string][]string{}
+			var order []string
+			for i := lo; i < hi; i++ {
+				kv := strings.SplitN(values[i], "\x00", 2)
+				if _, ok := fields[kv[0]]; !ok {
+					order = append(order, kv[0])
+				}
+				fields[kv[0]] = append(fields[kv[0]], kv[1])
+
+				for _, e := range sources[i] {
+					rule.references = appendUnique(rule.references, e.Reference)
+					if e.Status == "online" {
+						rule.level = "high"
+					}
+					if t, ok := parseTime(e.DateAdded); ok {
+						d := t.Format("2006-01-02")
+						if rule.date == "" || d < rule.date {
+							rule.date = d
+						}
+						if d > rule.modified {
+							rule.modified = d
+						}
+					}
+				}
+			}
+			for _, f := range order {
+				if f != "request" {
+					rule.selections = append(rule.selections, sigmaSelection{field: f, values: fields[f]})
+					continue
+				}
+				sel := sigmaSelection{field: f}
+				for _, v := range fields[f] {
+					var r [3]string
+					copy(r[:], strings.SplitN(v, "\x00", 3))
+					sel.requests = append(sel.requests, r)
+				}
+				rule.selections = append(rule.selections, sel)
+			}
+			if rule.date == "" {
+				rule.date = time.Now().UTC().Format("2006-01-02")
+			}
+			if rule.modified == rule.date {
+				rule.modified = ""
+			}
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// uuid5 returns the RFC 4122 name-based (SHA-1) UUID of a name
+func uuid5(namespace [16]byte, name string) string {
+	h := sha1.New()
+	h.Write(namespace[:])
+	h.Write([]byte(name))
+	var u [16]byte
+	copy(u[:], h.Sum(nil))
+	u[6] = (u[6] & 0x0f) | 0x50
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// yamlQuote single-quotes a YAML scalar
+func yamlQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// sigmaEscape escapes the Sigma wildcards so that a value matches literally
+var sigmaEscape = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`)
+
+func writeSigmaRule(w io.Writer, r sigmaRule) {
+	fmt.Fprintf(w, "title: %s\n", yamlQuote(r.title))
+	fmt.Fprintf(w, "id: %s\n", r.id)
+	fmt.Fprintln(w, "status: experimental")
+	fmt.Fprintf(w, "description: %s\n", yamlQuote(r.description))
+	fmt.Fprintln(w, "references:")
+	for _, ref := range r.references {
+		fmt.Fprintf(w, "    - %s\n", yamlQuote(ref))
+	}
+	fmt.Fprintf(w, "author: %s\n", yamlQuote(sigmaAuthor))
+	fmt.Fprintf(w, "date: %s\n", r.date)
+	if r.modified != "" {
+		fmt.Fprintf(w, "modified: %s\n", r.modified)
+	}
+	fmt.Fprintln(w, "tags:")
+	fmt.Fprintln(w, "    - attack.command-and-control")
+	fmt.Fprintln(w, "    - attack.t1105")
+	fmt.Fprintln(w, "logsource:")
+	fmt.Fprintf(w, "    category: %s\n", r.logsource)
+	fmt.Fprintln(w, "detection:")
+	var names []string
+	for _, sel := range r.selections {
+		name := "selection_" + strings.Replace(sel.field, "-", "_", -1)
+		names = append(names, name)
+		fmt.Fprintf(w, "    %s:\n", name)
+		for _, r := range sel.requests {
+			fmt.Fprintf(w, "        - cs-host: %s\n", yamlQuote(sigmaEscape.Replace(r[0])))
+			fmt.Fprintf(w, "          c-uri: %s\n", yamlQuote(sigmaEscape.Replace(r[1])))
+			if r[2] != "" {
+				fmt.Fprintf(w, "          c-uri-query: %s\n", yamlQuote(sigmaEscape.Replace(r[2])))
+			}
+		}
+		if len(sel.values) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "        %s:\n", sel.field)
+		for _, v := range sel.values {
+			fmt.Fprintf(w, "            - %s\n", yamlQuote(sigmaEscape.Replace(v)))
+		}
+	}
+	fmt.Fprintf(w, "    condition: %s\n", strings.Join(names, " or "))
+	fmt.Fprintln(w, "falsepositives:")
+	fmt.Fprintln(w, "    - Legitimate content hosted on shared hosting or file sharing services")
+	fmt.Fprintf(w, "level: %s\n", r.level)
+}
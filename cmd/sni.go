@@ -0,0 +1,151 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var errNoSNI = errors.New("no server name in TLS ClientHello")
+
+// maxClientHello is the most readClientHello reads
+const maxClientHello = 64 << 10
+
+// readClientHello reads the TLS records of the ClientHello starting a
+// stream, which may span several records. It returns the bytes read, to be
+// forwarded as they are, and the ClientHello as a single record for
+// parseSNI.
+func readClientHello(r io.Reader) (raw, record []byte, err error) {
+	var hello []byte
+	for {
+		header := make([]byte, 5)
+		n, err := io.ReadFull(r, header)
+		raw = append(raw, header[:n]...)
+		if err != nil {
+			return raw, nil, err
+		}
+		if header[0] != 0x16 {
+			return raw, nil, errors.New("not a TLS handshake")
+		}
+
+		size := int(binary.BigEndian.Uint16(header[3:]))
+		if len(raw)+size > maxClientHello {
+			return raw, nil, errors.New("TLS ClientHello too large")
+		}
+		body := make([]byte, size)
+		n, err = io.ReadFull(r, body)
+		raw = append(raw, body[:n]...)
+		if err != nil {
+			return raw, nil, err
+		}
+		hello = append(hello, body...)
+
+		if len(hello) < 4 {
+			continue
+		}
+		if hello[0] != 0x01 {
+			return raw, nil, errors.New("not a TLS ClientHello")
+		}
+		size = 4 + (int(hello[1])<<16 | int(hello[2])<<8 | int(hello[3]))
+		if len(hello) >= size {
+			record = append([]byte{0x16, header[1], header[2], 0, 0}, hello[:size]...)
+			binary.BigEndian.PutUint16(record[3:], uint16(size))
+			return raw, record, nil
+		}
+	}
+}
+
+// parseSNI returns the server name of a TLS record holding a ClientHello
+func parseSNI(record []byte) (string, error) {
+	// record header: content type, version, length
+	if len(record) < 5 || record[0] != 0x16 {
+		return "", errors.New("not a TLS handshake")
+	}
+	b := record[5:]
+
+	// handshake header: type, 24 bit length
+	if len(b) < 4 || b[0] != 0x01 {
+		return "", errors.New("not a TLS ClientHello")
+	}
+	b = b[4:]
+
+	// version and random
+	if len(b) < 34 {
+		return "", errNoSNI
+	}
+	b = b[34:]
+
+	// session ID, cipher suites and compression methods
+	for _, size := range []int{1, 2, 1} {
+		if len(b) < size {
+			return "", errNoSNI
+		}
+		n := int(b[0])
+		if size == 2 {
+			n = int(binary.BigEndian.Uint16(b))
+		}
+		if len(b) < size+n {
+			return "", errNoSNI
+		}
+		b = b[size+n:]
+	}
+
+	if len(b) < 2 {
+		return "", errNoSNI
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) > n {
+		b = b[:n]
+	}
+
+	for len(b) >= 4 {
+		typ := binary.BigEndian.Uint16(b)
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+n {
+			break
+		}
+		ext := b[4 : 4+n]
+		b = b[4+n:]
+		if typ != 0 { // server_name
+			continue
+		}
+
+		if len(ext) < 2 {
+			break
+		}
+		ext = ext[2:]
+		for len(ext) >= 3 {
+			nameType := ext[0]
+			n := int(binary.BigEndian.Uint16(ext[1:]))
+			if len(ext) < 3+n {
+				break
+			}
+			if nameType == 0 { // host_name
+				return string(ext[3 : 3+n]), nil
+			}
+			ext = ext[3+n:]
+		}
+	}
+	return "", errNoSNI
+}
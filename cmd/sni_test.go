@@ -0,0 +1,218 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// captureClientHello returns the records of the ClientHello crypto/tls
+// sends for a server name
+func captureClientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		client.Close()
+	}()
+	raw, _, err := readClientHello(server)
+	server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// buildClientHello returns a ClientHello handshake message with a
+// server_name extension after a padding extension of the given size
+func buildClientHello(serverName string, padding int) []byte {
+	body := []byte{3, 3}
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 0)                   // session ID
+	body = append(body, 0, 2, 0x13, 0x01)    // cipher suites
+	body = append(body, 1, 0)                // compression methods
+
+	var ext []byte
+	ext = append(ext, 0, 21, byte(padding>>8), byte(padding))
+	ext = append(ext, make([]byte, padding)...)
+	name := []byte(serverName)
+	list := append([]byte{0, byte(len(name) >> 8), byte(len(name))}, name...)
+	ext = append(ext, 0, 0, byte((len(list)+2)>>8), byte(len(list)+2), byte(len(list)>>8), byte(len(list)))
+	ext = append(ext, list...)
+
+	body = append(body, byte(len(ext)>>8), byte(len(ext)))
+	body = append(body, ext...)
+	return append([]byte{1, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+// tlsRecords splits a handshake message into records of at most size bytes
+func tlsRecords(msg []byte, size int) []byte {
+	var b []byte
+	for len(msg) > 0 {
+		n := size
+		if n > len(msg) {
+			n = len(msg)
+		}
+		b = append(b, 0x16, 3, 1, byte(n>>8), byte(n))
+		b = append(b, msg[:n]...)
+		msg = msg[n:]
+	}
+	return b
+}
+
+func TestReadClientHello(t *testing.T) {
+	real := captureClientHello(t, "Evil.Example")
+	hello := buildClientHello("padded.example", 6000)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		sni   string
+		sniOK bool
+		err   bool
+	}{
+		{"crypto/tls", real, "Evil.Example", true, false},
+		{"crypto/tls in small records", tlsRecords(real[5:], 50), "Evil.Example", true, false},
+		{"larger than 4KB", tlsRecords(hello, 16384), "padded.example", true, false},
+		{"larger than 4KB in records", tlsRecords(hello, 1000), "padded.example", true, false},
+		{"IP address", captureClientHello(t, "127.0.0.1"), "", false, false},
+		{"not TLS", []byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"), "", false, true},
+		{"not a ClientHello", tlsRecords([]byte{2, 0, 0, 1, 0}, 100), "", false, true},
+		{"truncated", real[:len(real)-10], "", false, true},
+		{"too large", tlsRecords(buildClientHello("x", 65000), 100), "", false, true},
+	}
+	for _, tt := range tests {
+		// what follows the ClientHello must not be consumed
+		r := bufio.NewReader(bytes.NewReader(append(append([]byte(nil), tt.data...), "next"...)))
+		raw, record, err := readClientHello(r)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !bytes.Equal(raw, tt.data) {
+			t.Errorf("%s: read %d bytes out of %d", tt.name, len(raw), len(tt.data))
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "next" {
+			t.Errorf("%s: left %q", tt.name, rest)
+		}
+		sni, err := parseSNI(record)
+		if (err == nil) != tt.sniOK || sni != tt.sni {
+			t.Errorf("%s: SNI %q, %v", tt.name, sni, err)
+		}
+	}
+}
+
+func TestParseSNI(t *testing.T) {
+	hello := tlsRecords(buildClientHello("a.example", 0), 16384)
+	tests := []struct {
+		name   string
+		record []byte
+		sni    string
+		err    bool
+	}{
+		{"ClientHello", hello, "a.example", false},
+		{"empty", nil, "", true},
+		{"alert", append([]byte{0x15}, hello[1:]...), "", true},
+		{"ServerHello", append(append([]byte(nil), hello[:5]...), append([]byte{2}, hello[6:]...)...), "", true},
+		{"truncated", hello[:60], "", true},
+	}
+	for _, tt := range tests {
+		sni, err := parseSNI(tt.record)
+		if (err != nil) != tt.err || sni != tt.sni {
+			t.Errorf("%s: got %q, %v", tt.name, sni, err)
+		}
+	}
+}
+
+func TestProxyConnectChecksSNIBeforeDialing(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b, _ := ioutil.ReadAll(conn)
+			conn.Close()
+			received <- b
+		}
+	}()
+
+	p := &proxyServer{checker: testChecker(t), log: &ndjsonLogger{w: ioutil.Discard}}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		hello  []byte
+		passed bool
+	}{
+		{"listed", tlsRecords(buildClientHello("bad.example", 5000), 1000), false},
+		{"not listed", tlsRecords(buildClientHello("good.example", 5000), 1000), true},
+	}
+	for _, tt := range tests {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "CONNECT "+l.Addr().String()+" HTTP/1.1\r\nHost: "+l.Addr().String()+"\r\n\r\n")
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: CONNECT %v %v", tt.name, resp, err)
+		}
+		conn.Write(tt.hello)
+		conn.(*net.TCPConn).CloseWrite()
+		ioutil.ReadAll(br)
+		conn.Close()
+
+		select {
+		case b := <-received:
+			if !tt.passed {
+				t.Errorf("%s: the upstream was dialed", tt.name)
+			} else if !bytes.Equal(b, tt.hello) {
+				t.Errorf("%s: the upstream got %d bytes out of %d", tt.name, len(b), len(tt.hello))
+			}
+		case <-time.After(200 * time.Millisecond):
+			if tt.passed {
+				t.Errorf("%s: the upstream was not dialed", tt.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,446 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+// sqliteDB is a read-only SQLite database file, along with the committed
+// pages of its write-ahead log if there is one. Only what is needed to scan
+// tables is supported: no indexes, no WITHOUT ROWID tables.
+type sqliteDB struct {
+	f        *os.File
+	size     int64
+	pageSize int
+	usable   int
+	encoding int
+
+	wal      *os.File
+	walPages map[uint32]int64
+}
+
+// sqliteTable is a table of the schema
+type sqliteTable struct {
+	name    string
+	root    uint32
+	columns []string
+	// rowid is the column aliasing the rowid, or -1
+	rowid int
+}
+
+var errNotSQLite = errors.New("not a SQLite database")
+
+func openSQLite(name string) (*sqliteDB, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	header := make([]byte, 100)
+	if _, err := io.ReadFull(f, header); err != nil || !bytes.HasPrefix(header, []byte("SQLite format 3\x00")) {
+		f.Close()
+		return nil, errNotSQLite
+	}
+	db := &sqliteDB{f: f, size: fi.Size()}
+	db.pageSize = int(binary.BigEndian.Uint16(header[16:]))
+	if db.pageSize == 1 {
+		db.pageSize = 65536
+	}
+	if db.pageSize < 512 || db.pageSize&(db.pageSize-1) != 0 {
+		f.Close()
+		return nil, errNotSQLite
+	}
+	db.usable = db.pageSize - int(header[20])
+	db.encoding = int(binary.BigEndian.Uint32(header[56:]))
+
+	if err := db.openWAL(name + "-wal"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s-wal: %v", name, err)
+	}
+	return db, nil
+}
+
+// openWAL indexes the pages of the committed transactions of the log
+func (db *sqliteDB) openWAL(name string) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	db.wal = f
+
+	header := make([]byte, 32)
+	if _, err := io.ReadFull(f, header); err != nil {
+		// an empty log
+		return nil
+	}
+	if magic := binary.BigEndian.Uint32(header); magic&^1 != 0x377f0682 {
+		return errors.New("not a SQLite write-ahead log")
+	}
+	if int(binary.BigEndian.Uint32(header[8:])) != db.pageSize {
+		return errors.New("page size mismatch")
+	}
+	salt := header[16:24]
+
+	db.walPages = map[uint32]int64{}
+	pending := map[uint32]int64{}
+	frame := make([]byte, 24)
+	for off := int64(32); ; off += 24 + int64(db.pageSize) {
+		if _, err := f.ReadAt(frame, off); err != nil {
+			break
+		}
+		if !bytes.Equal(frame[8:16], salt) {
+			// left over from a previous checkpoint
+			break
+		}
+		pending[binary.BigEndian.Uint32(frame)] = off + 24
+		if binary.BigEndian.Uint32(frame[4:]) != 0 {
+			// commit frame
+			for n, o := range pending {
+				db.walPages[n] = o
+			}
+			pending = map[uint32]int64{}
+		}
+	}
+	return nil
+}
+
+func (db *sqliteDB) Close() error {
+	if db.wal != nil {
+		db.wal.Close()
+	}
+	return db.f.Close()
+}
+
+// page returns the content of a page, numbered from 1
+func (db *sqliteDB) page(n uint32) ([]byte, error) {
+	b := make([]byte, db.pageSize)
+	if off, ok := db.walPages[n]; ok {
+		_, err := db.wal.ReadAt(b, off)
+		return b, err
+	}
+	off := int64(n-1) * int64(db.pageSize)
+	if n == 0 || off >= db.size {
+		return nil, fmt.Errorf("invalid page %d", n)
+	}
+	_, err := db.f.ReadAt(b, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return b, err
+}
+
+// tables returns the tables of the schema by name
+func (db *sqliteDB) tables() (map[string]*sqliteTable, error) {
+	tables := map[string]*sqliteTable{}
+	master := &sqliteTable{root: 1, columns: []string{"type", "name", "tbl_name", "rootpage", "sql"}, rowid: -1}
+	err := db.scan(master, func(row map[string]interface{}) error {
+		if row["type"] != "table" {
+			return nil
+		}
+		name, _ := row["name"].(string)
+		root, _ := row["rootpage"].(int64)
+		sql, _ := row["sql"].(string)
+		t := parseCreateTable(sql)
+		t.name, t.root = name, uint32(root)
+		tables[strings.ToLower(name)] = t
+		return nil
+	})
+	return tables, err
+}
+
+// parseCreateTable returns the columns of a CREATE TABLE statement
+func parseCreateTable(sql string) *sqliteTable {
+	t := &sqliteTable{rowid: -1}
+	start, end := strings.Index(sql, "("), strings.LastIndex(sql, ")")
+	if start < 0 || end < start {
+		return t
+	}
+
+	var defs []string
+	depth, last := 0, start+1
+	for i := start + 1; i < end; i++ {
+		switch sql[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				defs = append(defs, sql[last:i])
+				last = i + 1
+			}
+		}
+	}
+	defs = append(defs, sql[last:end])
+
+	for _, def := range defs {
+		fields := strings.Fields(def)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PRIMARY", "UNIQUE", "CHECK", "FOREIGN", "CONSTRAINT":
+			continue
+		}
+		name := strings.Trim(fields[0], "\"`[]'")
+		upper := strings.ToUpper(def)
+		if len(fields) > 1 && strings.ToUpper(fields[1]) == "INTEGER" && strings.Contains(upper, "PRIMARY KEY") {
+			t.rowid = len(t.columns)
+		}
+		t.columns = append(t.columns, name)
+	}
+	return t
+}
+
+// scan calls fn with every row of a table, as values by column name:
+// int64, float64, string, []byte or nil
+func (db *sqliteDB) scan(t *sqliteTable, fn func(row map[string]interface{}) error) error {
+	return db.scanPage(t, t.root, 0, fn)
+}
+
+func (db *sqliteDB) scanPage(t *sqliteTable, n uint32, depth int, fn func(map[string]interface{}) error) error {
+	if depth > 64 {
+		return errors.New("b-tree too deep")
+	}
+	b, err := db.page(n)
+	if err != nil {
+		return err
+	}
+	h := b
+	if n == 1 {
+		h = b[100:]
+	}
+	cells := int(binary.BigEndian.Uint16(h[3:]))
+	switch h[0] {
+	case 0x05: // interior
+		ptrs := h[12:]
+		if len(ptrs) < 2*cells {
+			return fmt.Errorf("invalid page %d", n)
+		}
+		for i := 0; i < cells; i++ {
+			off := int(binary.BigEndian.Uint16(ptrs[2*i:]))
+			if off+4 > len(b) {
+				return fmt.Errorf("invalid page %d", n)
+			}
+			if err := db.scanPage(t, binary.BigEndian.Uint32(b[off:]), depth+1, fn); err != nil {
+				return err
+			}
+		}
+		return db.scanPage(t, binary.BigEndian.Uint32(h[8:]), depth+1, fn)
+
+	case 0x0d: // leaf
+		ptrs := h[8:]
+		if len(ptrs) < 2*cells {
+			return fmt.Errorf("invalid page %d", n)
+		}
+		for i := 0; i < cells; i++ {
+			off := int(binary.BigEndian.Uint16(ptrs[2*i:]))
+			if off >= db.usable {
+				return fmt.Errorf("invalid page %d", n)
+			}
+			rowid, payload, err := db.cell(b[off:db.usable])
+			if err != nil {
+				return fmt.Errorf("page %d: %v", n, err)
+			}
+			values, err := db.record(payload)
+			if err != nil {
+				return fmt.Errorf("page %d: %v", n, err)
+			}
+			row := map[string]interface{}{}
+			for i, c := range t.columns {
+				if i < len(values) {
+					row[c] = values[i]
+				}
+			}
+			if t.rowid >= 0 {
+				row[t.columns[t.rowid]] = rowid
+			}
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("page %d is not a table b-tree page", n)
+}
+
+// cell returns the rowid and payload of a table leaf cell, following its
+// overflow pages
+func (db *sqliteDB) cell(b []byte) (int64, []byte, error) {
+	size, n := sqliteVarint(b)
+	b = b[n:]
+	rowid, n := sqliteVarint(b)
+	b = b[n:]
+	if size > 1<<30 {
+		return 0, nil, errors.New("invalid cell")
+	}
+
+	u := db.usable
+	x := u - 35
+	local := int(size)
+	if int(size) > x {
+		m := (u-12)*32/255 - 23
+		k := m + (int(size)-m)%(u-4)
+		local = m
+		if k <= x {
+			local = k
+		}
+	}
+	if int(size) <= x {
+		if len(b) < local {
+			return 0, nil, errors.New("truncated cell")
+		}
+		return int64(rowid), b[:local], nil
+	}
+	if len(b) < local+4 {
+		return 0, nil, errors.New("truncated cell")
+	}
+	payload := append([]byte{}, b[:local]...)
+	next := binary.BigEndian.Uint32(b[local:])
+	for len(payload) < int(size) && next != 0 {
+		page, err := db.page(next)
+		if err != nil {
+			return 0, nil, err
+		}
+		chunk := page[4:u]
+		if rest := int(size) - len(payload); len(chunk) > rest {
+			chunk = chunk[:rest]
+		}
+		payload = append(payload, chunk...)
+		next = binary.BigEndian.Uint32(page)
+	}
+	if len(payload) < int(size) {
+		return 0, nil, errors.New("truncated overflow chain")
+	}
+	return int64(rowid), payload, nil
+}
+
+// record decodes the values of a record
+func (db *sqliteDB) record(b []byte) ([]interface{}, error) {
+	hsize, n := sqliteVarint(b)
+	if hsize > uint64(len(b)) || int(hsize) < n {
+		return nil, errors.New("invalid record")
+	}
+	header, body := b[n:hsize], b[hsize:]
+
+	var values []interface{}
+	for len(header) > 0 {
+		typ, n := sqliteVarint(header)
+		header = header[n:]
+
+		size := 0
+		switch {
+		case typ >= 1 && typ <= 4:
+			size = int(typ)
+		case typ == 5:
+			size = 6
+		case typ == 6 || typ == 7:
+			size = 8
+		case typ == 10 || typ == 11:
+			// reserved for internal use
+			return nil, fmt.Errorf("invalid serial type %d", typ)
+		case typ >= 12:
+			if (typ-12)/2 > uint64(len(body)) {
+				return nil, errors.New("truncated record")
+			}
+			size = int(typ-12) / 2
+		}
+		if len(body) < size {
+			return nil, errors.New("truncated record")
+		}
+		v := body[:size]
+		body = body[size:]
+
+		switch {
+		case typ == 0:
+			values = append(values, nil)
+		case typ <= 6:
+			var i int64
+			for _, c := range v {
+				i = i<<8 | int64(c)
+			}
+			// sign extension
+			if size > 0 && v[0]&0x80 != 0 && size < 8 {
+				i -= 1 << (8 * uint(size))
+			}
+			values = append(values, i)
+		case typ == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(v)))
+		case typ == 8:
+			values = append(values, int64(0))
+		case typ == 9:
+			values = append(values, int64(1))
+		case typ >= 12 && typ%2 == 0:
+			values = append(values, append([]byte{}, v...))
+		case typ >= 13:
+			values = append(values, db.text(v))
+		default:
+			return nil, fmt.Errorf("invalid serial type %d", typ)
+		}
+	}
+	return values, nil
+}
+
+func (db *sqliteDB) text(b []byte) string {
+	if db.encoding != 2 && db.encoding != 3 {
+		return string(b)
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if db.encoding == 3 {
+		order = binary.BigEndian
+	}
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = order.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
+
+// sqliteVarint decodes a SQLite variable length integer
+func sqliteVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 9 && i < len(b); i++ {
+		if i == 8 {
+			return v<<8 | uint64(b[i]), 9
+		}
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return v, len(b)
+}
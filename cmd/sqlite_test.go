@@ -0,0 +1,230 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSQLiteRecord(t *testing.T) {
+	// record returns a record of a header of serial types and a body
+	record := func(types []uint64, body ...byte) []byte {
+		var header []byte
+		for _, typ := range types {
+			header = appendSQLiteVarint(header, typ)
+		}
+		return append(append([]byte{byte(1 + len(header))}, header...), body...)
+	}
+	float := make([]byte, 8)
+	binary.BigEndian.PutUint64(float, math.Float64bits(1.5))
+
+	tests := []struct {
+		name   string
+		record []byte
+		values []interface{}
+		ok     bool
+	}{
+		{"null and constants", record([]uint64{0, 8, 9}), []interface{}{nil, int64(0), int64(1)}, true},
+		{"integers", record([]uint64{1, 2, 5}, 0xff, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00), []interface{}{int64(-1), int64(256), int64(1 << 40)}, true},
+		{"float", record([]uint64{7}, float...), []interface{}{1.5}, true},
+		{"text and blob", record([]uint64{13 + 2*3, 12 + 2*2}, 'a', 'b', 'c', 1, 2), []interface{}{"abc", []byte{1, 2}}, true},
+		{"truncated text", record([]uint64{13 + 2*3}, 'a'), nil, false},
+		{"reserved serial type 10", record([]uint64{10}), nil, false},
+		{"reserved serial type 11", record([]uint64{11}), nil, false},
+		{"serial type over 2^63", record([]uint64{1<<63 + 12}), nil, false},
+		{"largest serial type", record([]uint64{math.MaxUint64}), nil, false},
+		{"header longer than the record", []byte{10, 1}, nil, false},
+	}
+	db := &sqliteDB{encoding: 1}
+	for _, tt := range tests {
+		values, err := db.record(tt.record)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(values, tt.values) {
+			t.Errorf("%s: got %#v", tt.name, values)
+		}
+	}
+}
+
+// appendSQLiteVarint appends a SQLite variable length integer
+func appendSQLiteVarint(b []byte, v uint64) []byte {
+	if v > 1<<56-1 {
+		b = append(b, byte(v>>57)|0x80, byte(v>>50)|0x80, byte(v>>43)|0x80, byte(v>>36)|0x80,
+			byte(v>>29)|0x80, byte(v>>22)|0x80, byte(v>>15)|0x80, byte(v>>8)|0x80)
+		return append(b, byte(v))
+	}
+	var groups []byte
+	for groups = append(groups, byte(v&0x7f)); v > 0x7f; groups = append(groups, byte(v&0x7f)|0x80) {
+		v >>= 7
+	}
+	for i := len(groups) - 1; i >= 0; i-- {
+		b = append(b, groups[i])
+	}
+	return b
+}
+
+// historyEvent is what the tests compare of a browser event
+type historyEvent struct {
+	browser, kind, url, title, time, target, sha256 string
+}
+
+func readTestHistory(t *testing.T, name string) []historyEvent {
+	events, err := readHistory(name)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	var got []historyEvent
+	for _, e := range events {
+		got = append(got, historyEvent{e.Browser, e.Kind, e.URL, e.Title, e.Time, e.Target, e.SHA256})
+	}
+	sort.Slice(got, func(i, j int) bool {
+		if got[i].time != got[j].time {
+			return got[i].time < got[j].time
+		}
+		return got[i].url < got[j].url
+	})
+	return got
+}
+
+// copyHistory copies a database of testdata and its write-ahead log, if
+// wal is set, to a temporary directory
+func copyHistory(t *testing.T, name string, wal bool) string {
+	dir := t.TempDir()
+	files := []string{name}
+	if wal {
+		files = append(files, name+"-wal")
+	}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(filepath.Join("testdata", f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, f), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, name)
+}
+
+func TestReadHistory(t *testing.T) {
+	long := "http://evil.example/" + strings.Repeat("x", 2000)
+	chrome := []historyEvent{
+		{"chrome", "visit", long, "long", "2024-01-02T10:01:40Z", "", ""},
+		{"chrome", "download", "http://evil.example/x.doc", "", "2024-01-02T10:03:20Z", "/home/u/Downloads/x.doc", "6f3e6d992dbf984ca244efa671e3c71e89073c74126fdb372fab7378908f1997"},
+	}
+	firefox := []historyEvent{
+		{"firefox", "visit", "https://example.com/", "example", "2024-01-02T10:00:00Z", "", ""},
+		{"firefox", "visit", "http://evil.example/x.doc", "doc", "2024-01-02T10:01:00Z", "", ""},
+		{"firefox", "download", "http://evil.example/x.doc", "doc", "2024-01-02T10:01:01Z", "file:///home/u/x.doc", ""},
+		{"firefox", "visit", "http://expired.example/", "", "2024-01-02T10:02:00Z", "", ""},
+	}
+
+	got := readTestHistory(t, copyHistory(t, "History", true))
+	// the 40 pages visited first span the b-tree pages of the database
+	if len(got) != 40+len(chrome) {
+		t.Fatalf("History: %d events", len(got))
+	}
+	for i, e := range got[:40] {
+		if e.url != "https://example.com/page"+strconv.Itoa(i+1) || e.kind != "visit" {
+			t.Errorf("History: event %d is %v", i, e)
+		}
+	}
+	if !reflect.DeepEqual(got[40:], chrome) {
+		t.Errorf("History: got %v", got[40:])
+	}
+	if got := readTestHistory(t, copyHistory(t, "History", false)); len(got) != 40 {
+		t.Errorf("History without its log: %d events", len(got))
+	}
+
+	if got := readTestHistory(t, copyHistory(t, "places.sqlite", true)); !reflect.DeepEqual(got, firefox) {
+		t.Errorf("places.sqlite: got %v", got)
+	}
+	if got := readTestHistory(t, copyHistory(t, "places.sqlite", false)); !reflect.DeepEqual(got, firefox[:1]) {
+		t.Errorf("places.sqlite without its log: got %v", got)
+	}
+}
+
+func TestSQLiteWALFrames(t *testing.T) {
+	name := copyHistory(t, "places.sqlite", true)
+	wal, err := ioutil.ReadFile(name + "-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openSQLite(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageSize := db.pageSize
+	db.Close()
+
+	// frame copies the last frame of the log, overwriting its page and
+	// setting its commit field
+	last := wal[len(wal)-24-pageSize:]
+	frame := func(commit uint32, salt bool) []byte {
+		f := append([]byte(nil), last...)
+		binary.BigEndian.PutUint32(f[4:], commit)
+		if !salt {
+			f[8] ^= 0xff
+		}
+		for i := 24; i < len(f); i++ {
+			f[i] = 0xee
+		}
+		return f
+	}
+	tests := []struct {
+		name   string
+		frames [][]byte
+	}{
+		{"uncommitted frame", [][]byte{frame(0, true)}},
+		{"frame of a previous checkpoint", [][]byte{frame(0, false), frame(1, false)}},
+	}
+	for _, tt := range tests {
+		b := append([]byte(nil), wal...)
+		for _, f := range tt.frames {
+			b = append(b, f...)
+		}
+		if err := ioutil.WriteFile(name+"-wal", b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := readTestHistory(t, name); len(got) != 4 {
+			t.Errorf("%s: got %v", tt.name, got)
+		}
+	}
+
+	if err := ioutil.WriteFile(name+"-wal", []byte("not a log, but long enough to have a header"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openSQLite(name); err == nil {
+		t.Error("an invalid log was read")
+	}
+	os.Remove(name + "-wal")
+}
@@ -0,0 +1,199 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	squidMode        string
+	squidConcurrency int
+	squidBlockHosts  bool
+	squidRedirect    string
+	squidTag         string
+)
+
+// squidCmd represents the squid-helper command
+var squidCmd = &cobra.Command{
+	Use:   "squid-helper",
+	Short: "Run as a Squid external ACL or URL rewrite helper",
+	Long: `This command implements the Squid helper protocol on stdin and stdout.
+
+In acl mode (external_acl_type), it answers OK when the URL, or the host of
+a CONNECT request, is listed on URLhaus and ERR otherwise, e.g.
+
+  external_acl_type urlhaus concurrency=10 ttl=300 %>ru /usr/bin/urlhaus-cli squid-helper --mirror /var/lib/urlhaus/csv.txt --concurrency 10
+  acl urlhaus external urlhaus
+  http_access deny urlhaus
+
+In rewrite mode (url_rewrite_program), it redirects listed URLs to the
+--redirect URL, with the listed URL appended as the url query parameter,
+and leaves the others alone.
+
+The --concurrency value must match the concurrency set in squid.conf so
+that channel IDs are read and echoed back.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if squidMode != "acl" && squidMode != "rewrite" {
+			log.Fatalf("unknown helper mode %q", squidMode)
+		}
+		if squidMode == "rewrite" && squidRedirect == "" {
+			log.Fatal("rewrite mode requires --redirect")
+		}
+
+		c, err := newChecker()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var mu sync.Mutex
+		out := bufio.NewWriter(os.Stdout)
+		reply := func(channel, answer string) {
+			mu.Lock()
+			defer mu.Unlock()
+			if channel != "" {
+				fmt.Fprintf(out, "%s %s\n", channel, answer)
+			} else {
+				fmt.Fprintln(out, answer)
+			}
+			out.Flush()
+		}
+
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, squidConcurrency)
+		in := bufio.NewScanner(os.Stdin)
+		in.Buffer(make([]byte, 64*1024), 1024*1024)
+		for in.Scan() {
+			fields := strings.Fields(in.Text())
+			channel := ""
+			if squidConcurrency > 0 && len(fields) > 0 {
+				channel, fields = fields[0], fields[1:]
+			}
+
+			if squidConcurrency == 0 {
+				reply(channel, squidAnswer(c, fields))
+				continue
+			}
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(channel string, fields []string) {
+				defer func() { <-sem; wg.Done() }()
+				reply(channel, squidAnswer(c, fields))
+			}(channel, fields)
+		}
+		wg.Wait()
+		if err := in.Err(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(squidCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// squidCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// squidCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	squidCmd.Flags().StringVar(&squidMode, "mode", "acl", "The helper protocol, acl or rewrite")
+	squidCmd.Flags().IntVar(&squidConcurrency, "concurrency", 0, "The concurrency set in squid.conf (0 for no channel IDs)")
+	squidCmd.Flags().BoolVar(&squidBlockHosts, "block-hosts", false, "Also block URLs whose host is listed")
+	squidCmd.Flags().StringVar(&squidRedirect, "redirect", "", "The block page listed URLs are redirected to in rewrite mode")
+	squidCmd.Flags().StringVar(&squidTag, "tag", "urlhaus", "The tag set on blocked requests")
+	addCheckerFlags(squidCmd)
+}
+
+// squidAnswer checks the URL or host in the first field of a request and
+// returns the answer to send back to Squid.
+func squidAnswer(c *checker, fields []string) string {
+	if len(fields) == 0 {
+		return "BH message=" + squidQuote("empty request")
+	}
+	// external ACLs get %-encoded URLs, rewrite helpers get them as is
+	target := fields[0]
+	if squidMode != "rewrite" {
+		if t, err := url.PathUnescape(target); err == nil {
+			target = t
+		}
+	}
+
+	v, err := squidCheck(c, target)
+	if err != nil {
+		return "BH message=" + squidQuote(err.Error())
+	}
+
+	if squidMode == "rewrite" {
+		if !v.Listed {
+			return "ERR"
+		}
+		redirect := squidRedirect
+		if strings.Contains(redirect, "?") {
+			redirect += "&"
+		} else {
+			redirect += "?"
+		}
+		redirect += "url=" + url.QueryEscape(target)
+		return "OK status=302 url=" + squidQuote(redirect)
+	}
+
+	if !v.Listed {
+		return "ERR"
+	}
+	return fmt.Sprintf("OK tag=%s message=%s log=%s", squidQuote(squidTag), squidQuote(v.summary()), squidQuote(v.Reference))
+}
+
+// squidCheck checks an URL, or a host[:port] as found in CONNECT requests
+func squidCheck(c *checker, target string) (verdict, error) {
+	if strings.Contains(target, "://") {
+		v, err := c.check("url", target)
+		if err != nil || v.Listed || !squidBlockHosts {
+			return v, err
+		}
+		return c.check("host", hostOf(target))
+	}
+
+	host := target
+	if h, _, err := net.SplitHostPort(target); err == nil {
+		host = h
+	}
+	return c.check("host", strings.ToLower(host))
+}
+
+// squidQuote quotes a helper reply value
+func squidQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", " ", "\r", " ").Replace(s) + `"`
+}
@@ -0,0 +1,651 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	taxiiListen   string
+	taxiiConfig   string
+	taxiiUsers    string
+	taxiiPageSize int
+	taxiiReload   time.Duration
+)
+
+const (
+	taxiiMediaType = "application/taxii+json;version=2.1"
+	stixMediaType  = "application/stix+json;version=2.1"
+)
+
+// taxiiConfiguration is the file describing the server and its collections
+type taxiiConfiguration struct {
+	Title       string            `json:"title"`
+	Description string            `json:"description,omitempty"`
+	APIRoot     string            `json:"api_root"`
+	Collections []taxiiCollection `json:"collections"`
+}
+
+// taxiiCollection is a collection of the indicators of a tag or signature,
+// optionally limited to the URLs with a given status
+type taxiiCollection struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Tag         string `json:"tag,omitempty"`
+	Signature   string `json:"signature,omitempty"`
+	Status      string `json:"status,omitempty"`
+}
+
+// taxiiObject is a STIX object along with when it was added, and the
+// status and tags of its URL for collections to select it
+type taxiiObject struct {
+	added  time.Time
+	id     string
+	obj    map[string]interface{}
+	status string
+	tags   []string
+}
+
+// taxiiIndex holds the STIX objects of the mirror sorted by date added,
+// built once per load, and the positions of the objects of each collection
+type taxiiIndex struct {
+	objects     []taxiiObject
+	byID        map[string]int
+	collections map[string][]int
+}
+
+// taxiiView is the sorted list of the objects of a collection: all the
+// objects, or only those at the positions idx when it is not nil
+type taxiiView struct {
+	objects []taxiiObject
+	idx     []int
+	byID    map[string]int
+}
+
+// taxiiCmd represents the taxii-serve command
+var taxiiCmd = &cobra.Command{
+	Use:   "taxii-serve",
+	Short: "Run a TAXII 2.1 server publishing URLhaus indicators",
+	Long: `This command runs a read-only TAXII 2.1 server publishing the malware URLs
+of the mirror as STIX 2.1 indicators, in collections described by a JSON
+--config file:
+
+  {
+    "title": "URLhaus",
+    "api_root": "urlhaus",
+    "collections": [
+      {"title": "Mozi", "tag": "Mozi"},
+      {"title": "Emotet online", "signature": "Emotet", "status": "online"}
+    ]
+  }
+
+Collections without an id get one derived from their tag or signature.
+Since the dump has no signatures, signature collections are looked up with
+the API and cached for --reload. The mirror is read again every --reload.
+
+With --users, clients must use HTTP basic authentication with one of the
+user:password lines of the file.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := ioutil.ReadFile(taxiiConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var conf taxiiConfiguration
+		if err := json.Unmarshal(b, &conf); err != nil {
+			log.Fatalf("%s: %v", taxiiConfig, err)
+		}
+		if conf.APIRoot == "" {
+			conf.APIRoot = "urlhaus"
+		}
+		if conf.Title == "" {
+			conf.Title = "URLhaus"
+		}
+		for i := range conf.Collections {
+			c := &conf.Collections[i]
+			if c.ID == "" {
+				c.ID = uuid5(urlNamespace, "https://urlhaus.abuse.ch/#taxii/"+c.Tag+"/"+c.Signature+"/"+c.Status)
+			}
+		}
+
+		m, err := localMirror()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if m == nil {
+			log.Fatal("taxii-serve requires --mirror")
+		}
+
+		s := &taxiiServer{conf: conf, index: newTAXIIIndex(m, conf.Collections), signatures: newLRUCache(len(conf.Collections), taxiiReload)}
+		if taxiiUsers != "" {
+			lines, err := readLines(taxiiUsers)
+			if err != nil {
+				log.Fatal(err)
+			}
+			s.users = map[string]string{}
+			for _, l := range lines {
+				kv := strings.SplitN(l, ":", 2)
+				if len(kv) != 2 {
+					log.Fatalf("%s: malformed line %q", taxiiUsers, l)
+				}
+				s.users[kv[0]] = kv[1]
+			}
+		}
+		if taxiiReload > 0 {
+			go s.reload()
+		}
+
+		srv := &http.Server{Addr: taxiiListen, Handler: logRequests(s)}
+		serveGracefully(srv, serveShutdownTimeout, nil)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(taxiiCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// taxiiCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// taxiiCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	taxiiCmd.Flags().StringVarP(&taxiiListen, "listen", "l", "127.0.0.1:8082", "The address to listen on")
+	taxiiCmd.Flags().StringVarP(&taxiiConfig, "config", "c", "taxii.json", "The file describing the collections")
+	taxiiCmd.Flags().StringVar(&taxiiUsers, "users", "", "A file of user:password lines for basic authentication")
+	taxiiCmd.Flags().IntVar(&taxiiPageSize, "page-size", 1000, "The most objects returned at once")
+	taxiiCmd.Flags().DurationVar(&taxiiReload, "reload", time.Hour, "How often the mirror is read again")
+	taxiiCmd.Flags().DurationVar(&serveShutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait for requests in flight on shutdown")
+}
+
+type taxiiServer struct {
+	conf       taxiiConfiguration
+	users      map[string]string
+	signatures *lruCache
+
+	mu    sync.RWMutex
+	index *taxiiIndex
+}
+
+// reload reads the mirror again periodically
+func (s *taxiiServer) reload() {
+	for range time.Tick(taxiiReload) {
+		m, err := loadMirror(mirrorPath)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		x := newTAXIIIndex(m, s.conf.Collections)
+		s.mu.Lock()
+		s.index = x
+		s.mu.Unlock()
+	}
+}
+
+// taxiiError is the TAXII error message resource
+type taxiiError struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	HTTPStatus  string `json:"http_status"`
+}
+
+func writeTAXII(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", taxiiMediaType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeTAXIIError(w http.ResponseWriter, status int, desc string) {
+	writeTAXII(w, status, taxiiError{
+		Title:       http.StatusText(status),
+		Description: desc,
+		HTTPStatus:  strconv.Itoa(status),
+	})
+}
+
+func (s *taxiiServer) authorized(r *http.Request) bool {
+	if s.users == nil {
+		return true
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	want, ok := s.users[user]
+	return ok && subtle.ConstantTimeCompare([]byte(pass), []byte(want)) == 1
+}
+
+func (s *taxiiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="TAXII"`)
+		writeTAXIIError(w, http.StatusUnauthorized, "")
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeTAXIIError(w, http.StatusMethodNotAllowed, "this server is read-only")
+		return
+	}
+	if accept := r.Header.Get("Accept"); accept != "" && !strings.Contains(accept, "application/taxii+json") && !strings.Contains(accept, "*/*") {
+		writeTAXIIError(w, http.StatusNotAcceptable, "the media type must be "+taxiiMediaType)
+		return
+	}
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "taxii2":
+		s.discovery(w, r)
+	case path[0] != s.conf.APIRoot:
+		writeTAXIIError(w, http.StatusNotFound, "")
+	case len(path) == 1:
+		writeTAXII(w, http.StatusOK, map[string]interface{}{
+			"title":              s.conf.Title,
+			"description":        s.conf.Description,
+			"versions":           []string{taxiiMediaType},
+			"max_content_length": 0,
+		})
+	case len(path) == 2 && path[1] == "collections":
+		var collections []map[string]interface{}
+		for _, c := range s.conf.Collections {
+			collections = append(collections, taxiiCollectionResource(c))
+		}
+		writeTAXII(w, http.StatusOK, map[string]interface{}{"collections": collections})
+	case len(path) >= 3 && path[1] == "collections":
+		c, ok := s.collection(path[2])
+		if !ok {
+			writeTAXIIError(w, http.StatusNotFound, "no such collection")
+			return
+		}
+		switch {
+		case len(path) == 3:
+			writeTAXII(w, http.StatusOK, taxiiCollectionResource(c))
+		case len(path) == 4 && path[3] == "objects":
+			s.objects(w, r, c, "", false)
+		case len(path) == 5 && path[3] == "objects":
+			s.objects(w, r, c, path[4], false)
+		case len(path) == 4 && path[3] == "manifest":
+			s.objects(w, r, c, "", true)
+		default:
+			writeTAXIIError(w, http.StatusNotFound, "")
+		}
+	default:
+		writeTAXIIError(w, http.StatusNotFound, "")
+	}
+}
+
+func (s *taxiiServer) discovery(w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	root := scheme + "://" + r.Host + "/" + s.conf.APIRoot + "/"
+	writeTAXII(w, http.StatusOK, map[string]interface{}{
+		"title":       s.conf.Title,
+		"description": s.conf.Description,
+		"default":     root,
+		"api_roots":   []string{root},
+	})
+}
+
+func (s *taxiiServer) collection(id string) (taxiiCollection, bool) {
+	for _, c := range s.conf.Collections {
+		if c.ID == id {
+			return c, true
+		}
+	}
+	return taxiiCollection{}, false
+}
+
+func taxiiCollectionResource(c taxiiCollection) map[string]interface{} {
+	res := map[string]interface{}{
+		"id":          c.ID,
+		"title":       c.Title,
+		"can_read":    true,
+		"can_write":   false,
+		"media_types": []string{stixMediaType},
+	}
+	if c.Description != "" {
+		res["description"] = c.Description
+	}
+	return res
+}
+
+// newTAXIIIndex builds the STIX objects of a mirror and the lists of the
+// collections selecting them by tag or status
+func newTAXIIIndex(m *mirror, collections []taxiiCollection) *taxiiIndex {
+	x := &taxiiIndex{
+		objects:     make([]taxiiObject, len(m.urls)),
+		byID:        make(map[string]int, len(m.urls)),
+		collections: map[string][]int{},
+	}
+	for i, e := range m.urls {
+		x.objects[i] = stixIndicator(e)
+	}
+	sort.SliceStable(x.objects, func(i, j int) bool { return x.objects[i].added.Before(x.objects[j].added) })
+	for i, o := range x.objects {
+		x.byID[o.id] = i
+	}
+
+	for _, c := range collections {
+		if c.Signature != "" || (c.Tag == "" && c.Status == "") {
+			continue
+		}
+		idx := []int{} // not nil, which would select every object
+		for i, o := range x.objects {
+			if c.selects(o) {
+				idx = append(idx, i)
+			}
+		}
+		x.collections[c.ID] = idx
+	}
+	return x
+}
+
+// selects reports whether an object belongs to the collection
+func (c taxiiCollection) selects(o taxiiObject) bool {
+	return (c.Tag == "" || hasTag(o.tags, c.Tag)) && (c.Status == "" || o.status == c.Status)
+}
+
+// view returns the objects of a collection. The objects of signature
+// collections are looked up with the API and cached.
+func (s *taxiiServer) view(c taxiiCollection) (taxiiView, error) {
+	if c.Signature == "" {
+		s.mu.RLock()
+		x := s.index
+		s.mu.RUnlock()
+		return taxiiView{objects: x.objects, idx: x.collections[c.ID], byID: x.byID}, nil
+	}
+
+	if v, ok := s.signatures.get(c.ID); ok {
+		return v.(taxiiView), nil
+	}
+	r, err := lookupResult("signature", c.Signature)
+	if err != nil {
+		return taxiiView{}, err
+	}
+	v := taxiiView{byID: map[string]int{}}
+	for _, e := range r.urls() {
+		if o := stixIndicator(e); c.selects(o) {
+			v.objects = append(v.objects, o)
+		}
+	}
+	sort.SliceStable(v.objects, func(i, j int) bool { return v.objects[i].added.Before(v.objects[j].added) })
+	for i, o := range v.objects {
+		v.byID[o.id] = i
+	}
+	s.signatures.put(c.ID, v)
+	return v, nil
+}
+
+func (v taxiiView) len() int {
+	if v.idx == nil {
+		return len(v.objects)
+	}
+	return len(v.idx)
+}
+
+func (v taxiiView) at(i int) taxiiObject {
+	if v.idx == nil {
+		return v.objects[i]
+	}
+	return v.objects[v.idx[i]]
+}
+
+// after returns the position of the first object added after t
+func (v taxiiView) after(t time.Time) int {
+	return sort.Search(v.len(), func(i int) bool { return v.at(i).added.After(t) })
+}
+
+// find returns the position of the object with the given ID
+func (v taxiiView) find(id string) (int, bool) {
+	i, ok := v.byID[id]
+	if !ok || v.idx == nil {
+		return i, ok
+	}
+	j := sort.SearchInts(v.idx, i)
+	return j, j < len(v.idx) && v.idx[j] == i
+}
+
+// hasTag reports whether tags holds tag, ignoring case
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// objects serves the objects or the manifest of a collection
+func (s *taxiiServer) objects(w http.ResponseWriter, r *http.Request, c taxiiCollection, objectID string, manifest bool) {
+	q := r.URL.Query()
+
+	var addedAfter time.Time
+	if v := q.Get("added_after"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			writeTAXIIError(w, http.StatusBadRequest, "added_after must be a timestamp")
+			return
+		}
+		addedAfter = t
+	}
+	limit := taxiiPageSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeTAXIIError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+	offset := 0
+	if v := q.Get("next"); v != "" {
+		n, err := decodeTAXIINext(v)
+		if err != nil {
+			writeTAXIIError(w, http.StatusBadRequest, "invalid next")
+			return
+		}
+		offset = n
+	}
+	ids := splitParam(q.Get("match[id]"))
+	if objectID != "" {
+		ids = []string{objectID}
+	}
+	types := splitParam(q.Get("match[type]"))
+
+	v, err := s.view(c)
+	if err != nil {
+		writeTAXIIError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	if len(types) > 0 && !containsString(types, "indicator") {
+		v = taxiiView{}
+	}
+
+	// the matching objects are the positions from start on, or those of
+	// the requested IDs
+	start, count := 0, 0
+	var positions []int
+	if len(ids) > 0 {
+		for _, id := range ids {
+			i, ok := v.find(id)
+			if ok && (addedAfter.IsZero() || v.at(i).added.After(addedAfter)) && !containsInt(positions, i) {
+				positions = append(positions, i)
+			}
+		}
+		sort.Ints(positions)
+		count = len(positions)
+	} else {
+		if !addedAfter.IsZero() {
+			start = v.after(addedAfter)
+		}
+		count = v.len() - start
+	}
+
+	if objectID != "" && count == 0 {
+		writeTAXIIError(w, http.StatusNotFound, "no such object")
+		return
+	}
+	if offset > count {
+		offset = count
+	}
+	end := offset + limit
+	more := end < count
+	if !more {
+		end = count
+	}
+	page := make([]taxiiObject, 0, end-offset)
+	for i := offset; i < end; i++ {
+		if positions != nil {
+			page = append(page, v.at(positions[i]))
+		} else {
+			page = append(page, v.at(start+i))
+		}
+	}
+
+	if len(page) > 0 {
+		w.Header().Set("X-TAXII-Date-Added-First", stixTime(page[0].added))
+		w.Header().Set("X-TAXII-Date-Added-Last", stixTime(page[len(page)-1].added))
+	}
+
+	res := map[string]interface{}{"more": more}
+	if more {
+		res["next"] = encodeTAXIINext(offset + len(page))
+	}
+	list := make([]interface{}, 0, len(page))
+	for _, o := range page {
+		if manifest {
+			list = append(list, map[string]interface{}{
+				"id":         o.id,
+				"date_added": stixTime(o.added),
+				"version":    o.obj["modified"],
+				"media_type": stixMediaType,
+			})
+		} else {
+			list = append(list, o.obj)
+		}
+	}
+	res["objects"] = list
+	writeTAXII(w, http.StatusOK, res)
+}
+
+func encodeTAXIINext(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+func decodeTAXIINext(next string) (int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(next)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(string(b))
+	if err == nil && n < 0 {
+		err = errors.New("negative offset")
+	}
+	return n, err
+}
+
+func splitParam(v string) []string {
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+func containsInt(s []int, v int) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(s []string, v string) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// stixTime formats a STIX timestamp
+func stixTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// stixString quotes a string literal of a STIX pattern
+func stixString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// stixIndicator returns the STIX indicator of a malware URL
+func stixIndicator(e urlEntry) taxiiObject {
+	added, ok := parseTime(e.DateAdded)
+	if !ok {
+		added = time.Unix(0, 0)
+	}
+	id := "indicator--" + uuid5(urlNamespace, e.URL)
+
+	obj := map[string]interface{}{
+		"type":            "indicator",
+		"spec_version":    "2.1",
+		"id":              id,
+		"created":         stixTime(added),
+		"modified":        stixTime(added),
+		"name":            "Malware URL " + e.URL,
+		"indicator_types": []string{"malicious-activity"},
+		"pattern":         fmt.Sprintf("[url:value = %s]", stixString(e.URL)),
+		"pattern_type":    "stix",
+		"valid_from":      stixTime(added),
+	}
+	if e.Threat != "" {
+		obj["description"] = e.Threat
+	}
+	if len(e.Tags) > 0 {
+		obj["labels"] = e.Tags
+	}
+	if e.Reference != "" {
+		obj["external_references"] = []map[string]string{{"source_name": "URLhaus", "url": e.Reference}}
+	}
+	return taxiiObject{added: added, id: id, obj: obj, status: e.Status, tags: e.Tags}
+}
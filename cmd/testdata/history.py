@@ -0,0 +1,71 @@
+# Generates the Chrome and Firefox history databases the tests of
+# scan-browser read. The rows added last are only in the write-ahead logs,
+# which are copied before the connections are closed and checkpoint them.
+import hashlib, os, shutil, sqlite3
+
+here = os.path.dirname(os.path.abspath(__file__))
+
+def wal(name):
+    for suffix in ('', '-wal', '-shm'):
+        if os.path.exists(name + suffix):
+            os.remove(name + suffix)
+    db = sqlite3.connect(name)
+    db.execute('pragma page_size=1024')
+    db.execute('pragma journal_mode=wal')
+    db.execute('pragma wal_autocheckpoint=0')
+    return db
+
+def keep(db, name, dest):
+    shutil.copy(name, os.path.join(here, dest))
+    shutil.copy(name + '-wal', os.path.join(here, dest + '-wal'))
+    db.close()
+    os.remove(name)
+
+chrome = os.path.join(here, 'tmp-History')
+db = wal(chrome)
+db.executescript('''
+CREATE TABLE urls(id INTEGER PRIMARY KEY AUTOINCREMENT,url LONGVARCHAR,title LONGVARCHAR,visit_count INTEGER DEFAULT 0 NOT NULL,typed_count INTEGER DEFAULT 0 NOT NULL,last_visit_time INTEGER NOT NULL,hidden INTEGER DEFAULT 0 NOT NULL);
+CREATE TABLE visits(id INTEGER PRIMARY KEY,url INTEGER NOT NULL,visit_time INTEGER NOT NULL,from_visit INTEGER,transition INTEGER DEFAULT 0 NOT NULL);
+CREATE TABLE downloads (id INTEGER PRIMARY KEY,guid VARCHAR NOT NULL,current_path LONGVARCHAR NOT NULL,target_path LONGVARCHAR NOT NULL,start_time INTEGER NOT NULL,received_bytes INTEGER NOT NULL,total_bytes INTEGER NOT NULL,state INTEGER NOT NULL,danger_type INTEGER NOT NULL,interrupt_reason INTEGER NOT NULL,hash BLOB NOT NULL,end_time INTEGER NOT NULL);
+CREATE TABLE downloads_url_chains (id INTEGER NOT NULL,chain_index INTEGER NOT NULL,url LONGVARCHAR NOT NULL, PRIMARY KEY (id, chain_index));
+''')
+# 2024-01-02T10:00:00Z in microseconds since 1601
+base = 13348663200000000
+for i in range(1, 41):
+    db.execute('insert into urls(url,title,last_visit_time) values(?,?,?)', ('https://example.com/page%d' % i, 'page %d' % i, base + i * 1000000))
+    db.execute('insert into visits(url,visit_time) values(?,?)', (i, base + i * 1000000))
+db.commit()
+db.execute('pragma wal_checkpoint(TRUNCATE)')
+
+# an URL longer than a page, and a download, in the log
+db.execute('insert into urls(id,url,title,last_visit_time) values(41,?,?,?)', ('http://evil.example/' + 'x' * 2000, 'long', base + 100000000))
+db.execute('insert into visits(url,visit_time) values(41,?)', (base + 100000000,))
+db.execute("insert into downloads values(1,'guid','/home/u/Downloads/x.doc','/home/u/Downloads/x.doc',?,16,16,1,0,0,?,0)", (base + 200000000, hashlib.sha256(b'malware payload\n').digest()))
+db.execute("insert into downloads_url_chains values(1,0,'http://short.example/r')")
+db.execute("insert into downloads_url_chains values(1,1,'http://evil.example/x.doc')")
+db.commit()
+keep(db, chrome, 'History')
+
+firefox = os.path.join(here, 'tmp-places.sqlite')
+db = wal(firefox)
+db.executescript('''
+CREATE TABLE moz_places (id INTEGER PRIMARY KEY, url LONGVARCHAR, title LONGVARCHAR, rev_host LONGVARCHAR, visit_count INTEGER DEFAULT 0, hidden INTEGER DEFAULT 0 NOT NULL, typed INTEGER DEFAULT 0 NOT NULL, frecency INTEGER DEFAULT -1 NOT NULL, last_visit_date INTEGER , guid TEXT);
+CREATE TABLE moz_historyvisits (id INTEGER PRIMARY KEY, from_visit INTEGER, place_id INTEGER, visit_date INTEGER, visit_type INTEGER, session INTEGER);
+CREATE TABLE moz_anno_attributes (id INTEGER PRIMARY KEY, name VARCHAR(32) UNIQUE NOT NULL);
+CREATE TABLE moz_annos (id INTEGER PRIMARY KEY,place_id INTEGER NOT NULL,anno_attribute_id INTEGER,content LONGVARCHAR, flags INTEGER DEFAULT 0,expiration INTEGER DEFAULT 0,type INTEGER DEFAULT 0,dateAdded INTEGER DEFAULT 0,lastModified INTEGER DEFAULT 0);
+''')
+# 2024-01-02T10:00:00Z in microseconds since 1970
+base = 1704189600000000
+db.execute("insert into moz_places(id,url,title,last_visit_date) values(1,'https://example.com/','example',?)", (base,))
+db.execute('insert into moz_historyvisits(place_id,visit_date) values(1,?)', (base,))
+db.commit()
+db.execute('pragma wal_checkpoint(TRUNCATE)')
+
+# the rows of the log: a visit, a place whose visits expired and a download
+db.execute("insert into moz_places(id,url,title,last_visit_date) values(2,'http://evil.example/x.doc','doc',?)", (base + 60000000,))
+db.execute('insert into moz_historyvisits(place_id,visit_date) values(2,?)', (base + 60000000,))
+db.execute("insert into moz_places(id,url,title,last_visit_date) values(3,'http://expired.example/','',?)", (base + 120000000,))
+db.execute("insert into moz_anno_attributes values(1,'downloads/destinationFileURI')")
+db.execute("insert into moz_annos(place_id,anno_attribute_id,content,dateAdded) values(2,1,'file:///home/u/x.doc',?)", (base + 61000000,))
+db.commit()
+keep(db, firefox, 'places.sqlite')
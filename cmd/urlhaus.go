@@ -21,8 +21,14 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var baseURL = url.URL{
@@ -36,3 +42,37 @@ func URL(pathFmt string, a ...interface{}) string {
 	url, _ := url.Parse(path)
 	return baseURL.ResolveReference(url).String()
 }
+
+// apiClient is the client of the lookups, bounded so that a stalled API
+// call does not hold up the servers answering from them
+var apiClient = &http.Client{Timeout: 30 * time.Second}
+
+// query posts a form to a URLhaus API endpoint and decodes the JSON response
+func query(endpoint string, form url.Values) (map[string]interface{}, error) {
+	start := time.Now()
+	resp, err := apiClient.Post(URL("%s", endpoint), "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		apiMetrics.observe(endpoint, time.Since(start), "network")
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		apiMetrics.observe(endpoint, time.Since(start), "network")
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		apiMetrics.observe(endpoint, time.Since(start), "http_"+strconv.Itoa(resp.StatusCode))
+		return nil, fmt.Errorf("%s: unexpected HTTP status %s", endpoint, resp.Status)
+	}
+
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		apiMetrics.observe(endpoint, time.Since(start), "decode")
+		return nil, fmt.Errorf("%s: %v", endpoint, err)
+	}
+	apiMetrics.observe(endpoint, time.Since(start), "")
+	return m, nil
+}
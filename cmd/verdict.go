@@ -0,0 +1,291 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	checkAPI       bool
+	checkCacheSize int
+	checkCacheTTL  time.Duration
+)
+
+// verdict is what URLhaus knows about an URL, a host or a payload
+type verdict struct {
+	Type      string   `json:"type"`
+	Indicator string   `json:"indicator"`
+	Listed    bool     `json:"listed"`
+	Status    string   `json:"status,omitempty"`
+	Threat    string   `json:"threat,omitempty"`
+	Signature string   `json:"signature,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	URLCount  int      `json:"url_count,omitempty"`
+	Reference string   `json:"urlhaus_reference,omitempty"`
+	Source    string   `json:"source"`
+}
+
+// checker decides whether indicators are known to URLhaus, looking them up
+// in the mirror first and falling back to the API, and caches the verdicts.
+type checker struct {
+	mirror   *mirror
+	payloads *payloadMirror
+	api      bool
+	cache    *lruCache
+}
+
+// addCheckerFlags adds the flags configuring newChecker to a command
+func addCheckerFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&checkAPI, "api", false, "Look up indicators missing from the mirrors with the API")
+	cmd.Flags().IntVar(&checkCacheSize, "cache-size", 10000, "The number of verdicts kept in memory")
+	cmd.Flags().DurationVar(&checkCacheTTL, "cache-ttl", time.Hour, "How long verdicts are kept in memory")
+}
+
+// newChecker returns a checker using the mirrors if configured, and the
+// API with --api or when there is no mirror at all.
+func newChecker() (*checker, error) {
+	m, err := localMirror()
+	if err != nil {
+		return nil, err
+	}
+	p, err := localPayloadMirror()
+	if err != nil {
+		return nil, err
+	}
+	return &checker{
+		mirror:   m,
+		payloads: p,
+		api:      checkAPI,
+		cache:    newLRUCache(checkCacheSize, checkCacheTTL),
+	}, nil
+}
+
+// usesAPI reports whether the indicators of a type missing from the
+// mirrors are looked up with the API: all of them with --api, URLs and
+// hosts without URL mirror, and payload hashes without any mirror, so that
+// a command given the URL mirror alone does not send them out.
+func (c *checker) usesAPI(typ string) bool {
+	if c.api {
+		return true
+	}
+	if typ == "md5" || typ == "sha256" {
+		return c.mirror == nil && c.payloads == nil
+	}
+	return c.mirror == nil
+}
+
+// checksPayloads reports whether payload hashes can be checked at all
+func (c *checker) checksPayloads() bool {
+	return c.payloads != nil || c.usesAPI("sha256")
+}
+
+// check returns the verdict about an indicator of the given type (url,
+// host, md5 or sha256).
+func (c *checker) check(typ, indicator string) (verdict, error) {
+	key := typ + " " + indicator
+	if v, ok := c.cache.get(key); ok {
+		return v.(verdict), nil
+	}
+
+	v, err := c.lookup(typ, indicator)
+	if err != nil {
+		return v, err
+	}
+	c.cache.put(key, v)
+	return v, nil
+}
+
+// checkConcurrently checks indicators with a number of workers, calling fn
+// with each verdict, one at a time
+func checkConcurrently(c *checker, indicators []logIndicator, workers int, fn func(in logIndicator, v verdict, err error)) {
+	jobs := make(chan logIndicator)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for in := range jobs {
+				v, err := c.check(in.Type, in.Value)
+				mu.Lock()
+				fn(in, v, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, in := range indicators {
+		jobs <- in
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+func (c *checker) lookup(typ, indicator string) (verdict, error) {
+	v := verdict{Type: typ, Indicator: indicator}
+
+	if c.mirror != nil {
+		v.Source = "mirror"
+		switch typ {
+		case "url":
+			if e, ok := c.mirror.lookupURL(indicator); ok {
+				return urlVerdict(v, e), nil
+			}
+		case "host":
+			if entries := c.mirror.lookupHost(indicator); len(entries) > 0 {
+				return hostVerdict(v, entries), nil
+			}
+		}
+	}
+	if c.payloads != nil && (typ == "md5" || typ == "sha256") {
+		v.Source = "mirror"
+		if e, urls, ok := c.payloads.lookup(indicator); ok {
+			v.Listed = true
+			v.Signature = e.Signature
+			v.URLCount = urls
+			v.Reference = e.Reference
+			return v, nil
+		}
+	}
+	if !c.usesAPI(typ) {
+		return v, nil
+	}
+
+	v.Source = "api"
+	if typ == "host" {
+		indicator = strings.ToLower(indicator)
+	}
+	r, err := lookupResult(typ, indicator)
+	if err != nil {
+		return v, err
+	}
+	switch status := str(r.data, "query_status"); status {
+	case "ok":
+	case "no_results":
+		return v, nil
+	default:
+		return v, fmt.Errorf("%s %s: %s", typ, indicator, status)
+	}
+
+	switch r.kind {
+	case "url":
+		v = urlVerdict(v, r.urls()[0])
+	case "host":
+		v = hostVerdict(v, r.urls())
+		v.Listed = true
+	case "payload":
+		v.Listed = true
+		v.Signature = str(r.data, "signature")
+		v.URLCount = len(objects(r.data, "urls"))
+		v.Reference = "https://urlhaus.abuse.ch/browse.php?search=" + str(r.data, "sha256_hash")
+	}
+	return v, nil
+}
+
+func urlVerdict(v verdict, e urlEntry) verdict {
+	v.Listed = true
+	v.Status = e.Status
+	v.Threat = e.Threat
+	v.Signature = e.Signature
+	v.Tags = e.Tags
+	v.URLCount = 1
+	v.Reference = e.Reference
+	return v
+}
+
+func hostVerdict(v verdict, entries []urlEntry) verdict {
+	v.Listed = len(entries) > 0
+	v.Status = "offline"
+	for _, e := range entries {
+		if e.Status == "online" {
+			v.Status = "online"
+		}
+		v.Tags = appendUnique(v.Tags, e.Tags...)
+		if v.Threat == "" {
+			v.Threat = e.Threat
+		}
+	}
+	v.URLCount = len(entries)
+	v.Reference = "https://urlhaus.abuse.ch/host/" + strings.ToLower(v.Indicator) + "/"
+	return v
+}
+
+// summary describes a verdict in one line
+func (v verdict) summary() string {
+	if !v.Listed {
+		return v.Type + " " + v.Indicator + " is not listed on URLhaus"
+	}
+	s := v.Type + " " + v.Indicator + " is listed on URLhaus"
+	var details []string
+	if v.Threat != "" {
+		details = append(details, v.Threat)
+	}
+	if v.Status != "" {
+		details = append(details, v.Status)
+	}
+	if v.Signature != "" {
+		details = append(details, v.Signature)
+	}
+	if len(v.Tags) > 0 {
+		details = append(details, "tags: "+strings.Join(v.Tags, ","))
+	}
+	if len(details) > 0 {
+		s += " (" + strings.Join(details, ", ") + ")"
+	}
+	if v.Reference != "" {
+		s += " " + v.Reference
+	}
+	return s
+}
+
+// checkAll checks each distinct indicator once, logging the failed lookups,
+// and returns the verdicts and the errors by indicator
+func checkAll(c *checker, indicators []logIndicator, workers int) (map[logIndicator]verdict, map[logIndicator]error) {
+	seen := map[logIndicator]bool{}
+	var unique []logIndicator
+	for _, in := range indicators {
+		if !seen[in] {
+			seen[in] = true
+			unique = append(unique, in)
+		}
+	}
+
+	verdicts := map[logIndicator]verdict{}
+	failed := map[logIndicator]error{}
+	checkConcurrently(c, unique, workers, func(in logIndicator, v verdict, err error) {
+		verdicts[in] = v
+		if err != nil {
+			log.Print(err)
+			failed[in] = err
+		}
+	})
+	return verdicts, failed
+}
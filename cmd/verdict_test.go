@@ -0,0 +1,75 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckerUsesAPI(t *testing.T) {
+	m, err := parseMirror(strings.NewReader(testDump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := parsePayloadMirror(strings.NewReader(testPayloadDump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name           string
+		c              *checker
+		urls, hashes   bool
+		checksPayloads bool
+	}{
+		{"no mirror", &checker{}, true, true, true},
+		{"URL mirror", &checker{mirror: m}, false, false, false},
+		{"payload mirror", &checker{payloads: p}, true, false, true},
+		{"both mirrors", &checker{mirror: m, payloads: p}, false, false, true},
+		{"both mirrors and --api", &checker{mirror: m, payloads: p, api: true}, true, true, true},
+		{"URL mirror and --api", &checker{mirror: m, api: true}, true, true, true},
+	}
+	for _, tt := range tests {
+		for _, typ := range []string{"url", "host"} {
+			if got := tt.c.usesAPI(typ); got != tt.urls {
+				t.Errorf("%s: %s uses the API: %v", tt.name, typ, got)
+			}
+		}
+		for _, typ := range []string{"md5", "sha256"} {
+			if got := tt.c.usesAPI(typ); got != tt.hashes {
+				t.Errorf("%s: %s uses the API: %v", tt.name, typ, got)
+			}
+		}
+		if got := tt.c.checksPayloads(); got != tt.checksPayloads {
+			t.Errorf("%s: checks payloads: %v", tt.name, got)
+		}
+	}
+
+	// a payload mirror alone checks hashes offline
+	c := &checker{payloads: p, cache: newLRUCache(10, time.Minute)}
+	for _, in := range []logIndicator{{"sha256", strings.Repeat("0", 64)}, {"md5", strings.Repeat("0", 32)}} {
+		v, err := c.check(in.Type, in.Value)
+		if err != nil || v.Listed || v.Source != "mirror" {
+			t.Errorf("%v: %+v %v", in, v, err)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	watchHosts      []string
+	watchTags       []string
+	watchSignatures []string
+	watchList       string
+	watchState      string
+	watchFormat     string
+	watchOutput     string
+	watchInterval   time.Duration
+	watchDaemon     bool
+	watchExit       bool
+	watchNotify     string
+)
+
+// watchSnapshot is what was known about a watched host, tag or signature
+type watchSnapshot struct {
+	URLs       map[string]string `json:"urls"`
+	References map[string]string `json:"references,omitempty"`
+	Payloads   []string          `json:"payloads,omitempty"`
+	Blacklists map[string]string `json:"blacklists,omitempty"`
+}
+
+// watchChange is a difference between two snapshots
+type watchChange struct {
+	Time      time.Time `json:"time"`
+	Target    string    `json:"target"`
+	Value     string    `json:"value"`
+	Change    string    `json:"change"`
+	URL       string    `json:"url,omitempty"`
+	OldStatus string    `json:"old_status,omitempty"`
+	Status    string    `json:"status,omitempty"`
+	SHA256    string    `json:"sha256_hash,omitempty"`
+	Blacklist string    `json:"blacklist,omitempty"`
+	Reference string    `json:"urlhaus_reference,omitempty"`
+}
+
+// watchCmd represents the watch command
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Report changes to hosts, tags and signatures",
+	Long: `This command looks up hosts, tags and signatures, compares the results with
+the snapshot saved in the --state file by the previous run and reports the
+changes only: new URLs, URLs going online or offline, new payloads and new
+blacklist listings. The first run only records a snapshot. Since host and
+tag results do not list the payloads of their URLs, new payloads are only
+reported for signatures.
+
+The watched indicators are given with --host, --tag and --signature, or as
+"host example.com", "tag Mozi" or "signature Emotet" lines in the --watchlist
+file.
+
+Without --daemon, the command runs once, which suits cron and CI jobs. With
+--exit-on-change, it exits with status 3 as soon as something changed.
+
+With --notify, the changes are also sent to the webhooks, Slack or Teams
+channels, mail addresses and syslog servers configured in the file:
+
+  {
+    "dedup_file": "urlhaus-sent.json",
+    "sinks": [
+      {"type": "webhook", "url": "https://example.com/hook", "secret": "s3cr3t"},
+      {"type": "slack", "url": "https://hooks.slack.com/services/..."},
+      {"type": "smtp", "address": "mail:587", "from": "urlhaus@example.com",
+       "to": ["soc@example.com"], "template": "{{.Summary}}"},
+      {"type": "syslog", "network": "tls", "address": "siem:6514"}
+    ]
+  }`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		targets, err := watchTargets()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(targets) == 0 {
+			log.Fatal("nothing to watch")
+		}
+
+		emit, err := watchEmitter()
+		if err != nil {
+			log.Fatal(err)
+		}
+		var nt *notifier
+		if watchNotify != "" {
+			if nt, err = newNotifier(watchNotify); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		for {
+			changes, err := watchRound(targets)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, c := range changes {
+				if err := emit(c); err != nil {
+					log.Fatal(err)
+				}
+				if nt != nil {
+					nt.notify(c.notification())
+				}
+			}
+			if nt != nil && (!watchDaemon || watchExit && len(changes) > 0) {
+				nt.flush(time.Minute)
+			}
+			if watchExit && len(changes) > 0 {
+				os.Exit(3)
+			}
+			if !watchDaemon {
+				return
+			}
+			time.Sleep(watchInterval)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(watchCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// watchCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// watchCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	watchCmd.Flags().StringArrayVar(&watchHosts, "host", nil, "A host to watch")
+	watchCmd.Flags().StringArrayVar(&watchTags, "tag", nil, "A tag to watch")
+	watchCmd.Flags().StringArrayVar(&watchSignatures, "signature", nil, "A signature to watch")
+	watchCmd.Flags().StringVarP(&watchList, "watchlist", "w", "", "A file of \"host|tag|signature value\" lines to watch")
+	watchCmd.Flags().StringVarP(&watchState, "state", "s", "urlhaus-watch.json", "The file keeping the last snapshot")
+	watchCmd.Flags().StringVarP(&watchFormat, "format", "f", "text", "The output format: text or ndjson")
+	watchCmd.Flags().StringVarP(&watchOutput, "output", "o", "-", "The file the changes are appended to")
+	watchCmd.Flags().DurationVar(&watchInterval, "interval", time.Hour, "How often to look up in daemon mode")
+	watchCmd.Flags().BoolVarP(&watchDaemon, "daemon", "d", false, "Keep watching every --interval")
+	watchCmd.Flags().BoolVar(&watchExit, "exit-on-change", false, "Exit with status 3 when something changed")
+	watchCmd.Flags().StringVar(&watchNotify, "notify", "", "A JSON file configuring where changes are notified")
+}
+
+// watchTargets returns the "kind value" pairs to watch
+func watchTargets() ([]string, error) {
+	var targets []string
+	for _, h := range watchHosts {
+		targets = append(targets, "host "+strings.ToLower(h))
+	}
+	for _, t := range watchTags {
+		targets = append(targets, "tag "+t)
+	}
+	for _, s := range watchSignatures {
+		targets = append(targets, "signature "+s)
+	}
+
+	if watchList != "" {
+		lines, err := readLines(watchList)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range lines {
+			// tags and signatures may contain spaces
+			i := strings.IndexAny(l, " \t")
+			if i < 0 || strings.TrimSpace(l[i:]) == "" {
+				return nil, fmt.Errorf("%s: malformed line %q", watchList, l)
+			}
+			kind, value := l[:i], strings.TrimSpace(l[i:])
+			switch kind {
+			case "host":
+				value = strings.ToLower(value)
+			case "tag", "signature":
+			default:
+				return nil, fmt.Errorf("%s: cannot watch %s", watchList, kind)
+			}
+			targets = append(targets, kind+" "+value)
+		}
+	}
+	return appendUnique(nil, targets...), nil
+}
+
+// watchEmitter returns the function writing a change in --format
+func watchEmitter() (func(watchChange) error, error) {
+	switch watchFormat {
+	case "ndjson":
+		l, err := newNDJSONLogger(watchOutput)
+		if err != nil {
+			return nil, err
+		}
+		return func(c watchChange) error { return l.log(c) }, nil
+	case "text":
+		l, err := newNDJSONLogger(watchOutput)
+		if err != nil {
+			return nil, err
+		}
+		return func(c watchChange) error {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			_, err := fmt.Fprintln(l.w, c.summary())
+			return err
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", watchFormat)
+	}
+}
+
+// watchRound looks up every target and returns the changes since the saved
+// snapshot, which it then replaces
+func watchRound(targets []string) ([]watchChange, error) {
+	state := map[string]watchSnapshot{}
+	b, err := ioutil.ReadFile(watchState)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(b, &state); err != nil {
+			return nil, fmt.Errorf("%s: %v", watchState, err)
+		}
+	}
+
+	var changes []watchChange
+	now := time.Now().UTC()
+	for _, target := range targets {
+		kv := strings.SplitN(target, " ", 2)
+		r, err := lookupResult(kv[0], kv[1])
+		if err == nil && !r.ok() && str(r.data, "query_status") != "no_results" {
+			err = fmt.Errorf("%s", str(r.data, "query_status"))
+		}
+		if err != nil {
+			log.Printf("%s: %v", target, err)
+			continue
+		}
+
+		snap := newWatchSnapshot(r)
+		if prev, ok := state[target]; ok {
+			for _, c := range diffSnapshots(prev, snap) {
+				c.Time = now
+				c.Target = kv[0]
+				c.Value = kv[1]
+				changes = append(changes, c)
+			}
+		}
+		state[target] = snap
+	}
+
+	b, err = json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(watchState), ".urlhaus-watch")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return changes, os.Rename(tmp.Name(), watchState)
+}
+
+func newWatchSnapshot(r result) watchSnapshot {
+	s := watchSnapshot{
+		URLs:       map[string]string{},
+		References: map[string]string{},
+		Blacklists: strMap(r.data, "blacklists"),
+	}
+	for _, e := range r.urls() {
+		s.URLs[e.URL] = e.Status
+		if e.Reference != "" {
+			s.References[e.URL] = e.Reference
+		}
+		if e.SHA256 != "" {
+			s.Payloads = appendUnique(s.Payloads, e.SHA256)
+		}
+	}
+	for _, p := range r.payloads() {
+		if p.SHA256 != "" {
+			s.Payloads = appendUnique(s.Payloads, p.SHA256)
+		}
+	}
+	sort.Strings(s.Payloads)
+	return s
+}
+
+// diffSnapshots returns what is new in cur
+func diffSnapshots(prev, cur watchSnapshot) []watchChange {
+	var changes []watchChange
+
+	var urls []string
+	for u := range cur.URLs {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	for _, u := range urls {
+		status := cur.URLs[u]
+		old, ok := prev.URLs[u]
+		switch {
+		case !ok:
+			changes = append(changes, watchChange{Change: "new_url", URL: u, Status: status, Reference: cur.References[u]})
+		case old != status:
+			changes = append(changes, watchChange{Change: "status_changed", URL: u, OldStatus: old, Status: status, Reference: cur.References[u]})
+		}
+	}
+
+	for _, p := range cur.Payloads {
+		if !containsString(prev.Payloads, p) {
+			changes = append(changes, watchChange{Change: "new_payload", SHA256: p, Reference: "https://urlhaus.abuse.ch/browse.php?search=" + p})
+		}
+	}
+
+	var blacklists []string
+	for bl := range cur.Blacklists {
+		blacklists = append(blacklists, bl)
+	}
+	sort.Strings(blacklists)
+	for _, bl := range blacklists {
+		status := cur.Blacklists[bl]
+		if status == "not listed" || status == prev.Blacklists[bl] {
+			continue
+		}
+		changes = append(changes, watchChange{Change: "new_listing", Blacklist: bl, OldStatus: prev.Blacklists[bl], Status: status})
+	}
+	return changes
+}
+
+// summary describes a change in one line
+func (c watchChange) summary() string {
+	s := c.Time.Format(time.RFC3339) + " " + c.describe()
+	if c.Reference != "" {
+		s += " " + c.Reference
+	}
+	return s
+}
+
+// describe says what changed
+func (c watchChange) describe() string {
+	s := c.Target + " " + c.Value + ": "
+	switch c.Change {
+	case "new_url":
+		return s + "new " + c.Status + " URL " + c.URL
+	case "status_changed":
+		return s + c.URL + " went " + c.Status
+	case "new_payload":
+		return s + "new payload " + c.SHA256
+	case "new_listing":
+		return s + "listed on " + c.Blacklist + " (" + c.Status + ")"
+	default:
+		return s + c.Change
+	}
+}
+
+// notification returns the notification of a change
+func (c watchChange) notification() notification {
+	return notification{
+		Time:      c.Time,
+		Source:    "watch",
+		Summary:   c.describe(),
+		Reference: c.Reference,
+		Event:     c,
+		Key:       strings.Join([]string{"watch", c.Target, c.Value, c.Change, c.URL, c.Status, c.SHA256, c.Blacklist}, "|"),
+	}
+}
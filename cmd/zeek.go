@@ -0,0 +1,192 @@
+// Copyright © 2019 En-Hao Hu <enhao.mobile@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	zeekSource string
+	zeekTypes  []string
+)
+
+// zeekCmd represents the zeek command
+var zeekCmd = &cobra.Command{
+	Use:   "zeek",
+	Short: "Export indicators as a Zeek Intel framework file",
+	Long: `This command exports malware URLs, their hosts and malware payload hashes
+as a Zeek Intel framework file, to be loaded with Intel::read_files.
+
+URLs are written without their scheme, as seen by Zeek, hosts as
+Intel::DOMAIN or Intel::ADDR and payloads as Intel::FILE_HASH (both the MD5
+and the SHA256 hash). The description holds the signature and tags.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		types := map[string]bool{}
+		for _, t := range zeekTypes {
+			types[strings.ToUpper(t)] = true
+		}
+
+		results, err := exportResults()
+		if err != nil {
+			log.Fatal(err)
+		}
+		entries, err := exportURLEntries(results)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		w, done, err := exportWriter()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Fprintln(w, "#fields\tindicator\tindicator_type\tmeta.source\tmeta.desc\tmeta.url")
+
+		if types["URL"] {
+			for _, e := range entries {
+				_, host, uri, err := splitURL(e.URL)
+				if err != nil {
+					continue
+				}
+				writeZeekIntel(w, host+uri, "Intel::URL", zeekDesc(e.Signature, e.Tags), e.Reference)
+			}
+		}
+
+		if types["DOMAIN"] || types["ADDR"] {
+			// describe each host with everything known about its URLs
+			hosts := map[string][]urlEntry{}
+			for _, e := range entries {
+				h := strings.Trim(strings.ToLower(e.Host), "[]")
+				if h != "" {
+					hosts[h] = append(hosts[h], e)
+				}
+			}
+			for _, h := range sortedHosts(hosts) {
+				typ := "DOMAIN"
+				if isIP(h) {
+					typ = "ADDR"
+				}
+				if !types[typ] {
+					continue
+				}
+
+				var sigs, tags []string
+				for _, e := range hosts[h] {
+					sigs = appendUnique(sigs, e.Signature)
+					tags = appendUnique(tags, e.Tags...)
+				}
+				writeZeekIntel(w, h, "Intel::"+typ, zeekDesc(strings.Join(sigs, ","), tags), "https://urlhaus.abuse.ch/host/"+h+"/")
+			}
+		}
+
+		if types["FILE_HASH"] {
+			for _, p := range collectPayloads(results) {
+				desc := zeekDesc(p.Signature, nil)
+				writeZeekIntel(w, p.SHA256, "Intel::FILE_HASH", desc, p.Reference)
+				writeZeekIntel(w, p.MD5, "Intel::FILE_HASH", desc, p.Reference)
+			}
+		}
+
+		if err := done(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	exportCmd.AddCommand(zeekCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// zeekCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// zeekCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	zeekCmd.Flags().StringVar(&zeekSource, "source", "URLhaus", "The meta.source of the indicators")
+	zeekCmd.Flags().StringSliceVar(&zeekTypes, "types", []string{"url", "domain", "addr", "file_hash"}, "The indicator types to export")
+}
+
+// zeekField makes a value safe for a Zeek TSV field
+func zeekField(s string) string {
+	s = strings.NewReplacer("\t", " ", "\r", " ", "\n", " ").Replace(strings.TrimSpace(s))
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func writeZeekIntel(w io.Writer, indicator, typ, desc, url string) {
+	if indicator == "" {
+		return
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", zeekField(indicator), typ, zeekField(zeekSource), zeekField(desc), zeekField(url))
+}
+
+// zeekDesc describes an indicator by its signature and tags
+func zeekDesc(signature string, tags []string) string {
+	var parts []string
+	if signature != "" {
+		parts = append(parts, "signature: "+signature)
+	}
+	if len(tags) > 0 {
+		parts = append(parts, "tags: "+strings.Join(tags, ","))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// appendUnique appends the non-empty values not already in s
+func appendUnique(s []string, values ...string) []string {
+	for _, v := range values {
+		found := v == ""
+		for _, x := range s {
+			if x == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			s = append(s, v)
+		}
+	}
+	return s
+}
+
+// sortedHosts returns the hosts of a grouping in order
+func sortedHosts(m map[string][]urlEntry) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}